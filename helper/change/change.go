@@ -0,0 +1,138 @@
+// Package change implements client-side report-by-exception for modules that
+// poll their values. A value is reported when it or its status changed, when
+// it left the deadband around the last reported value or when the heartbeat
+// interval passed since it was last reported.
+package change
+
+import (
+	"errors"
+	"math"
+	"reflect"
+	"sync"
+	"time"
+)
+
+// Config holds the report-by-exception settings of a node.
+type Config struct {
+	Enabled         bool          `config:"enabled"`
+	Deadband        float64       `config:"deadband"`
+	DeadbandPercent float64       `config:"deadbandPercent"`
+	Heartbeat       time.Duration `config:"heartbeat"`
+}
+
+// Validate checks the configuration. It is called by the config unpacker.
+func (c *Config) Validate() error {
+	if c.Deadband < 0 {
+		return errors.New("deadband must not be negative")
+	}
+	if c.DeadbandPercent < 0 || c.DeadbandPercent > 100 {
+		return errors.New("deadbandPercent must be between 0 and 100")
+	}
+	if c.Heartbeat < 0 {
+		return errors.New("heartbeat must not be negative")
+	}
+	return nil
+}
+
+type state struct {
+	value    interface{}
+	status   string
+	reported time.Time
+}
+
+// Detector remembers the last reported value of every node.
+type Detector struct {
+	mutex sync.Mutex
+	last  map[string]state
+}
+
+// NewDetector creates a detector without any reported values.
+func NewDetector() *Detector {
+	return &Detector{
+		last: make(map[string]state),
+	}
+}
+
+// Report decides whether the value of a node has to be reported and remembers
+// it if so. The first value of every node is always reported.
+func (d *Detector) Report(config *Config, key string, value interface{}, status string, now time.Time) bool {
+	if config == nil || !config.Enabled {
+		return true
+	}
+
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+
+	last, found := d.last[key]
+	if found && !changed(config, last, value, status) {
+		if config.Heartbeat == 0 || now.Sub(last.reported) < config.Heartbeat {
+			return false
+		}
+	}
+	d.last[key] = state{value: value, status: status, reported: now}
+	return true
+}
+
+// Reset forgets all reported values, e.g. after a reconnect.
+func (d *Detector) Reset() {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+	d.last = make(map[string]state)
+}
+
+func changed(config *Config, last state, value interface{}, status string) bool {
+	if last.status != status {
+		return true
+	}
+
+	old, oldIsNumber := toFloat64(last.value)
+	current, currentIsNumber := toFloat64(value)
+	if !oldIsNumber || !currentIsNumber {
+		return !reflect.DeepEqual(last.value, value)
+	}
+	if math.IsNaN(old) || math.IsNaN(current) {
+		return math.IsNaN(old) != math.IsNaN(current)
+	}
+
+	diff := math.Abs(current - old)
+	if config.Deadband == 0 && config.DeadbandPercent == 0 {
+		return diff != 0
+	}
+	if config.Deadband > 0 && diff > config.Deadband {
+		return true
+	}
+	if config.DeadbandPercent > 0 && diff > math.Abs(old)*config.DeadbandPercent/100 {
+		return true
+	}
+	return false
+}
+
+func toFloat64(value interface{}) (float64, bool) {
+	switch v := value.(type) {
+	case float32:
+		return float64(v), true
+	case float64:
+		return v, true
+	case int:
+		return float64(v), true
+	case int8:
+		return float64(v), true
+	case int16:
+		return float64(v), true
+	case int32:
+		return float64(v), true
+	case int64:
+		return float64(v), true
+	case uint:
+		return float64(v), true
+	case uint8:
+		return float64(v), true
+	case uint16:
+		return float64(v), true
+	case uint32:
+		return float64(v), true
+	case uint64:
+		return float64(v), true
+	}
+	return 0, false
+}
@@ -0,0 +1,103 @@
+// Package ssl holds the ssl settings of the modules that connect to MQTT
+// brokers. These are the common ssl.* settings of the beats with the server
+// name used for SNI and hostname verification.
+package ssl
+
+import (
+	"crypto/tls"
+	"fmt"
+
+	"github.com/elastic/beats/v7/libbeat/common"
+	"github.com/elastic/beats/v7/libbeat/common/cfgwarn"
+	"github.com/elastic/beats/v7/libbeat/common/transport/tlscommon"
+)
+
+// Config holds the ssl settings of the connection to a broker. ssl: true
+// enables TLS with the default settings.
+type Config struct {
+	TLS        tlscommon.Config `config:",inline"`
+	ServerName string           `config:"server_name"`
+
+	loaded *tlscommon.TLSConfig
+}
+
+// config has the fields of a Config without its Unpack method.
+type config Config
+
+// Unpack accepts a boolean or an object with the ssl settings. It is called
+// by the config unpacker.
+func (c *Config) Unpack(value interface{}) error {
+	switch v := value.(type) {
+	case bool:
+		*c = Config{}
+		c.TLS.Enabled = &v
+	case map[string]interface{}:
+		cfg, err := common.NewConfigFrom(v)
+		if err != nil {
+			return err
+		}
+		var ssl config
+		if err := cfg.Unpack(&ssl); err != nil {
+			return err
+		}
+		*c = Config(ssl)
+		// Like in all beats the ssl settings are enabled unless enabled is false
+		if c.TLS.Enabled == nil {
+			enabled := true
+			c.TLS.Enabled = &enabled
+		}
+	default:
+		return fmt.Errorf("ssl must be true, false or an object, got %v", value)
+	}
+	return nil
+}
+
+// Enabled returns true if TLS is enabled.
+func (c *Config) Enabled() bool {
+	return c.TLS.Enabled != nil && *c.TLS.Enabled
+}
+
+// MergeLegacy adds the deprecated settings CA, clientCert and clientKey to the
+// ssl settings.
+func (c *Config) MergeLegacy(ca, clientCert, clientKey string) {
+	if !c.Enabled() {
+		return
+	}
+	if ca != "" {
+		cfgwarn.Deprecate("", "The setting CA is deprecated, use ssl.certificate_authorities.")
+		c.TLS.CAs = append(c.TLS.CAs, ca)
+	}
+	if clientCert != "" && c.TLS.Certificate.Certificate == "" {
+		cfgwarn.Deprecate("", "The settings clientCert and clientKey are deprecated, use ssl.certificate and ssl.key.")
+		c.TLS.Certificate.Certificate = clientCert
+		c.TLS.Certificate.Key = clientKey
+	}
+}
+
+// Load reads the certificates and keys of the settings. Errors are returned
+// while the configuration is validated.
+func (c *Config) Load() error {
+	if !c.Enabled() {
+		return nil
+	}
+	loaded, err := tlscommon.LoadTLSConfig(&c.TLS)
+	if err != nil {
+		return fmt.Errorf("invalid ssl settings: %v", err)
+	}
+	c.loaded = loaded
+	return nil
+}
+
+// ClientConfig returns the TLS configuration of the connection to a broker,
+// or nil if ssl is not enabled or not loaded. The server name defaults to the
+// host of the broker.
+func (c *Config) ClientConfig(host string) *tls.Config {
+	if !c.Enabled() || c.loaded == nil {
+		return nil
+	}
+	serverName := c.ServerName
+	if serverName == "" {
+		serverName = host
+	}
+	return c.loaded.BuildModuleClientConfig(serverName)
+}
@@ -0,0 +1,242 @@
+// Package transform converts raw machine values into engineering values.
+// It is shared by the modules that read values from nodes or tags.
+package transform
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"strconv"
+)
+
+// Config holds the transformations of a single node. The transformations are
+// applied in this order: bit extraction, enum mapping, linear scaling, unit
+// conversion and clamping. A value that is mapped by the enum is not
+// transformed any further.
+type Config struct {
+	Bit       *uint             `config:"bit"`
+	BitLength uint              `config:"bitLength"`
+	Enum      map[string]string `config:"enum"`
+	Scale     *float64          `config:"scale"`
+	Offset    float64           `config:"offset"`
+	RawMin    *float64          `config:"rawMin"`
+	RawMax    *float64          `config:"rawMax"`
+	ScaledMin *float64          `config:"scaledMin"`
+	ScaledMax *float64          `config:"scaledMax"`
+	Unit      string            `config:"unit"`
+	ConvertTo string            `config:"convertTo"`
+	Min       *float64          `config:"min"`
+	Max       *float64          `config:"max"`
+}
+
+// Validate checks the configuration. It is called by the config unpacker.
+func (c *Config) Validate() error {
+	if c.BitLength > 64 {
+		return errors.New("bitLength must not be larger than 64")
+	}
+	if c.BitLength > 0 && c.Bit == nil {
+		return errors.New("bitLength requires bit")
+	}
+	if c.Bit != nil && *c.Bit > 63 {
+		return errors.New("bit must be between 0 and 63")
+	}
+	ranges := 0
+	for _, v := range []*float64{c.RawMin, c.RawMax, c.ScaledMin, c.ScaledMax} {
+		if v != nil {
+			ranges++
+		}
+	}
+	if ranges != 0 && ranges != 4 {
+		return errors.New("rawMin, rawMax, scaledMin and scaledMax must be configured together")
+	}
+	if ranges == 4 && *c.RawMin == *c.RawMax {
+		return errors.New("rawMin and rawMax must not be equal")
+	}
+	if ranges == 4 && c.Scale != nil {
+		return errors.New("scale can't be combined with rawMin, rawMax, scaledMin and scaledMax")
+	}
+	if c.ConvertTo != "" {
+		if _, err := convert(1, c.Unit, c.ConvertTo); err != nil {
+			return err
+		}
+	}
+	if c.Min != nil && c.Max != nil && *c.Min > *c.Max {
+		return errors.New("min must not be larger than max")
+	}
+	return nil
+}
+
+// Enabled reports whether any transformation is configured.
+func (c *Config) Enabled() bool {
+	return c != nil && (c.Bit != nil || len(c.Enum) > 0 || c.Scale != nil || c.Offset != 0 ||
+		c.RawMin != nil || c.ConvertTo != "" || c.Min != nil || c.Max != nil)
+}
+
+// OutputUnit returns the unit of the transformed value.
+func (c *Config) OutputUnit() string {
+	if c == nil {
+		return ""
+	}
+	if c.ConvertTo != "" {
+		return c.ConvertTo
+	}
+	return c.Unit
+}
+
+// Apply transforms a raw value. Bit extraction returns a bool for single bits
+// and an uint64 otherwise, enum mapping returns a string and every other
+// transformation returns a float64.
+func (c *Config) Apply(raw interface{}) (interface{}, error) {
+	var value interface{} = raw
+
+	if c.Bit != nil {
+		word, ok := toUint64(value)
+		if !ok {
+			return nil, fmt.Errorf("bit extraction requires an integer, got %T", value)
+		}
+		length := c.BitLength
+		if length == 0 {
+			length = 1
+		}
+		bits := word >> *c.Bit
+		if length < 64 {
+			bits &= (uint64(1) << length) - 1
+		}
+		if length == 1 {
+			value = bits == 1
+		} else {
+			value = bits
+		}
+	}
+
+	if len(c.Enum) > 0 {
+		if text, found := c.Enum[enumKey(value)]; found {
+			return text, nil
+		}
+	}
+
+	if c.Scale == nil && c.Offset == 0 && c.RawMin == nil && c.ConvertTo == "" && c.Min == nil && c.Max == nil {
+		return value, nil
+	}
+
+	f, ok := toFloat64(value)
+	if !ok {
+		return nil, fmt.Errorf("scaling requires a number, got %T", value)
+	}
+
+	if c.RawMin != nil {
+		f = *c.ScaledMin + (f-*c.RawMin)*(*c.ScaledMax-*c.ScaledMin)/(*c.RawMax-*c.RawMin)
+	}
+	if c.Scale != nil {
+		f = f * *c.Scale
+	}
+	f += c.Offset
+
+	if c.ConvertTo != "" {
+		converted, err := convert(f, c.Unit, c.ConvertTo)
+		if err != nil {
+			return nil, err
+		}
+		f = converted
+	}
+
+	if c.Min != nil {
+		f = math.Max(f, *c.Min)
+	}
+	if c.Max != nil {
+		f = math.Min(f, *c.Max)
+	}
+	return f, nil
+}
+
+// enumKey returns the key used to look up a value in the enum map.
+func enumKey(value interface{}) string {
+	switch v := value.(type) {
+	case bool:
+		return strconv.FormatBool(v)
+	case string:
+		return v
+	}
+	if i, ok := toInt64(value); ok {
+		return strconv.FormatInt(i, 10)
+	}
+	return fmt.Sprint(value)
+}
+
+func toFloat64(value interface{}) (float64, bool) {
+	switch v := value.(type) {
+	case float32:
+		return float64(v), true
+	case float64:
+		return v, true
+	case bool:
+		if v {
+			return 1, true
+		}
+		return 0, true
+	}
+	if i, ok := toInt64(value); ok {
+		return float64(i), true
+	}
+	if u, ok := toUint64(value); ok {
+		return float64(u), true
+	}
+	return 0, false
+}
+
+func toInt64(value interface{}) (int64, bool) {
+	switch v := value.(type) {
+	case int:
+		return int64(v), true
+	case int8:
+		return int64(v), true
+	case int16:
+		return int64(v), true
+	case int32:
+		return int64(v), true
+	case int64:
+		return v, true
+	case uint8:
+		return int64(v), true
+	case uint16:
+		return int64(v), true
+	case uint32:
+		return int64(v), true
+	case uint64:
+		if v <= math.MaxInt64 {
+			return int64(v), true
+		}
+	}
+	return 0, false
+}
+
+func toUint64(value interface{}) (uint64, bool) {
+	switch v := value.(type) {
+	case uint:
+		return uint64(v), true
+	case uint8:
+		return uint64(v), true
+	case uint16:
+		return uint64(v), true
+	case uint32:
+		return uint64(v), true
+	case uint64:
+		return v, true
+	case int8:
+		return uint64(uint8(v)), true
+	case int16:
+		return uint64(uint16(v)), true
+	case int32:
+		return uint64(uint32(v)), true
+	case int64:
+		return uint64(v), true
+	case int:
+		return uint64(v), true
+	case bool:
+		if v {
+			return 1, true
+		}
+		return 0, true
+	}
+	return 0, false
+}
@@ -0,0 +1,99 @@
+package transform
+
+import (
+	"fmt"
+	"strings"
+)
+
+// unit describes a unit by its quantity and the linear conversion into the
+// base unit of the quantity: base = value * factor + offset
+type unit struct {
+	quantity string
+	factor   float64
+	offset   float64
+}
+
+var units = map[string]unit{
+	// temperature, base degC
+	"degc":    {"temperature", 1, 0},
+	"°c":      {"temperature", 1, 0},
+	"celsius": {"temperature", 1, 0},
+	"degf":    {"temperature", 5.0 / 9.0, -32 * 5.0 / 9.0},
+	"°f":      {"temperature", 5.0 / 9.0, -32 * 5.0 / 9.0},
+	"k":       {"temperature", 1, -273.15},
+	"kelvin":  {"temperature", 1, -273.15},
+
+	// length, base m
+	"mm": {"length", 0.001, 0},
+	"cm": {"length", 0.01, 0},
+	"m":  {"length", 1, 0},
+	"km": {"length", 1000, 0},
+	"in": {"length", 0.0254, 0},
+	"ft": {"length", 0.3048, 0},
+
+	// pressure, base Pa
+	"pa":   {"pressure", 1, 0},
+	"hpa":  {"pressure", 100, 0},
+	"kpa":  {"pressure", 1000, 0},
+	"mpa":  {"pressure", 1e6, 0},
+	"mbar": {"pressure", 100, 0},
+	"bar":  {"pressure", 1e5, 0},
+	"psi":  {"pressure", 6894.757293168, 0},
+	"atm":  {"pressure", 101325, 0},
+
+	// mass, base kg
+	"g":  {"mass", 0.001, 0},
+	"kg": {"mass", 1, 0},
+	"t":  {"mass", 1000, 0},
+	"lb": {"mass", 0.45359237, 0},
+
+	// time, base s
+	"ms":  {"time", 0.001, 0},
+	"s":   {"time", 1, 0},
+	"min": {"time", 60, 0},
+	"h":   {"time", 3600, 0},
+
+	// volume flow, base m3/h
+	"m3/h":  {"flow", 1, 0},
+	"l/min": {"flow", 0.06, 0},
+	"l/s":   {"flow", 3.6, 0},
+	"gpm":   {"flow", 0.2271247, 0},
+
+	// speed, base m/s
+	"m/s":  {"speed", 1, 0},
+	"km/h": {"speed", 1 / 3.6, 0},
+	"mph":  {"speed", 0.44704, 0},
+	"rpm":  {"rotation", 1, 0},
+	"1/s":  {"rotation", 60, 0},
+
+	// electrical, base A, V, W and J
+	"ma":  {"current", 0.001, 0},
+	"a":   {"current", 1, 0},
+	"mv":  {"voltage", 0.001, 0},
+	"v":   {"voltage", 1, 0},
+	"kv":  {"voltage", 1000, 0},
+	"w":   {"power", 1, 0},
+	"kw":  {"power", 1000, 0},
+	"hp":  {"power", 745.69987158, 0},
+	"j":   {"energy", 1, 0},
+	"kj":  {"energy", 1000, 0},
+	"wh":  {"energy", 3600, 0},
+	"kwh": {"energy", 3.6e6, 0},
+}
+
+// convert converts a value between two units of the same quantity.
+func convert(value float64, from string, to string) (float64, error) {
+	fromUnit, found := units[strings.ToLower(from)]
+	if !found {
+		return 0, fmt.Errorf("unknown unit %q", from)
+	}
+	toUnit, found := units[strings.ToLower(to)]
+	if !found {
+		return 0, fmt.Errorf("unknown unit %q", to)
+	}
+	if fromUnit.quantity != toUnit.quantity {
+		return 0, fmt.Errorf("can't convert %v (%v) to %v (%v)", from, fromUnit.quantity, to, toUnit.quantity)
+	}
+	base := value*fromUnit.factor + fromUnit.offset
+	return (base - toUnit.offset) / toUnit.factor, nil
+}
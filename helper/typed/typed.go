@@ -0,0 +1,55 @@
+// Package typed publishes values with the fields of the OPC UA module. The
+// name of the Go type of a value is published in value.datatype and the value
+// in value.value_<type>, so every type is indexed in its own field. Values of
+// other types, like lists and objects, are published in value.value.
+package typed
+
+import (
+	"math"
+	"reflect"
+	"time"
+
+	"github.com/elastic/beats/v7/libbeat/common"
+)
+
+// DataType returns the name of the type of a value like the OPC UA module,
+// e.g. float32 or time.Time, bytes are named byte. It returns an empty string
+// for values that are published in value.value.
+func DataType(value interface{}) string {
+	switch value.(type) {
+	case nil:
+		return ""
+	case time.Time:
+		return "time.Time"
+	case time.Duration:
+		return "time.Duration"
+	}
+	switch kind := reflect.TypeOf(value).Kind(); kind {
+	case reflect.Uint8:
+		return "byte"
+	case reflect.Bool, reflect.String,
+		reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+		reflect.Uint, reflect.Uint16, reflect.Uint32, reflect.Uint64,
+		reflect.Float32, reflect.Float64:
+		// Named types are published with their underlying type
+		return kind.String()
+	}
+	return ""
+}
+
+// Put adds a value to fields in value.datatype and value.value_<type>, or in
+// value.value if it has no data type. NaN can't be indexed and is left out.
+func Put(fields common.MapStr, value interface{}) {
+	dataType := DataType(value)
+	if dataType == "" {
+		fields.Put("value.value", value)
+		return
+	}
+	fields.Put("value.datatype", dataType)
+	if v := reflect.ValueOf(value); v.Kind() == reflect.Float32 || v.Kind() == reflect.Float64 {
+		if math.IsNaN(v.Float()) {
+			return
+		}
+	}
+	fields.Put("value.value_"+dataType, value)
+}
@@ -27,9 +27,11 @@ package include
 
 import (
 	_ "github.com/elastic/machinebeat/module/mqtt"
+	_ "github.com/elastic/machinebeat/module/mqtt/broker"
 	_ "github.com/elastic/machinebeat/module/mqtt/topic"
 	_ "github.com/elastic/machinebeat/module/opcua"
 	_ "github.com/elastic/machinebeat/module/opcua/nodevalue"
+	_ "github.com/elastic/machinebeat/module/opcua/pubsub"
 	_ "github.com/elastic/machinebeat/module/plc4x"
 	_ "github.com/elastic/machinebeat/module/plc4x/value"
 )
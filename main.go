@@ -7,6 +7,7 @@ import (
 
 	// Make sure all your modules and metricsets are linked in this file
 	_ "github.com/elastic/machinebeat/include"
+	_ "github.com/elastic/machinebeat/output/mqtt"
 )
 
 func main() {
@@ -0,0 +1,108 @@
+package broker
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"time"
+
+	"github.com/elastic/beats/v7/libbeat/common"
+	"github.com/elastic/beats/v7/libbeat/common/cfgwarn"
+	"github.com/elastic/beats/v7/metricbeat/mb"
+
+	"github.com/elastic/machinebeat/helper/ssl"
+)
+
+// init registers the MetricSet with the central registry as soon as the program
+// starts. The New function will be called later to instantiate an instance of
+// the MetricSet for each host defined in the module's configuration. After the
+// MetricSet has been created then Fetch will begin to be called periodically.
+func init() {
+	mb.Registry.MustAddMetricSet("mqtt", "broker", New)
+}
+
+// MetricSet holds any configuration or state information. It must implement
+// the mb.MetricSet interface. And this is best achieved by embedding
+// mb.BaseMetricSet because it implements all of the required mb.MetricSet
+// interface methods except for Fetch.
+type MetricSet struct {
+	mb.BaseMetricSet
+	BrokerURL      string     `config:"host"`
+	BrokerUsername string     `config:"user"`
+	BrokerPassword string     `config:"password"`
+	ClientID       string     `config:"clientID"`
+	Topics         []string   `config:"broker_topics"`
+	RawStats       bool       `config:"broker_raw_stats"`
+	SSL            ssl.Config `config:"ssl"`
+
+	client *client
+	stats  *stats
+}
+
+var DefaultConfig = MetricSet{
+	BrokerURL: "localhost",
+	Topics:    []string{"$SYS/#"},
+}
+
+// New creates a new instance of the MetricSet. New is responsible for unpacking
+// any MetricSet specific configuration options if there are any.
+func New(base mb.BaseMetricSet) (mb.MetricSet, error) {
+	cfgwarn.Beta("The MQTT broker metricset is beta.")
+
+	config := DefaultConfig
+	if err := base.Module().UnpackConfig(&config); err != nil {
+		return nil, err
+	}
+	if err := config.SSL.Load(); err != nil {
+		return nil, err
+	}
+
+	metricset := &MetricSet{
+		BaseMetricSet:  base,
+		BrokerURL:      config.BrokerURL,
+		BrokerUsername: config.BrokerUsername,
+		BrokerPassword: config.BrokerPassword,
+		ClientID:       brokerClientID(config.ClientID),
+		Topics:         config.Topics,
+		SSL:            config.SSL,
+		RawStats:       config.RawStats,
+		stats:          newStats(config.RawStats),
+	}
+	metricset.client = newClient(metricset)
+	return metricset, nil
+}
+
+// brokerClientID returns the client ID of the metricset. The topic metricset
+// of the same module block uses the configured clientID, without one the ID
+// gets a random suffix.
+func brokerClientID(clientID string) string {
+	if clientID != "" {
+		return clientID + "-broker"
+	}
+	suffix := make([]byte, 4)
+	if _, err := rand.Read(suffix); err != nil {
+		return "Machinebeat-broker"
+	}
+	return "Machinebeat-broker-" + hex.EncodeToString(suffix)
+}
+
+// Fetch publishes a document per broker node with the latest statistics the
+// broker has published on its $SYS topics.
+func (m *MetricSet) Fetch(report mb.ReporterV2) error {
+	for _, event := range m.stats.events() {
+		report.Event(mb.Event{
+			MetricSetFields: event,
+			RootFields: common.MapStr{
+				"event.provider": "mqtt",
+				"event.url":      m.BrokerURL,
+				"event.creation": time.Now(),
+			},
+		})
+	}
+	return nil
+}
+
+// Close disconnects from the broker.
+func (m *MetricSet) Close() error {
+	m.client.disconnect()
+	return nil
+}
@@ -0,0 +1,79 @@
+package broker
+
+import (
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/elastic/beats/v7/libbeat/logp"
+
+	MQTT "github.com/eclipse/paho.mqtt.golang"
+)
+
+// client subscribes to the $SYS topics of the broker and adds the received
+// statistics to the stats of the MetricSet.
+type client struct {
+	config *MetricSet
+	mqtt   MQTT.Client
+}
+
+func newClient(config *MetricSet) *client {
+	c := &client{config: config}
+
+	logp.Info("[MQTT] Connect to broker URL %s to collect its statistics", config.BrokerURL)
+	opts := MQTT.NewClientOptions()
+	opts.AddBroker(config.BrokerURL)
+	opts.SetClientID(config.ClientID)
+	opts.SetAutoReconnect(true)
+	opts.SetConnectRetry(true)
+	opts.SetConnectRetryInterval(5 * time.Second)
+	opts.SetMaxReconnectInterval(5 * time.Second)
+	opts.SetOnConnectHandler(c.subscribeOnConnect)
+	opts.SetConnectionLostHandler(func(_ MQTT.Client, reason error) {
+		logp.Warn("[MQTT] Connection to broker lost: %s", reason.Error())
+	})
+	if config.BrokerUsername != "" {
+		opts.SetUsername(config.BrokerUsername)
+		opts.SetPassword(config.BrokerPassword)
+	}
+	if tlsConfig := config.SSL.ClientConfig(brokerHostname(config.BrokerURL)); tlsConfig != nil {
+		opts.SetTLSConfig(tlsConfig)
+	}
+
+	// With ConnectRetry the client connects in the background
+	c.mqtt = MQTT.NewClient(opts)
+	c.mqtt.Connect()
+	return c
+}
+
+func (c *client) subscribeOnConnect(mqtt MQTT.Client) {
+	subscriptions := make(map[string]byte)
+	for _, topic := range c.config.Topics {
+		subscriptions[topic] = 0
+		logp.Info("[MQTT] Subscribe to %v", topic)
+	}
+	if token := mqtt.SubscribeMultiple(subscriptions, c.onMessage); token.Wait() && token.Error() != nil {
+		logp.Error(token.Error())
+	}
+}
+
+func (c *client) onMessage(_ MQTT.Client, msg MQTT.Message) {
+	c.config.stats.update(msg.Topic(), string(msg.Payload()))
+}
+
+// brokerHostname returns the hostname of the broker URL, which is used for SNI
+// and to verify the certificate of the broker.
+func brokerHostname(brokerURL string) string {
+	if !strings.Contains(brokerURL, "://") {
+		brokerURL = "tcp://" + brokerURL
+	}
+	u, err := url.Parse(brokerURL)
+	if err != nil {
+		return ""
+	}
+	return u.Hostname()
+}
+
+func (c *client) disconnect() {
+	c.mqtt.Disconnect(250)
+}
@@ -0,0 +1,239 @@
+package broker
+
+import (
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/elastic/beats/v7/libbeat/common"
+)
+
+// Broker implementations, detected from the $SYS topics and the version
+const (
+	implementationMosquitto = "mosquitto"
+	implementationHiveMQ    = "hivemq"
+	implementationEMQX      = "emqx"
+)
+
+// statFields maps the $SYS statistics of the brokers to the fields they are
+// published in, so that the documents of all brokers can be compared. The
+// statistics are named after their topic levels below $SYS/broker or
+// $SYS/brokers/<node>.
+var statFields = map[string]string{
+	// Mosquitto and the $SYS topic extension of HiveMQ
+	"clients/connected":       "clients.connected",
+	"messages/received":       "messages.received",
+	"messages/sent":           "messages.sent",
+	"bytes/received":          "bytes.received",
+	"bytes/sent":              "bytes.sent",
+	"retained messages/count": "messages.retained",
+	"messages/retained/count": "messages.retained",
+	"subscriptions/count":     "subscriptions.count",
+	// EMQX
+	"stats/connections/count":   "clients.connected",
+	"metrics/messages/received": "messages.received",
+	"metrics/messages/sent":     "messages.sent",
+	"metrics/bytes/received":    "bytes.received",
+	"metrics/bytes/sent":        "bytes.sent",
+	"stats/retained/count":      "messages.retained",
+	"stats/subscriptions/count": "subscriptions.count",
+}
+
+// nodeStats holds the latest statistics of a broker node.
+type nodeStats struct {
+	implementation string
+	version        string
+	fields         map[string]int64
+	raw            map[string]interface{}
+	updated        time.Time
+}
+
+// stats collects the statistics that the brokers publish on $SYS topics.
+// Mosquitto and the $SYS extension of HiveMQ use $SYS/broker/<stat>, EMQX
+// uses $SYS/brokers/<node>/<stat> with one node per cluster member. The well
+// known statistics are published in fixed fields, with broker_raw_stats all
+// numeric statistics are published in stats as well.
+type stats struct {
+	raw   bool
+	mutex sync.Mutex
+	nodes map[string]*nodeStats
+}
+
+func newStats(raw bool) *stats {
+	return &stats{raw: raw, nodes: make(map[string]*nodeStats)}
+}
+
+// update adds the payload of a $SYS topic to the statistics. Payloads that
+// are neither numbers nor known text statistics are ignored.
+func (s *stats) update(topic string, payload string) {
+	levels := strings.Split(topic, "/")
+	if len(levels) < 3 || levels[0] != "$SYS" {
+		return
+	}
+
+	var node, implementation string
+	var stat []string
+	switch levels[1] {
+	case "broker":
+		stat = levels[2:]
+	case "brokers":
+		if len(levels) < 4 {
+			return
+		}
+		node, implementation, stat = levels[2], implementationEMQX, levels[3:]
+		// Client events of EMQX aren't statistics
+		if stat[0] == "clients" {
+			return
+		}
+	default:
+		return
+	}
+	payload = strings.TrimSpace(payload)
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	n, found := s.nodes[node]
+	if !found {
+		n = &nodeStats{
+			implementation: implementation,
+			fields:         make(map[string]int64),
+			raw:            make(map[string]interface{}),
+		}
+		s.nodes[node] = n
+	}
+	n.updated = time.Now()
+
+	name := strings.Join(stat, "/")
+	switch name {
+	case "version":
+		n.version = payload
+		if n.implementation == "" {
+			n.implementation = detectImplementation(payload)
+		}
+		return
+	case "uptime":
+		if uptime, ok := parseUptime(payload); ok {
+			n.fields["uptime.sec"] = int64(uptime)
+		} else if ms, err := strconv.ParseFloat(payload, 64); err == nil && n.implementation == implementationEMQX {
+			// EMQX 5 publishes the uptime in milliseconds
+			n.fields["uptime.sec"] = int64(ms / 1000)
+		}
+		return
+	}
+	value, ok := parseNumber(payload)
+	if !ok {
+		return
+	}
+	if field, found := statFields[name]; found {
+		switch v := value.(type) {
+		case int64:
+			n.fields[field] = v
+		case float64:
+			n.fields[field] = int64(v)
+		}
+	}
+	if s.raw {
+		n.raw[rawStatName(stat)] = value
+	}
+}
+
+// rawStatName joins the topic levels of a statistic with underscores. The
+// names are never nested, so a statistic like messages/dropped of EMQX can't
+// conflict with messages/dropped/no_subscribers in the mapping.
+func rawStatName(levels []string) string {
+	name := strings.Join(levels, "_")
+	return strings.NewReplacer(".", "_", " ", "_").Replace(name)
+}
+
+// events returns a document per broker node with its latest statistics.
+func (s *stats) events() []common.MapStr {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	nodes := make([]string, 0, len(s.nodes))
+	for node := range s.nodes {
+		nodes = append(nodes, node)
+	}
+	sort.Strings(nodes)
+
+	var events []common.MapStr
+	for _, node := range nodes {
+		n := s.nodes[node]
+		event := common.MapStr{}
+		if n.implementation != "" {
+			event["implementation"] = n.implementation
+		}
+		if node != "" {
+			event["node"] = node
+		}
+		if n.version != "" {
+			event["version"] = n.version
+		}
+		for field, value := range n.fields {
+			event.Put(field, value)
+		}
+		if len(n.raw) > 0 {
+			raw := make(common.MapStr, len(n.raw))
+			for name, value := range n.raw {
+				raw[name] = value
+			}
+			event["stats"] = raw
+		}
+		events = append(events, event)
+	}
+	return events
+}
+
+func detectImplementation(version string) string {
+	version = strings.ToLower(version)
+	switch {
+	case strings.Contains(version, "mosquitto"):
+		return implementationMosquitto
+	case strings.Contains(version, "hivemq"):
+		return implementationHiveMQ
+	case strings.Contains(version, "emqx"):
+		return implementationEMQX
+	}
+	return ""
+}
+
+// parseNumber returns an int64 or float64 of a numeric payload.
+func parseNumber(payload string) (interface{}, bool) {
+	if i, err := strconv.ParseInt(payload, 10, 64); err == nil {
+		return i, true
+	}
+	if f, err := strconv.ParseFloat(payload, 64); err == nil {
+		return f, true
+	}
+	return nil, false
+}
+
+var uptimeUnits = regexp.MustCompile(`(\d+(?:\.\d+)?)\s*(day|hour|minute|second)s?`)
+
+// parseUptime returns the uptime in seconds of a text like "12345 seconds" of
+// Mosquitto or "1 days, 2 hours, 3 minutes, 4 seconds" of EMQX 4.
+func parseUptime(payload string) (float64, bool) {
+	matches := uptimeUnits.FindAllStringSubmatch(payload, -1)
+	if len(matches) == 0 {
+		return 0, false
+	}
+	var seconds float64
+	for _, match := range matches {
+		value, _ := strconv.ParseFloat(match[1], 64)
+		switch match[2] {
+		case "day":
+			seconds += value * 86400
+		case "hour":
+			seconds += value * 3600
+		case "minute":
+			seconds += value * 60
+		default:
+			seconds += value
+		}
+	}
+	return seconds, true
+}
@@ -0,0 +1,124 @@
+package broker
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/elastic/beats/v7/libbeat/common"
+)
+
+func TestStatsEvents(t *testing.T) {
+	tests := []struct {
+		name     string
+		raw      bool
+		messages map[string]string
+		want     []common.MapStr
+	}{
+		{
+			name: "mosquitto",
+			messages: map[string]string{
+				"$SYS/broker/version":                     "mosquitto version 2.0.18",
+				"$SYS/broker/uptime":                      "3725 seconds",
+				"$SYS/broker/clients/connected":           "12",
+				"$SYS/broker/messages/received":           "48213",
+				"$SYS/broker/messages/sent":               "96310",
+				"$SYS/broker/bytes/received":              "5128340",
+				"$SYS/broker/bytes/sent":                  "10370125",
+				"$SYS/broker/retained messages/count":     "37",
+				"$SYS/broker/subscriptions/count":         "54",
+				"$SYS/broker/load/messages/received/1min": "17.53",
+				"$SYS/broker/publish/messages/dropped":    "0",
+				"$SYS/broker/clients/disconnected":        "2",
+				"$SYS/broker/heap/current size":           "not a number",
+			},
+			want: []common.MapStr{{
+				"implementation": "mosquitto",
+				"version":        "mosquitto version 2.0.18",
+				"uptime":         common.MapStr{"sec": int64(3725)},
+				"clients":        common.MapStr{"connected": int64(12)},
+				"messages":       common.MapStr{"received": int64(48213), "sent": int64(96310), "retained": int64(37)},
+				"bytes":          common.MapStr{"received": int64(5128340), "sent": int64(10370125)},
+				"subscriptions":  common.MapStr{"count": int64(54)},
+			}},
+		},
+		{
+			name: "hivemq",
+			messages: map[string]string{
+				"$SYS/broker/version":                 "HiveMQ 4.20.0",
+				"$SYS/broker/messages/retained/count": "3",
+			},
+			want: []common.MapStr{{
+				"implementation": "hivemq",
+				"version":        "HiveMQ 4.20.0",
+				"messages":       common.MapStr{"retained": int64(3)},
+			}},
+		},
+		{
+			name: "emqx",
+			messages: map[string]string{
+				"$SYS/brokers/emqx@node1/version":                   "5.3.0",
+				"$SYS/brokers/emqx@node1/uptime":                    "3725000",
+				"$SYS/brokers/emqx@node1/stats/connections/count":   "12",
+				"$SYS/brokers/emqx@node1/metrics/messages/received": "48213",
+				"$SYS/brokers/emqx@node1/stats/retained/count":      "37",
+				"$SYS/brokers/emqx@node1/clients/press1/connected":  "{}",
+				"$SYS/brokers/emqx@node2/stats/connections/count":   "5",
+			},
+			want: []common.MapStr{
+				{
+					"implementation": "emqx",
+					"node":           "emqx@node1",
+					"version":        "5.3.0",
+					"uptime":         common.MapStr{"sec": int64(3725)},
+					"clients":        common.MapStr{"connected": int64(12)},
+					"messages":       common.MapStr{"received": int64(48213), "retained": int64(37)},
+				},
+				{
+					"implementation": "emqx",
+					"node":           "emqx@node2",
+					"clients":        common.MapStr{"connected": int64(5)},
+				},
+			},
+		},
+		{
+			name: "raw statistics",
+			raw:  true,
+			messages: map[string]string{
+				"$SYS/brokers/emqx@node1/metrics/messages/dropped":                "4",
+				"$SYS/brokers/emqx@node1/metrics/messages/dropped/no_subscribers": "3",
+				"$SYS/brokers/emqx@node1/stats/connections/count":                 "12",
+				"$SYS/brokers/emqx@node1/stats/load.avg":                          "0.5",
+			},
+			want: []common.MapStr{{
+				"implementation": "emqx",
+				"node":           "emqx@node1",
+				"clients":        common.MapStr{"connected": int64(12)},
+				"stats": common.MapStr{
+					"metrics_messages_dropped":                int64(4),
+					"metrics_messages_dropped_no_subscribers": int64(3),
+					"stats_connections_count":                 int64(12),
+					"stats_load_avg":                          0.5,
+				},
+			}},
+		},
+		{
+			name: "other topics",
+			messages: map[string]string{
+				"$SYS/broker":        "1",
+				"$SYS/other/clients": "1",
+				"plant/temperature":  "21",
+			},
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			s := newStats(test.raw)
+			for topic, payload := range test.messages {
+				s.update(topic, payload)
+			}
+			if got := s.events(); !reflect.DeepEqual(got, test.want) {
+				t.Errorf("got %v, want %v", got, test.want)
+			}
+		})
+	}
+}
@@ -1,84 +1,79 @@
 package topic
 
 import (
-	"crypto/tls"
-	"crypto/x509"
-	"io/ioutil"
+	"context"
+	"net"
+	"net/url"
+	"path/filepath"
 	"strings"
+	"sync/atomic"
 	"time"
 
 	"github.com/elastic/beats/v7/libbeat/common"
 	"github.com/elastic/beats/v7/libbeat/logp"
+	"github.com/elastic/beats/v7/libbeat/paths"
 	"github.com/elastic/beats/v7/metricbeat/mb"
 
 	MQTT "github.com/eclipse/paho.mqtt.golang"
 )
 
-var (
-	client    MQTT.Client
-	connected bool = false
-	config    *MetricSet
-	reporter  mb.ReporterV2
-	events    chan mb.Event
+// Supported MQTT protocol versions
+const (
+	protocolV311 = "3.1.1"
+	protocolV5   = "5"
 )
 
-func NewTLSConfig() *tls.Config {
-	// Import trusted certificates from CAfile.pem.
-	// Alternatively, manually add CA certificates to
-	// default openssl CA bundle.
-	certpool := x509.NewCertPool()
-	if config.CA != "" {
-		logp.Info("[MQTT] Set the CA")
-		pemCerts, err := ioutil.ReadFile(config.CA)
-		if err == nil {
-			certpool.AppendCertsFromPEM(pemCerts)
-		}
-	}
-
-	tlsconfig := &tls.Config{
-		// RootCAs = certs used to verify server cert.
-		RootCAs: certpool,
-		// ClientAuth = whether to request cert from server.
-		// Since the server is set up for SSL, this happens
-		// anyways.
-		ClientAuth: tls.NoClientCert,
-		// ClientCAs = certs used to validate client cert.
-		ClientCAs: nil,
-		// InsecureSkipVerify = verify that cert contents
-		// match server. IP matches what is in cert etc.
-		InsecureSkipVerify: true,
-	}
-
-	// Import client certificate/key pair
-	if config.ClientCert != "" && config.ClientKey != "" {
-		logp.Info("[MQTT] Set the Certs")
-		cert, err := tls.LoadX509KeyPair(config.ClientCert, config.ClientKey)
-		if err != nil {
-			panic(err)
-		}
+// Policies for a full event buffer
+const (
+	overflowBlock      = "block"
+	overflowDropNewest = "drop_newest"
+	overflowDropOldest = "drop_oldest"
+)
 
-		// Certificates = list of certs client sends to server.
-		tlsconfig.Certificates = []tls.Certificate{cert}
+// Prepare MQTT client
+func (m *MetricSet) setupMqttClient() error {
+	if m.Sparkplug.Enabled {
+		m.sparkplug = newSparkplugDecoder(m.Sparkplug)
+	}
+	// The buffer is kept across reconnects, so no buffered message is lost
+	m.events = make(chan mb.Event, m.BufferSize)
+	m.dropped = new(atomic.Uint64)
+	if m.Deduplication.Enabled {
+		m.dedup = newDeduplicator(m.Deduplication)
 	}
 
-	// Create tls.Config with desired tls properties
-	return tlsconfig
-}
+	if m.EmbeddedBroker.Enabled {
+		return m.setupEmbeddedBroker()
+	}
+	if m.ProtocolVersion == protocolV5 {
+		m.setupMqtt5Client()
+		return nil
+	}
 
-// Prepare MQTT client
-func setupMqttClient(m *MetricSet) {
 	logp.Info("[MQTT] Connect to broker URL: %s", m.BrokerURL)
-	config = m
 
 	mqttClientOpt := MQTT.NewClientOptions()
 	mqttClientOpt.SetClientID(m.ClientID)
 	mqttClientOpt.AddBroker(m.BrokerURL)
 
 	mqttClientOpt.SetMaxReconnectInterval(1 * time.Second)
-	mqttClientOpt.SetConnectionLostHandler(reConnectHandler)
-	mqttClientOpt.SetOnConnectHandler(subscribeOnConnect)
+	mqttClientOpt.SetConnectionLostHandler(m.reConnectHandler)
+	mqttClientOpt.SetOnConnectHandler(m.subscribeOnConnect)
 	mqttClientOpt.SetAutoReconnect(true)
 
+	if !m.CleanSession {
+		// The broker keeps the subscriptions and queues QoS 1 and 2 messages
+		// while the client is offline, the store keeps the in-flight messages
+		// of the client across restarts.
+		store := m.SessionStore
+		if store == "" {
+			store = paths.Resolve(paths.Data, filepath.Join("mqtt", m.ClientID))
+		}
+		logp.Info("[MQTT] Use persistent session with store %s", store)
+		mqttClientOpt.SetCleanSession(false)
+		mqttClientOpt.SetStore(MQTT.NewFileStore(store))
+	}
+
 	if m.BrokerUsername != "" {
 		logp.Info("[MQTT] Broker username: %s", m.BrokerUsername)
 		mqttClientOpt.SetUsername(m.BrokerUsername)
@@ -88,94 +83,184 @@ func setupMqttClient(m *MetricSet) {
 		mqttClientOpt.SetPassword(m.BrokerPassword)
 	}
 
-	if m.SSL == true {
+	if s := m.WillMessage; s != nil {
+		// The broker publishes the will if the connection is lost without a disconnect
+		mqttClientOpt.SetBinaryWill(s.Topic, m.statusPayload(s, "will", statusOffline), byte(s.QoS), s.Retain)
+	}
+
+	// Both clients use the same dialer for TLS, websockets and proxies
+	dialer := m.dialer()
+	if dialer.tlsConfig != nil {
 		logp.Info("[MQTT] Configure session to use SSL")
-		tlsconfig := NewTLSConfig()
-		mqttClientOpt.SetTLSConfig(tlsconfig)
 	}
+	if dialer.proxy != nil {
+		logp.Info("[MQTT] Connect through proxy %s", dialer.proxy.Redacted())
+	}
+	mqttClientOpt.SetCustomOpenConnectionFn(func(uri *url.URL, options MQTT.ClientOptions) (net.Conn, error) {
+		ctx, cancel := context.WithTimeout(context.Background(), options.ConnectTimeout)
+		defer cancel()
+		return dialer.dial(ctx, uri)
+	})
 
-	client = MQTT.NewClient(mqttClientOpt)
+	m.client = MQTT.NewClient(mqttClientOpt)
+	m.conn = &v3Connection{client: m.client}
 
-	connect(client)
+	m.connect(m.client)
+	return nil
 }
 
-func connect(client MQTT.Client) {
-	if !connected {
+func (m *MetricSet) connect(client MQTT.Client) {
+	if !m.connected {
 		if token := client.Connect(); token.Wait() && token.Error() != nil {
 			logp.Info("Failed to connect to broker, waiting 5 seconds and retrying")
 			time.Sleep(5 * time.Second)
-			connected = false
-			reConnectHandler(client, token.Error())
+			m.connected = false
+			m.reConnectHandler(client, token.Error())
 			return
 		}
-		connected = client.IsConnected()
+		m.connected = client.IsConnected()
 		logp.Info("MQTT Client connected: %t", client.IsConnected())
 		return
 	}
 }
 
-func subscribeOnConnect(client MQTT.Client) {
-	subscriptions := ParseTopics(config.TopicsSubscribe, config.QoS)
+func (m *MetricSet) subscribeOnConnect(client MQTT.Client) {
+	subscriptions := ParseTopics(m.TopicsSubscribe, m.QoS, m.ShareGroup)
 	//bt.beatConfig.TopicsSubscribe
 
 	// Mqtt client - Subscribe to every topic in the config file, and bind with message handler
-	if token := client.SubscribeMultiple(subscriptions, onMessage); token.Wait() && token.Error() != nil {
+	if token := client.SubscribeMultiple(subscriptions, m.onMessage); token.Wait() && token.Error() != nil {
 		panic(token.Error())
 	}
-	events = make(chan mb.Event, 500)
 	logp.Info("Subscribed to configured topics")
+	m.publishBirth()
 }
 
 // Mqtt message handler
-func onMessage(client MQTT.Client, msg MQTT.Message) {
-	logp.Debug("MQTT", "MQTT message received: %s", string(msg.Payload()))
+func (m *MetricSet) onMessage(client MQTT.Client, msg MQTT.Message) {
+	m.handleMessage(messageFromV3(msg))
+}
+
+// handleMessage turns a message of the MQTT 3.1.1 or MQTT 5 client into events
+func (m *MetricSet) handleMessage(msg *message) {
+	logp.Debug("MQTT", "MQTT message received: %s", string(msg.payload))
+	if msg.retained && m.RetainedMessages == retainedIgnore {
+		logp.Debug("MQTT", "Ignoring retained message of %v", msg.topic)
+		return
+	}
+	if m.dedup != nil && m.dedup.duplicate(msg) {
+		logp.Debug("MQTT", "Dropping redelivered message %v of %v", msg.id, msg.topic)
+		return
+	}
+
+	sub := m.subscriptionFor(msg.topic)
+	if m.sparkplug != nil {
+		if topic, ok := parseSparkplugTopic(msg.topic); ok {
+			for _, mbEvent := range m.sparkplug.decode(m.conn, topic, msg) {
+				sub.apply(&mbEvent, msg.topic)
+				m.markRetained(&mbEvent, msg)
+				m.publish(mbEvent)
+			}
+			return
+		}
+	}
+
 	var mbEvent mb.Event
 	event := make(common.MapStr)
 	root := make(common.MapStr)
 
-	if config.LegacyFields {
+	if m.LegacyFields {
 		var message = make(common.MapStr)
-		message["content"] = string(msg.Payload())
+		message["content"] = string(msg.payload)
 
-		if strings.HasPrefix(msg.Topic(), "$") {
+		if strings.HasPrefix(msg.topic, "$") {
 			event["isSystemTopic"] = true
 		} else {
 			event["isSystemTopic"] = false
 		}
-		event["topic"] = msg.Topic()
-		message["ID"] = msg.MessageID()
-		message["retained"] = msg.Retained()
+		event["topic"] = msg.topic
+		message["ID"] = msg.id
+		message["retained"] = msg.retained
 		event["message"] = message
 
 	}
-	if config.ECSFields {
+	if properties := msg.properties(); len(properties) > 0 {
+		event["properties"] = properties
+	}
+	if m.ECSFields {
 		root.Put("event.creation", time.Now())
-		root.Put("event.dataset", msg.Topic())
-		root.Put("message", string(msg.Payload()))
+		root.Put("event.dataset", msg.topic)
+		root.Put("message", string(msg.payload))
 	}
 
-	// Finally sending the message to elasticsearch
 	mbEvent.RootFields = root
 	mbEvent.ModuleFields = event
-	events <- mbEvent
+	fields := event
+	if m.ECSFields {
+		fields = root
+	}
+
+	// Decoded fields are added next to the raw payload
+	events := []mb.Event{mbEvent}
+	if decoder := m.decoderFor(sub, msg); decoder != nil {
+		if sub.Mapping != nil {
+			events = mapMessage(m, msg, sub, decoder, mbEvent)
+		} else {
+			decodeMessage(m, msg, sub, decoder, &events[0], fields)
+		}
+	}
 
-	logp.Debug("MQTT", "Event sent: %t")
+	// Finally sending the message to elasticsearch
+	for _, mbEvent := range events {
+		sub.apply(&mbEvent, msg.topic)
+		m.markRetained(&mbEvent, msg)
+		m.publish(mbEvent)
+	}
+
+	logp.Debug("MQTT", "Event sent")
 }
 
-// DefaultConnectionLostHandler does nothing
-func reConnectHandler(client MQTT.Client, reason error) {
-	logp.Warn("[MQTT] Connection lost: %s", reason.Error())
-	connected = false
-	connect(client)
+// markRetained marks the events of retained messages, whose values may be
+// older than the event.
+func (m *MetricSet) markRetained(event *mb.Event, msg *message) {
+	if msg.retained && m.RetainedMessages == retainedMark {
+		event.ModuleFields["retained"] = true
+	}
 }
 
-// ParseTopics will parse the config file and return a map with topic:QoS
-func ParseTopics(topics []string, qos int) map[string]byte {
-	subscriptions := make(map[string]byte)
-	for _, value := range topics {
-		// Finally, filling the subscriptions map
-		subscriptions[value] = byte(qos)
-		logp.Info("Subscribe to %v with QoS %v", value, qos)
+// publish adds an event to the buffer. If the buffer is full the event is
+// handled according to buffer_overflow: block waits until Fetch makes room,
+// which also stops the acknowledgement of QoS 1 and 2 messages, drop_newest
+// drops the event and drop_oldest drops the oldest buffered event.
+func (m *MetricSet) publish(event mb.Event) {
+	switch m.BufferOverflow {
+	case overflowDropNewest:
+		select {
+		case m.events <- event:
+		default:
+			m.dropped.Add(1)
+		}
+	case overflowDropOldest:
+		for {
+			select {
+			case m.events <- event:
+				return
+			default:
+			}
+			select {
+			case <-m.events:
+				m.dropped.Add(1)
+			default:
+			}
+		}
+	default:
+		m.events <- event
 	}
-	return subscriptions
+}
+
+// DefaultConnectionLostHandler does nothing
+func (m *MetricSet) reConnectHandler(client MQTT.Client, reason error) {
+	logp.Warn("[MQTT] Connection lost: %s", reason.Error())
+	m.connected = false
+	m.connect(client)
 }
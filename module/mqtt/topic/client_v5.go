@@ -0,0 +1,303 @@
+package topic
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/elastic/beats/v7/libbeat/logp"
+
+	"github.com/eclipse/paho.golang/packets"
+	"github.com/eclipse/paho.golang/paho"
+)
+
+// v5Connection is the connection of the MQTT 5 client. It reconnects to the
+// broker until it is disconnected.
+type v5Connection struct {
+	m      *MetricSet
+	ctx    context.Context
+	cancel context.CancelFunc
+	done   chan struct{}
+
+	mutex  sync.Mutex
+	client *paho.Client
+}
+
+// Prepare MQTT 5 client
+func (m *MetricSet) setupMqtt5Client() {
+	logp.Info("[MQTT] Connect to broker URL %s with MQTT 5", m.BrokerURL)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	conn := &v5Connection{
+		m:      m,
+		ctx:    ctx,
+		cancel: cancel,
+		done:   make(chan struct{}),
+	}
+	m.conn = conn
+	go conn.run()
+}
+
+func (c *v5Connection) run() {
+	defer close(c.done)
+
+	for {
+		lost, err := c.connect()
+		if err != nil {
+			logp.Info("Failed to connect to broker, waiting 5 seconds and retrying: %v", err)
+		} else {
+			select {
+			case err := <-lost:
+				logp.Warn("[MQTT] Connection lost: %v", err)
+			case <-c.ctx.Done():
+			}
+			c.mutex.Lock()
+			c.client = nil
+			c.mutex.Unlock()
+		}
+
+		select {
+		case <-c.ctx.Done():
+			return
+		case <-time.After(5 * time.Second):
+		}
+	}
+}
+
+// connect connects and subscribes to the configured topics. The returned
+// channel receives the error that ended the connection.
+func (c *v5Connection) connect() (<-chan error, error) {
+	m := c.m
+
+	ctx, cancel := context.WithTimeout(c.ctx, 10*time.Second)
+	defer cancel()
+
+	brokerURL, err := parseBrokerURL(m.BrokerURL)
+	if err != nil {
+		return nil, err
+	}
+	netConn, err := m.dialer().dial(ctx, brokerURL)
+	if err != nil {
+		return nil, err
+	}
+
+	flags := &flagsConn{Conn: netConn}
+	lost := make(chan error, 1)
+	connectionLost := func(err error) {
+		select {
+		case lost <- err:
+		default:
+		}
+	}
+	client := paho.NewClient(paho.ClientConfig{
+		ClientID: m.ClientID,
+		Conn:     packets.NewThreadSafeConn(flags),
+		Router: paho.NewSingleHandlerRouter(func(p *paho.Publish) {
+			msg := messageFromV5(p)
+			f := flags.next()
+			msg.retained = msg.retained || f.retain
+			msg.duplicate = f.duplicate
+			m.handleMessage(msg)
+		}),
+		OnClientError: connectionLost,
+		OnServerDisconnect: func(d *paho.Disconnect) {
+			connectionLost(fmt.Errorf("disconnected by broker with reason code %v", d.ReasonCode))
+		},
+	})
+
+	connect := &paho.Connect{
+		ClientID:   m.ClientID,
+		KeepAlive:  30,
+		CleanStart: m.CleanSession,
+	}
+	if m.BrokerUsername != "" {
+		connect.UsernameFlag = true
+		connect.Username = m.BrokerUsername
+	}
+	if m.BrokerPassword != "" {
+		connect.PasswordFlag = true
+		connect.Password = []byte(m.BrokerPassword)
+	}
+	if s := m.WillMessage; s != nil {
+		connect.WillMessage = &paho.WillMessage{
+			Topic:   s.Topic,
+			QoS:     byte(s.QoS),
+			Retain:  s.Retain,
+			Payload: m.statusPayload(s, "will", statusOffline),
+		}
+	}
+	if !m.CleanSession {
+		// The broker keeps the session for the configured time after the connection is lost
+		expiry := uint32(m.SessionExpiry / time.Second)
+		connect.Properties = &paho.ConnectProperties{SessionExpiryInterval: &expiry}
+	}
+
+	connack, err := client.Connect(ctx, connect)
+	if err != nil {
+		netConn.Close()
+		return nil, err
+	}
+	logp.Info("MQTT 5 Client connected, session present: %t", connack.SessionPresent)
+
+	subscribe := &paho.Subscribe{Subscriptions: make(map[string]paho.SubscribeOptions)}
+	for topic, qos := range ParseTopics(m.TopicsSubscribe, m.QoS, m.ShareGroup) {
+		options := paho.SubscribeOptions{QoS: qos}
+		if m.RetainedMessages == retainedIgnore {
+			// The broker doesn't send the retained messages at all. The client
+			// expects the option at its position in the options byte.
+			options.RetainHandling = 2 << 4
+		}
+		subscribe.Subscriptions[topic] = options
+	}
+	if _, err := client.Subscribe(ctx, subscribe); err != nil {
+		client.Disconnect(&paho.Disconnect{ReasonCode: 0})
+		return nil, err
+	}
+	logp.Info("Subscribed to configured topics")
+
+	c.mutex.Lock()
+	c.client = client
+	c.mutex.Unlock()
+	m.publishBirth()
+	return lost, nil
+}
+
+func (c *v5Connection) publish(topic string, qos byte, retain bool, payload []byte) {
+	c.mutex.Lock()
+	client := c.client
+	c.mutex.Unlock()
+	if client == nil {
+		logp.Debug("MQTT", "Not connected, message to %v is not published", topic)
+		return
+	}
+
+	// Publish waits for the acknowledgement, which is received by the
+	// goroutine that may call this function
+	go func() {
+		ctx, cancel := context.WithTimeout(c.ctx, 10*time.Second)
+		defer cancel()
+		_, err := client.Publish(ctx, &paho.Publish{Topic: topic, QoS: qos, Retain: retain, Payload: payload})
+		if err != nil {
+			logp.Warn("[MQTT] Failed to publish to %v: %v", topic, err)
+		}
+	}()
+}
+
+func (c *v5Connection) publishWait(topic string, qos byte, retain bool, payload []byte, timeout time.Duration) error {
+	c.mutex.Lock()
+	client := c.client
+	c.mutex.Unlock()
+	if client == nil {
+		return fmt.Errorf("not connected")
+	}
+
+	ctx, cancel := context.WithTimeout(c.ctx, timeout)
+	defer cancel()
+	_, err := client.Publish(ctx, &paho.Publish{Topic: topic, QoS: qos, Retain: retain, Payload: payload})
+	return err
+}
+
+func (c *v5Connection) disconnect() {
+	c.mutex.Lock()
+	client := c.client
+	c.mutex.Unlock()
+	if client != nil {
+		client.Disconnect(&paho.Disconnect{ReasonCode: 0})
+	}
+	c.cancel()
+	<-c.done
+}
+
+// publishFlags are the flags of the fixed header of a received PUBLISH packet.
+type publishFlags struct {
+	retain    bool
+	duplicate bool
+}
+
+// Parser states of flagsConn
+const (
+	scanHeader = iota
+	scanLength
+	scanBody
+)
+
+// flagsConn reads the retain and DUP flags of received PUBLISH packets. The
+// MQTT 5 client has no DUP flag, and although it copies Retain into the
+// Publish, v0.11 only decodes the QoS of the fixed header of received packets,
+// so the sniffed retain flag is used if Publish.Retain isn't set. The client
+// routes the packets in the order they are read, so the flags are taken from a
+// queue by the message handler.
+type flagsConn struct {
+	net.Conn
+
+	mutex sync.Mutex
+	queue []publishFlags
+
+	// state of the packet parser, only used by Read
+	state     int
+	header    byte
+	length    int
+	shift     uint
+	remaining int
+}
+
+func (c *flagsConn) Read(b []byte) (int, error) {
+	n, err := c.Conn.Read(b)
+	c.scan(b[:n])
+	return n, err
+}
+
+// scan follows the packets of the stream by their fixed header.
+func (c *flagsConn) scan(data []byte) {
+	for len(data) > 0 {
+		switch c.state {
+		case scanHeader:
+			c.header = data[0]
+			c.length, c.shift = 0, 0
+			c.state = scanLength
+			data = data[1:]
+		case scanLength:
+			b := data[0]
+			data = data[1:]
+			c.length |= int(b&0x7f) << c.shift
+			c.shift += 7
+			if b&0x80 != 0 {
+				continue
+			}
+			if c.header>>4 == packets.PUBLISH {
+				c.mutex.Lock()
+				c.queue = append(c.queue, publishFlags{retain: c.header&0x01 != 0, duplicate: c.header&0x08 != 0})
+				c.mutex.Unlock()
+			}
+			c.remaining = c.length
+			c.state = scanBody
+			if c.remaining == 0 {
+				c.state = scanHeader
+			}
+		case scanBody:
+			skip := c.remaining
+			if skip > len(data) {
+				skip = len(data)
+			}
+			data = data[skip:]
+			c.remaining -= skip
+			if c.remaining == 0 {
+				c.state = scanHeader
+			}
+		}
+	}
+}
+
+// next returns the flags of the next routed PUBLISH packet.
+func (c *flagsConn) next() publishFlags {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	if len(c.queue) == 0 {
+		return publishFlags{}
+	}
+	flags := c.queue[0]
+	c.queue = c.queue[1:]
+	return flags
+}
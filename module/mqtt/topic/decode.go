@@ -0,0 +1,309 @@
+package topic
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	"github.com/elastic/beats/v7/libbeat/common"
+	"github.com/elastic/beats/v7/metricbeat/mb"
+)
+
+// decodeFailureTag is added to the tags of messages whose payload can't be decoded.
+const decodeFailureTag = "mqtt_decode_failure"
+
+// timestampLayouts are the layouts used to detect timestamps in string values.
+var timestampLayouts = []string{
+	time.RFC3339Nano,
+	"2006-01-02T15:04:05.999999999",
+	"2006-01-02 15:04:05.999999999Z07:00",
+	"2006-01-02 15:04:05.999999999",
+}
+
+// Payload formats
+const (
+	formatAuto     = "auto"
+	formatJSON     = "json"
+	formatText     = "text"
+	formatCBOR     = "cbor"
+	formatMsgpack  = "msgpack"
+	formatRaw      = "raw"
+	formatProtobuf = "protobuf"
+	formatAvro     = "avro"
+	formatNone     = "none"
+)
+
+// payloadFormat chooses the payload format by the content type of a MQTT 5
+// message. Payloads without content type are detected automatically.
+func payloadFormat(contentType string) string {
+	contentType = strings.ToLower(strings.TrimSpace(strings.Split(contentType, ";")[0]))
+	switch {
+	case contentType == "":
+		return formatAuto
+	case contentType == "application/json" || strings.HasSuffix(contentType, "+json"):
+		return formatJSON
+	case strings.HasPrefix(contentType, "text/"):
+		return formatText
+	case contentType == "application/cbor" || strings.HasSuffix(contentType, "+cbor"):
+		return formatCBOR
+	case contentType == "application/msgpack" || contentType == "application/x-msgpack" || contentType == "application/vnd.msgpack":
+		return formatMsgpack
+	}
+	return formatNone
+}
+
+// decodePayload decodes a JSON payload. Objects are returned as common.MapStr,
+// numbers as int64 or float64 and strings that contain a timestamp as
+// time.Time. In the auto and text formats payloads that are no JSON are
+// accepted as number, boolean, timestamp or string. Only the json format and
+// malformed JSON objects, arrays and strings fail, and binary payloads in the
+// auto format.
+func decodePayload(payload []byte, format string) (interface{}, error) {
+	trimmed := bytes.TrimSpace(payload)
+	if format == formatText {
+		return decodeText(payload), nil
+	}
+	if len(trimmed) == 0 {
+		if format == formatJSON {
+			return nil, fmt.Errorf("empty payload")
+		}
+		return string(payload), nil
+	}
+
+	decoder := json.NewDecoder(bytes.NewReader(trimmed))
+	decoder.UseNumber()
+	var raw interface{}
+	err := decoder.Decode(&raw)
+	if err == nil && decoder.More() {
+		err = fmt.Errorf("unexpected data after JSON value")
+	}
+	if err != nil {
+		if format == formatJSON || trimmed[0] == '{' || trimmed[0] == '[' || trimmed[0] == '"' {
+			return nil, fmt.Errorf("invalid JSON payload: %v", err)
+		}
+		if !utf8.Valid(payload) {
+			return nil, fmt.Errorf("payload is neither JSON nor text")
+		}
+		return decodeText(payload), nil
+	}
+	return convertJSON(raw), nil
+}
+
+// decodeText returns the number, boolean or timestamp of a plain text
+// payload, or the payload as string.
+func decodeText(payload []byte) interface{} {
+	if value, ok := detectScalar(string(bytes.TrimSpace(payload))); ok {
+		return value
+	}
+	return string(payload)
+}
+
+// convertJSON converts the values of a decoded JSON document into typed values.
+func convertJSON(raw interface{}) interface{} {
+	switch v := raw.(type) {
+	case map[string]interface{}:
+		fields := make(common.MapStr, len(v))
+		for key, value := range v {
+			fields[key] = convertJSON(value)
+		}
+		return fields
+	case []interface{}:
+		for i, value := range v {
+			v[i] = convertJSON(value)
+		}
+		return v
+	case json.Number:
+		if i, err := v.Int64(); err == nil {
+			return i
+		}
+		if f, err := v.Float64(); err == nil {
+			return f
+		}
+		return v.String()
+	case string:
+		if t, ok := parseTimestamp(v); ok {
+			return t
+		}
+		return v
+	}
+	return raw
+}
+
+// detectScalar detects numbers, booleans and timestamps in a plain text payload.
+func detectScalar(s string) (interface{}, bool) {
+	if i, err := strconv.ParseInt(s, 10, 64); err == nil {
+		return i, true
+	}
+	if f, err := strconv.ParseFloat(s, 64); err == nil && !math.IsInf(f, 0) && !math.IsNaN(f) {
+		return f, true
+	}
+	if b, err := strconv.ParseBool(s); err == nil {
+		return b, true
+	}
+	if t, ok := parseTimestamp(s); ok {
+		return t, true
+	}
+	return nil, false
+}
+
+func parseTimestamp(s string) (time.Time, bool) {
+	// Timestamps start with the year, this avoids parsing every string
+	if len(s) < 19 || s[4] != '-' {
+		return time.Time{}, false
+	}
+	for _, layout := range timestampLayouts {
+		if t, err := time.Parse(layout, s); err == nil {
+			return t, true
+		}
+	}
+	return time.Time{}, false
+}
+
+// flatten moves all nested fields to the top level. The keys of nested fields
+// are joined with an underscore. Arrays are kept as they are.
+func flatten(fields common.MapStr) common.MapStr {
+	flat := make(common.MapStr)
+	flattenInto(flat, "", fields)
+	return flat
+}
+
+func flattenInto(flat common.MapStr, prefix string, fields common.MapStr) {
+	for key, value := range fields {
+		if prefix != "" {
+			key = prefix + "_" + key
+		}
+		if nested, ok := value.(common.MapStr); ok {
+			flattenInto(flat, key, nested)
+			continue
+		}
+		flat[key] = value
+	}
+}
+
+// lookupPath returns the value at a dotted path of a decoded payload.
+func lookupPath(value interface{}, path string) (interface{}, bool) {
+	for _, key := range strings.Split(path, ".") {
+		fields, ok := value.(common.MapStr)
+		if !ok {
+			return nil, false
+		}
+		value, ok = fields[key]
+		if !ok {
+			return nil, false
+		}
+	}
+	return value, true
+}
+
+// toTimestamp converts the value of the timestamp path into a time. Numbers
+// are interpreted as Unix time in seconds or, if they are too large for that,
+// in milliseconds.
+func toTimestamp(value interface{}, layout string) (time.Time, error) {
+	switch v := value.(type) {
+	case time.Time:
+		return v, nil
+	case string:
+		if layout != "" {
+			return time.Parse(layout, v)
+		}
+		if t, ok := parseTimestamp(v); ok {
+			return t, nil
+		}
+		return time.Time{}, fmt.Errorf("unknown timestamp format %q", v)
+	case int64:
+		if v > 1e11 || v < -1e11 {
+			return time.UnixMilli(v), nil
+		}
+		return time.Unix(v, 0), nil
+	case float64:
+		if v > 1e11 || v < -1e11 {
+			return time.UnixMilli(int64(v)), nil
+		}
+		sec, frac := math.Modf(v)
+		return time.Unix(int64(sec), int64(frac*1e9)), nil
+	}
+	return time.Time{}, fmt.Errorf("unsupported timestamp value %v (%T)", value, value)
+}
+
+// decodeMessage decodes the payload of a message into the configured target
+// field. Messages that can't be decoded are tagged and keep their raw payload.
+func decodeMessage(m *MetricSet, msg *message, sub *Subscription, decoder Decoder, event *mb.Event, fields common.MapStr) {
+	if value, ok := decodeValue(m, msg, sub, decoder, event); ok {
+		putDecoded(m, value, fields)
+	}
+}
+
+// decodeValue decompresses and decodes the payload of a message and sets the
+// timestamp of the event. Failures are added to the event.
+func decodeValue(m *MetricSet, msg *message, sub *Subscription, decoder Decoder, event *mb.Event) (interface{}, bool) {
+	payload, err := decompress(msg.payload, sub.Decompress)
+	if err != nil {
+		addDecodeFailure(event, err)
+		return nil, false
+	}
+	value, err := decoder.Decode(payload)
+	if err != nil {
+		addDecodeFailure(event, err)
+		return nil, false
+	}
+
+	if m.TimestampPath != "" {
+		if tsValue, found := lookupPath(value, m.TimestampPath); found {
+			ts, err := toTimestamp(tsValue, m.TimestampFormat)
+			if err != nil {
+				addDecodeFailure(event, fmt.Errorf("invalid timestamp at %v: %v", m.TimestampPath, err))
+			} else {
+				event.Timestamp = ts
+			}
+		}
+	}
+	return value, true
+}
+
+// putDecoded adds a decoded value to the fields, objects are merged into
+// them unless a decode target is configured.
+func putDecoded(m *MetricSet, value interface{}, fields common.MapStr) {
+	if object, ok := value.(common.MapStr); ok && m.DecodeFlatten {
+		value = flatten(object)
+	}
+	if object, ok := value.(common.MapStr); ok && m.DecodeTarget == "" {
+		fields.DeepUpdate(object)
+		return
+	}
+	target := m.DecodeTarget
+	if target == "" {
+		target = "value"
+	}
+	fields.Put(target, value)
+}
+
+func addDecodeFailure(event *mb.Event, err error) {
+	if event.RootFields == nil {
+		event.RootFields = make(common.MapStr)
+	}
+	if tags, _ := event.RootFields.GetValue("tags"); !containsTag(tags, decodeFailureTag) {
+		common.AddTags(event.RootFields, []string{decodeFailureTag})
+	}
+	// The first error is kept, later ones are usually caused by it
+	if found, _ := event.RootFields.HasKey("error.message"); !found {
+		event.RootFields.Put("error.message", err.Error())
+	}
+}
+
+func containsTag(tags interface{}, tag string) bool {
+	list, ok := tags.([]string)
+	if !ok {
+		return false
+	}
+	for _, t := range list {
+		if t == tag {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,235 @@
+package topic
+
+import (
+	"bytes"
+	"compress/gzip"
+	"compress/zlib"
+	"encoding/base64"
+	"encoding/hex"
+	"fmt"
+	"io/ioutil"
+	"math"
+	"sort"
+	"strings"
+	"sync"
+	"unicode/utf8"
+
+	"github.com/elastic/beats/v7/libbeat/common"
+)
+
+// Decoder decodes the payload of a message. Objects are returned as
+// common.MapStr, numbers as int64, uint64 or float64.
+type Decoder interface {
+	Decode(payload []byte) (interface{}, error)
+}
+
+// DecoderFactory creates a decoder from the decoder settings of a topic. The
+// settings are empty if none are configured.
+type DecoderFactory func(config *common.Config) (Decoder, error)
+
+var (
+	decodersMutex sync.RWMutex
+	decoders      = make(map[string]DecoderFactory)
+)
+
+// RegisterDecoder makes a decoder available as format of the topics.
+func RegisterDecoder(format string, factory DecoderFactory) {
+	decodersMutex.Lock()
+	defer decodersMutex.Unlock()
+	if _, exists := decoders[format]; exists {
+		panic(fmt.Sprintf("payload decoder %v is already registered", format))
+	}
+	decoders[format] = factory
+}
+
+// newDecoder creates the decoder of a format. The format none has no decoder.
+func newDecoder(format string, config *common.Config) (Decoder, error) {
+	if format == formatNone {
+		return nil, nil
+	}
+	decodersMutex.RLock()
+	factory, found := decoders[format]
+	decodersMutex.RUnlock()
+	if !found {
+		return nil, fmt.Errorf("unknown format %q, use %v or %v", format, strings.Join(decoderFormats(), ", "), formatNone)
+	}
+	if config == nil {
+		config = common.NewConfig()
+	}
+	return factory(config)
+}
+
+func decoderFormats() []string {
+	decodersMutex.RLock()
+	defer decodersMutex.RUnlock()
+	formats := make([]string, 0, len(decoders))
+	for format := range decoders {
+		formats = append(formats, format)
+	}
+	sort.Strings(formats)
+	return formats
+}
+
+func init() {
+	for _, format := range []string{formatAuto, formatJSON, formatText} {
+		format := format
+		RegisterDecoder(format, func(*common.Config) (Decoder, error) {
+			return jsonDecoder(format), nil
+		})
+	}
+	RegisterDecoder(formatRaw, newRawDecoder)
+}
+
+// jsonDecoder decodes JSON or plain text payloads in one of the formats auto, json or text.
+type jsonDecoder string
+
+func (d jsonDecoder) Decode(payload []byte) (interface{}, error) {
+	return decodePayload(payload, string(d))
+}
+
+// rawDecoder keeps binary payloads as base64 or hex string.
+type rawDecoder struct {
+	Encoding string `config:"encoding"`
+}
+
+func newRawDecoder(config *common.Config) (Decoder, error) {
+	d := &rawDecoder{Encoding: "base64"}
+	if err := config.Unpack(d); err != nil {
+		return nil, err
+	}
+	if d.Encoding != "base64" && d.Encoding != "hex" {
+		return nil, fmt.Errorf("unknown encoding %q of raw payloads, use base64 or hex", d.Encoding)
+	}
+	return d, nil
+}
+
+func (d *rawDecoder) Decode(payload []byte) (interface{}, error) {
+	if d.Encoding == "hex" {
+		return hex.EncodeToString(payload), nil
+	}
+	return base64.StdEncoding.EncodeToString(payload), nil
+}
+
+// Decompression of payloads
+const (
+	decompressAuto    = "auto"
+	decompressGzip    = "gzip"
+	decompressDeflate = "deflate"
+	decompressNone    = "none"
+)
+
+// decompress decompresses gzip or zlib (deflate) compressed payloads. In the
+// mode auto compressed payloads are detected by their header, payloads that
+// only look compressed are returned as they are.
+func decompress(payload []byte, mode string) ([]byte, error) {
+	switch mode {
+	case decompressNone:
+		return payload, nil
+	case decompressGzip:
+		return gunzip(payload)
+	case decompressDeflate:
+		return inflate(payload)
+	}
+
+	if len(payload) < 2 {
+		return payload, nil
+	}
+	if payload[0] == 0x1f && payload[1] == 0x8b {
+		if decompressed, err := gunzip(payload); err == nil {
+			return decompressed, nil
+		}
+	}
+	// zlib header: deflate method, the header is a multiple of 31
+	if payload[0]&0x0f == 8 && (uint16(payload[0])<<8|uint16(payload[1]))%31 == 0 {
+		if decompressed, err := inflate(payload); err == nil {
+			return decompressed, nil
+		}
+	}
+	return payload, nil
+}
+
+func gunzip(payload []byte) ([]byte, error) {
+	reader, err := gzip.NewReader(bytes.NewReader(payload))
+	if err != nil {
+		return nil, fmt.Errorf("invalid gzip payload: %v", err)
+	}
+	defer reader.Close()
+	decompressed, err := ioutil.ReadAll(reader)
+	if err != nil {
+		return nil, fmt.Errorf("invalid gzip payload: %v", err)
+	}
+	return decompressed, nil
+}
+
+func inflate(payload []byte) ([]byte, error) {
+	reader, err := zlib.NewReader(bytes.NewReader(payload))
+	if err != nil {
+		return nil, fmt.Errorf("invalid deflate payload: %v", err)
+	}
+	defer reader.Close()
+	decompressed, err := ioutil.ReadAll(reader)
+	if err != nil {
+		return nil, fmt.Errorf("invalid deflate payload: %v", err)
+	}
+	return decompressed, nil
+}
+
+// normalize converts the values of binary formats like CBOR and MessagePack
+// into event fields. Map keys become strings, byte strings are kept as
+// string if they are UTF-8 and base64 encoded otherwise.
+func normalize(value interface{}) interface{} {
+	switch v := value.(type) {
+	case map[string]interface{}:
+		fields := make(common.MapStr, len(v))
+		for key, value := range v {
+			fields[key] = normalize(value)
+		}
+		return fields
+	case map[interface{}]interface{}:
+		fields := make(common.MapStr, len(v))
+		for key, value := range v {
+			fields[fmt.Sprint(key)] = normalize(value)
+		}
+		return fields
+	case []interface{}:
+		for i, value := range v {
+			v[i] = normalize(value)
+		}
+		return v
+	case []byte:
+		if utf8.Valid(v) {
+			return string(v)
+		}
+		return base64.StdEncoding.EncodeToString(v)
+	case int:
+		return int64(v)
+	case int8:
+		return int64(v)
+	case int16:
+		return int64(v)
+	case int32:
+		return int64(v)
+	case uint:
+		return normalize(uint64(v))
+	case uint8:
+		return int64(v)
+	case uint16:
+		return int64(v)
+	case uint32:
+		return int64(v)
+	case uint64:
+		// Like in JSON payloads numbers are int64 if possible
+		if v <= math.MaxInt64 {
+			return int64(v)
+		}
+		return v
+	case float32:
+		return float64(v)
+	case string:
+		if t, ok := parseTimestamp(v); ok {
+			return t
+		}
+		return v
+	}
+	return value
+}
@@ -0,0 +1,59 @@
+package topic
+
+import (
+	"fmt"
+	"io/ioutil"
+
+	"github.com/elastic/beats/v7/libbeat/common"
+
+	"github.com/linkedin/goavro/v2"
+)
+
+func init() {
+	RegisterDecoder(formatAvro, newAvroDecoder)
+}
+
+// avroConfig holds the schema of Avro payloads, inline or in a file.
+type avroConfig struct {
+	Schema     string `config:"schema"`
+	SchemaFile string `config:"schema_file"`
+}
+
+// avroDecoder decodes Avro payloads in binary encoding without header.
+type avroDecoder struct {
+	codec *goavro.Codec
+}
+
+func newAvroDecoder(config *common.Config) (Decoder, error) {
+	var c avroConfig
+	if err := config.Unpack(&c); err != nil {
+		return nil, err
+	}
+	schema := c.Schema
+	if c.SchemaFile != "" {
+		data, err := ioutil.ReadFile(c.SchemaFile)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read Avro schema: %v", err)
+		}
+		schema = string(data)
+	}
+	if schema == "" {
+		return nil, fmt.Errorf("the avro decoder needs a schema or schema_file")
+	}
+	codec, err := goavro.NewCodec(schema)
+	if err != nil {
+		return nil, fmt.Errorf("invalid Avro schema: %v", err)
+	}
+	return &avroDecoder{codec: codec}, nil
+}
+
+func (d *avroDecoder) Decode(payload []byte) (interface{}, error) {
+	value, rest, err := d.codec.NativeFromBinary(payload)
+	if err != nil {
+		return nil, fmt.Errorf("invalid Avro payload: %v", err)
+	}
+	if len(rest) > 0 {
+		return nil, fmt.Errorf("invalid Avro payload: %v unexpected bytes after the record", len(rest))
+	}
+	return normalize(value), nil
+}
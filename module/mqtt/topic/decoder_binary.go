@@ -0,0 +1,41 @@
+package topic
+
+import (
+	"fmt"
+
+	"github.com/elastic/beats/v7/libbeat/common"
+
+	"github.com/fxamacker/cbor/v2"
+	"github.com/vmihailenco/msgpack/v5"
+)
+
+func init() {
+	RegisterDecoder(formatCBOR, func(*common.Config) (Decoder, error) {
+		return cborDecoder{}, nil
+	})
+	RegisterDecoder(formatMsgpack, func(*common.Config) (Decoder, error) {
+		return msgpackDecoder{}, nil
+	})
+}
+
+// cborDecoder decodes CBOR (RFC 8949) payloads.
+type cborDecoder struct{}
+
+func (cborDecoder) Decode(payload []byte) (interface{}, error) {
+	var value interface{}
+	if err := cbor.Unmarshal(payload, &value); err != nil {
+		return nil, fmt.Errorf("invalid CBOR payload: %v", err)
+	}
+	return normalize(value), nil
+}
+
+// msgpackDecoder decodes MessagePack payloads.
+type msgpackDecoder struct{}
+
+func (msgpackDecoder) Decode(payload []byte) (interface{}, error) {
+	var value interface{}
+	if err := msgpack.Unmarshal(payload, &value); err != nil {
+		return nil, fmt.Errorf("invalid MessagePack payload: %v", err)
+	}
+	return normalize(value), nil
+}
@@ -0,0 +1,167 @@
+package topic
+
+import (
+	"encoding/base64"
+	"fmt"
+	"io/ioutil"
+	"time"
+
+	"github.com/elastic/beats/v7/libbeat/common"
+
+	"github.com/jhump/protoreflect/desc/protoparse"
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/reflect/protodesc"
+	"google.golang.org/protobuf/reflect/protoreflect"
+	"google.golang.org/protobuf/types/descriptorpb"
+	"google.golang.org/protobuf/types/dynamicpb"
+)
+
+func init() {
+	RegisterDecoder(formatProtobuf, newProtobufDecoder)
+}
+
+// protobufConfig holds the settings of the protobuf decoder. The message type
+// is defined by .proto files or by a descriptor set created with
+// protoc --descriptor_set_out --include_imports.
+type protobufConfig struct {
+	ProtoFiles    []string `config:"proto_files"`
+	ImportPaths   []string `config:"import_paths"`
+	DescriptorSet string   `config:"descriptor_set"`
+	MessageType   string   `config:"message_type" validate:"required"`
+}
+
+// protobufDecoder decodes protobuf messages of one message type.
+type protobufDecoder struct {
+	descriptor protoreflect.MessageDescriptor
+}
+
+func newProtobufDecoder(config *common.Config) (Decoder, error) {
+	var c protobufConfig
+	if err := config.Unpack(&c); err != nil {
+		return nil, err
+	}
+
+	var descriptor protoreflect.MessageDescriptor
+	var err error
+	switch {
+	case c.DescriptorSet != "" && len(c.ProtoFiles) == 0:
+		descriptor, err = messageFromDescriptorSet(c.DescriptorSet, c.MessageType)
+	case c.DescriptorSet == "" && len(c.ProtoFiles) > 0:
+		descriptor, err = messageFromProtoFiles(c.ProtoFiles, c.ImportPaths, c.MessageType)
+	default:
+		return nil, fmt.Errorf("the protobuf decoder needs either proto_files or a descriptor_set")
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &protobufDecoder{descriptor: descriptor}, nil
+}
+
+func messageFromDescriptorSet(path string, messageType string) (protoreflect.MessageDescriptor, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read descriptor set: %v", err)
+	}
+	var set descriptorpb.FileDescriptorSet
+	if err := proto.Unmarshal(data, &set); err != nil {
+		return nil, fmt.Errorf("invalid descriptor set %v: %v", path, err)
+	}
+	files, err := protodesc.NewFiles(&set)
+	if err != nil {
+		return nil, fmt.Errorf("invalid descriptor set %v: %v", path, err)
+	}
+	descriptor, err := files.FindDescriptorByName(protoreflect.FullName(messageType))
+	if err != nil {
+		return nil, fmt.Errorf("message type %v not found in %v", messageType, path)
+	}
+	message, ok := descriptor.(protoreflect.MessageDescriptor)
+	if !ok {
+		return nil, fmt.Errorf("%v in %v is no message type", messageType, path)
+	}
+	return message, nil
+}
+
+func messageFromProtoFiles(paths []string, importPaths []string, messageType string) (protoreflect.MessageDescriptor, error) {
+	parser := protoparse.Parser{ImportPaths: importPaths}
+	files, err := parser.ParseFiles(paths...)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse proto files: %v", err)
+	}
+	for _, file := range files {
+		if message := file.FindMessage(messageType); message != nil {
+			return message.UnwrapMessage(), nil
+		}
+	}
+	return nil, fmt.Errorf("message type %v not found in %v", messageType, paths)
+}
+
+func (d *protobufDecoder) Decode(payload []byte) (interface{}, error) {
+	message := dynamicpb.NewMessage(d.descriptor)
+	if err := proto.Unmarshal(payload, message); err != nil {
+		return nil, fmt.Errorf("invalid protobuf payload: %v", err)
+	}
+	return protoMessageFields(message), nil
+}
+
+// protoMessageFields returns the fields of a message that are set. Enums
+// are published with their name, google.protobuf.Timestamp as time.
+func protoMessageFields(message protoreflect.Message) common.MapStr {
+	fields := make(common.MapStr)
+	message.Range(func(field protoreflect.FieldDescriptor, value protoreflect.Value) bool {
+		switch {
+		case field.IsList():
+			list := value.List()
+			values := make([]interface{}, list.Len())
+			for i := range values {
+				values[i] = protoValue(field, list.Get(i))
+			}
+			fields[string(field.Name())] = values
+		case field.IsMap():
+			entries := make(common.MapStr)
+			value.Map().Range(func(key protoreflect.MapKey, value protoreflect.Value) bool {
+				entries[key.String()] = protoValue(field.MapValue(), value)
+				return true
+			})
+			fields[string(field.Name())] = entries
+		default:
+			fields[string(field.Name())] = protoValue(field, value)
+		}
+		return true
+	})
+	return fields
+}
+
+func protoValue(field protoreflect.FieldDescriptor, value protoreflect.Value) interface{} {
+	switch field.Kind() {
+	case protoreflect.MessageKind, protoreflect.GroupKind:
+		message := value.Message()
+		if field.Message().FullName() == "google.protobuf.Timestamp" {
+			fields := message.Descriptor().Fields()
+			seconds := message.Get(fields.ByName("seconds")).Int()
+			nanos := message.Get(fields.ByName("nanos")).Int()
+			return time.Unix(seconds, nanos).UTC()
+		}
+		return protoMessageFields(message)
+	case protoreflect.EnumKind:
+		if enum := field.Enum().Values().ByNumber(value.Enum()); enum != nil {
+			return string(enum.Name())
+		}
+		return int64(value.Enum())
+	case protoreflect.BoolKind:
+		return value.Bool()
+	case protoreflect.Int32Kind, protoreflect.Sint32Kind, protoreflect.Sfixed32Kind,
+		protoreflect.Int64Kind, protoreflect.Sint64Kind, protoreflect.Sfixed64Kind:
+		return value.Int()
+	case protoreflect.Uint32Kind, protoreflect.Fixed32Kind:
+		return int64(value.Uint())
+	case protoreflect.Uint64Kind, protoreflect.Fixed64Kind:
+		return normalize(value.Uint())
+	case protoreflect.FloatKind, protoreflect.DoubleKind:
+		return value.Float()
+	case protoreflect.StringKind:
+		return value.String()
+	case protoreflect.BytesKind:
+		return base64.StdEncoding.EncodeToString(value.Bytes())
+	}
+	return value.Interface()
+}
@@ -0,0 +1,95 @@
+package topic
+
+import (
+	"hash/fnv"
+	"sync"
+	"time"
+)
+
+// Handling of retained messages
+const (
+	retainedPublish = "publish"
+	retainedMark    = "mark"
+	retainedIgnore  = "ignore"
+)
+
+// DeduplicationConfig holds the settings of the deduplication of redelivered messages.
+type DeduplicationConfig struct {
+	Enabled bool          `config:"enabled"`
+	Window  time.Duration `config:"window"`
+	// MaxEntries limits the memory of the window, the oldest messages are
+	// forgotten first.
+	MaxEntries int `config:"max_entries"`
+	// AnyDuplicate drops all messages with the same topic and payload in the
+	// window, not only redeliveries.
+	AnyDuplicate bool `config:"any_duplicate"`
+}
+
+type seenMessage struct {
+	hash uint64
+	seen time.Time
+}
+
+// deduplicator remembers the content hashes of the messages of a window. A
+// message is a redelivery if its content was seen before and the broker set
+// the DUP flag. Packet IDs are reused by brokers and publishers, so a message
+// with a seen packet ID can be a new sample with an unchanged value.
+type deduplicator struct {
+	config DeduplicationConfig
+
+	mutex    sync.Mutex
+	messages map[uint64]*seenMessage
+	// order is used to expire the messages in the order they were seen
+	order []*seenMessage
+}
+
+func newDeduplicator(config DeduplicationConfig) *deduplicator {
+	return &deduplicator{
+		config:   config,
+		messages: make(map[uint64]*seenMessage),
+	}
+}
+
+// duplicate reports whether a message was already received and remembers it.
+func (d *deduplicator) duplicate(msg *message) bool {
+	h := fnv.New64a()
+	h.Write([]byte(msg.topic))
+	h.Write([]byte{0})
+	h.Write(msg.payload)
+	hash := h.Sum64()
+	now := time.Now()
+
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+
+	d.expire(now)
+	_, found := d.messages[hash]
+	if found && (d.config.AnyDuplicate || msg.duplicate) {
+		return true
+	}
+
+	seen := &seenMessage{hash: hash, seen: now}
+	d.messages[hash] = seen
+	d.order = append(d.order, seen)
+	d.expire(now)
+	return false
+}
+
+// expire forgets the messages seen before the window and the oldest messages
+// beyond max_entries.
+func (d *deduplicator) expire(now time.Time) {
+	expired := 0
+	for _, seen := range d.order {
+		if now.Sub(seen.seen) < d.config.Window && len(d.order)-expired <= d.config.MaxEntries {
+			break
+		}
+		// The hash may have been seen again since
+		if d.messages[seen.hash] == seen {
+			delete(d.messages, seen.hash)
+		}
+		expired++
+	}
+	if expired > 0 {
+		d.order = append(d.order[:0], d.order[expired:]...)
+	}
+}
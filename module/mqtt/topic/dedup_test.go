@@ -0,0 +1,61 @@
+package topic
+
+import (
+	"testing"
+	"time"
+)
+
+func TestDeduplicator(t *testing.T) {
+	d := newDeduplicator(DeduplicationConfig{Enabled: true, Window: time.Minute, MaxEntries: 100})
+
+	msg := &message{topic: "factory/temp", payload: []byte("21.5"), id: 1}
+	if d.duplicate(msg) {
+		t.Error("first message is a duplicate")
+	}
+	// A new sample with an unchanged value and a reused packet ID
+	if d.duplicate(&message{topic: "factory/temp", payload: []byte("21.5"), id: 1}) {
+		t.Error("message without DUP flag is a duplicate")
+	}
+	if !d.duplicate(&message{topic: "factory/temp", payload: []byte("21.5"), id: 1, duplicate: true}) {
+		t.Error("redelivery with DUP flag is no duplicate")
+	}
+	if d.duplicate(&message{topic: "factory/temp", payload: []byte("21.6"), duplicate: true}) {
+		t.Error("redelivery of an unseen payload is a duplicate")
+	}
+	if d.duplicate(&message{topic: "factory/pressure", payload: []byte("21.5"), duplicate: true}) {
+		t.Error("redelivery of a payload seen on another topic is a duplicate")
+	}
+}
+
+func TestDeduplicatorAnyDuplicate(t *testing.T) {
+	d := newDeduplicator(DeduplicationConfig{Enabled: true, Window: time.Minute, MaxEntries: 100, AnyDuplicate: true})
+	d.duplicate(&message{topic: "factory/temp", payload: []byte("21.5")})
+	if !d.duplicate(&message{topic: "factory/temp", payload: []byte("21.5")}) {
+		t.Error("message with seen content is no duplicate")
+	}
+}
+
+func TestDeduplicatorWindow(t *testing.T) {
+	d := newDeduplicator(DeduplicationConfig{Enabled: true, Window: 20 * time.Millisecond, MaxEntries: 100})
+	d.duplicate(&message{topic: "factory/temp", payload: []byte("21.5")})
+	time.Sleep(50 * time.Millisecond)
+	if d.duplicate(&message{topic: "factory/temp", payload: []byte("21.5"), duplicate: true}) {
+		t.Error("message seen before the window is a duplicate")
+	}
+	if len(d.order) != 1 || len(d.messages) != 1 {
+		t.Errorf("got %v entries in order and %v in messages, want 1", len(d.order), len(d.messages))
+	}
+}
+
+func TestDeduplicatorMaxEntries(t *testing.T) {
+	d := newDeduplicator(DeduplicationConfig{Enabled: true, Window: time.Minute, MaxEntries: 2})
+	for _, payload := range []string{"1", "2", "3"} {
+		d.duplicate(&message{topic: "factory/temp", payload: []byte(payload)})
+	}
+	if d.duplicate(&message{topic: "factory/temp", payload: []byte("1"), duplicate: true}) {
+		t.Error("forgotten message is a duplicate")
+	}
+	if !d.duplicate(&message{topic: "factory/temp", payload: []byte("3"), duplicate: true}) {
+		t.Error("remembered message is no duplicate")
+	}
+}
@@ -0,0 +1,184 @@
+package topic
+
+import (
+	"bufio"
+	"context"
+	"crypto/tls"
+	"encoding/base64"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"golang.org/x/net/proxy"
+)
+
+// WebsocketConfig holds the settings of connections to ws:// and wss:// brokers.
+type WebsocketConfig struct {
+	Headers      map[string]string `config:"headers"`
+	Subprotocols []string          `config:"subprotocols"`
+}
+
+// parseBrokerURL parses the host setting. A host without scheme uses TCP like
+// in the MQTT 3.1.1 client.
+func parseBrokerURL(host string) (*url.URL, error) {
+	if !strings.Contains(host, "://") {
+		host = "tcp://" + host
+	}
+	u, err := url.Parse(host)
+	if err != nil {
+		return nil, fmt.Errorf("invalid broker URL %v: %v", host, err)
+	}
+	return u, nil
+}
+
+// parseProxyURL parses the proxy_url setting. HTTP proxies are used with the
+// CONNECT method, SOCKS5 proxies with the socks5 scheme.
+func parseProxyURL(proxyURL string) (*url.URL, error) {
+	u, err := url.Parse(proxyURL)
+	if err != nil {
+		return nil, fmt.Errorf("invalid proxy_url %v: %v", proxyURL, err)
+	}
+	switch u.Scheme {
+	case "http", "socks5", "socks5h":
+	default:
+		return nil, fmt.Errorf("unsupported scheme %v in proxy_url, use http or socks5", u.Scheme)
+	}
+	if u.Host == "" {
+		return nil, fmt.Errorf("proxy_url %v has no host", proxyURL)
+	}
+	return u, nil
+}
+
+// brokerDialer opens the network connections to the broker for both MQTT clients.
+type brokerDialer struct {
+	tlsConfig *tls.Config
+	proxy     *url.URL
+	websocket WebsocketConfig
+}
+
+func (m *MetricSet) dialer() *brokerDialer {
+	d := &brokerDialer{
+		tlsConfig: m.tlsConfig(),
+		websocket: m.Websocket,
+	}
+	if m.ProxyURL != "" {
+		// proxy_url is checked by Validate
+		d.proxy, _ = parseProxyURL(m.ProxyURL)
+	}
+	return d
+}
+
+// dial connects to the broker with the scheme of its URL.
+func (d *brokerDialer) dial(ctx context.Context, u *url.URL) (net.Conn, error) {
+	switch strings.ToLower(u.Scheme) {
+	case "tcp", "mqtt":
+		return d.dialTCP(ctx, hostPort(u, "1883"))
+	case "ssl", "tls", "tcps", "mqtts":
+		conn, err := d.dialTCP(ctx, hostPort(u, "8883"))
+		if err != nil {
+			return nil, err
+		}
+		return d.handshake(ctx, conn, u.Hostname())
+	case "ws", "wss":
+		return d.dialWebsocket(ctx, u)
+	}
+	return nil, fmt.Errorf("unsupported scheme %v in broker URL %v", u.Scheme, u)
+}
+
+// handshake starts TLS on a connection. Without ssl settings the certificate
+// of the broker is verified with the system certificates.
+func (d *brokerDialer) handshake(ctx context.Context, conn net.Conn, host string) (net.Conn, error) {
+	tlsConfig := d.tlsConfig
+	if tlsConfig == nil {
+		tlsConfig = &tls.Config{ServerName: host}
+	}
+	tlsConn := tls.Client(conn, tlsConfig)
+	if err := tlsConn.HandshakeContext(ctx); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	return tlsConn, nil
+}
+
+// dialTCP opens a TCP connection to the address, through the proxy if one is configured.
+func (d *brokerDialer) dialTCP(ctx context.Context, address string) (net.Conn, error) {
+	var dialer net.Dialer
+	if d.proxy == nil {
+		return dialer.DialContext(ctx, "tcp", address)
+	}
+	if d.proxy.Scheme == "http" {
+		return d.dialHTTPProxy(ctx, address)
+	}
+
+	socks, err := proxy.FromURL(d.proxy, &dialer)
+	if err != nil {
+		return nil, err
+	}
+	return socks.(proxy.ContextDialer).DialContext(ctx, "tcp", address)
+}
+
+// dialHTTPProxy opens a tunnel to the address with the CONNECT method of a HTTP proxy.
+func (d *brokerDialer) dialHTTPProxy(ctx context.Context, address string) (net.Conn, error) {
+	var dialer net.Dialer
+	conn, err := dialer.DialContext(ctx, "tcp", hostPort(d.proxy, "80"))
+	if err != nil {
+		return nil, err
+	}
+	if deadline, ok := ctx.Deadline(); ok {
+		conn.SetDeadline(deadline)
+		defer conn.SetDeadline(time.Time{})
+	}
+
+	req := &http.Request{
+		Method: http.MethodConnect,
+		URL:    &url.URL{Opaque: address},
+		Host:   address,
+		Header: make(http.Header),
+	}
+	if user := d.proxy.User; user != nil {
+		password, _ := user.Password()
+		credentials := base64.StdEncoding.EncodeToString([]byte(user.Username() + ":" + password))
+		req.Header.Set("Proxy-Authorization", "Basic "+credentials)
+	}
+	if err := req.Write(conn); err != nil {
+		conn.Close()
+		return nil, err
+	}
+
+	reader := bufio.NewReader(conn)
+	resp, err := http.ReadResponse(reader, req)
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		conn.Close()
+		return nil, fmt.Errorf("proxy %v refused the connection to %v: %v", d.proxy.Host, address, resp.Status)
+	}
+	if reader.Buffered() > 0 {
+		// The broker has already sent data, which must not get lost
+		return &bufferedConn{Conn: conn, reader: reader}, nil
+	}
+	return conn, nil
+}
+
+// bufferedConn is a connection whose first bytes were read into a buffer.
+type bufferedConn struct {
+	net.Conn
+	reader *bufio.Reader
+}
+
+func (c *bufferedConn) Read(b []byte) (int, error) {
+	return c.reader.Read(b)
+}
+
+func hostPort(u *url.URL, defaultPort string) string {
+	if u.Port() == "" {
+		return net.JoinHostPort(u.Hostname(), defaultPort)
+	}
+	return u.Host
+}
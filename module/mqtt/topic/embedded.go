@@ -0,0 +1,410 @@
+package topic
+
+import (
+	"crypto/subtle"
+	"crypto/tls"
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/elastic/beats/v7/libbeat/common/transport/tlscommon"
+	"github.com/elastic/beats/v7/libbeat/logp"
+
+	"github.com/gorilla/websocket"
+	mqtt "github.com/mochi-mqtt/server/v2"
+	"github.com/mochi-mqtt/server/v2/listeners"
+	"github.com/mochi-mqtt/server/v2/packets"
+	"github.com/rs/zerolog"
+)
+
+// Listener types of the embedded broker
+const (
+	listenerTCP       = "tcp"
+	listenerWebsocket = "websocket"
+)
+
+// Access rights of the ACL rules of the embedded broker
+const (
+	accessRead      = "read"
+	accessWrite     = "write"
+	accessReadWrite = "readwrite"
+	accessDeny      = "deny"
+)
+
+// EmbeddedBrokerConfig holds the settings of the embedded broker. If it is
+// enabled the MetricSet doesn't connect to a broker but accepts MQTT 3.1.1 and
+// MQTT 5 clients itself and ingests the messages they publish to the topics.
+// Clients without a username are only accepted with allow_anonymous and are
+// restricted by the rules of anonymous_acl.
+type EmbeddedBrokerConfig struct {
+	Enabled        bool             `config:"enabled"`
+	Listeners      []BrokerListener `config:"listeners"`
+	Users          []BrokerUser     `config:"users"`
+	AllowAnonymous bool             `config:"allow_anonymous"`
+	AnonymousACL   []ACLRule        `config:"anonymous_acl"`
+}
+
+// BrokerListener is a TCP or websocket listener of the embedded broker, with
+// TLS if ssl is set.
+type BrokerListener struct {
+	Type    string                  `config:"type"`
+	Address string                  `config:"address"`
+	SSL     *tlscommon.ServerConfig `config:"ssl"`
+
+	tlsConfig *tls.Config
+}
+
+// BrokerUser is a user of the embedded broker. Users without ACL rules may
+// publish and subscribe to all topics.
+type BrokerUser struct {
+	Username string    `config:"username"`
+	Password string    `config:"password"`
+	ACL      []ACLRule `config:"acl"`
+}
+
+// ACLRule grants access to the topics matching a topic filter. The first
+// rule that matches a topic is used, topics matching no rule are denied.
+type ACLRule struct {
+	Topic  string `config:"topic"`
+	Access string `config:"access"`
+}
+
+// validate checks the settings and loads the certificates of the listeners.
+func (c *EmbeddedBrokerConfig) validate() error {
+	if !c.Enabled {
+		return nil
+	}
+	if len(c.Listeners) == 0 {
+		c.Listeners = []BrokerListener{{Type: listenerTCP, Address: "127.0.0.1:1883"}}
+	}
+	for i := range c.Listeners {
+		l := &c.Listeners[i]
+		if l.Type == "" {
+			l.Type = listenerTCP
+		}
+		if l.Type != listenerTCP && l.Type != listenerWebsocket {
+			return fmt.Errorf("unknown listener type %q, use %v or %v", l.Type, listenerTCP, listenerWebsocket)
+		}
+		if l.Address == "" {
+			return fmt.Errorf("address of %v listener must not be empty", l.Type)
+		}
+		if l.SSL.IsEnabled() {
+			loaded, err := tlscommon.LoadTLSServerConfig(l.SSL)
+			if err != nil {
+				return fmt.Errorf("invalid ssl settings of listener %v: %v", l.Address, err)
+			}
+			l.tlsConfig = loaded.BuildServerConfig("")
+		}
+	}
+
+	if len(c.Users) == 0 && !c.AllowAnonymous {
+		return fmt.Errorf("embedded broker needs users or allow_anonymous: true")
+	}
+	if err := validateACL(c.AnonymousACL, "anonymous clients"); err != nil {
+		return err
+	}
+	users := make(map[string]bool)
+	for _, user := range c.Users {
+		if user.Username == "" {
+			return fmt.Errorf("username of embedded broker user must not be empty")
+		}
+		if users[user.Username] {
+			return fmt.Errorf("embedded broker user %v is configured more than once", user.Username)
+		}
+		users[user.Username] = true
+		if err := validateACL(user.ACL, "user "+user.Username); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func validateACL(rules []ACLRule, owner string) error {
+	for _, rule := range rules {
+		if rule.Topic == "" {
+			return fmt.Errorf("topic of ACL rule of %v must not be empty", owner)
+		}
+		switch rule.Access {
+		case "", accessRead, accessWrite, accessReadWrite, accessDeny:
+		default:
+			return fmt.Errorf("unknown access %q of %v, use %v, %v, %v or %v", rule.Access, owner, accessRead, accessWrite, accessReadWrite, accessDeny)
+		}
+	}
+	return nil
+}
+
+// allowed reports whether the user may publish to a topic or subscribe to a
+// topic filter.
+func (u *BrokerUser) allowed(topic string, write bool) bool {
+	if len(u.ACL) == 0 {
+		return true
+	}
+	for _, rule := range u.ACL {
+		if !topicMatches(rule.Topic, topic) {
+			continue
+		}
+		switch rule.Access {
+		case accessRead:
+			return !write
+		case accessWrite:
+			return write
+		case accessDeny:
+			return false
+		default:
+			return true
+		}
+	}
+	return false
+}
+
+// setupEmbeddedBroker starts the listeners of the embedded broker.
+func (m *MetricSet) setupEmbeddedBroker() error {
+	log := zerolog.New(brokerLog{logp.NewLogger("mqtt.broker")}).Level(zerolog.InfoLevel)
+	server := mqtt.New(&mqtt.Options{Logger: &log})
+
+	hook := &brokerHook{m: m, users: make(map[string]*BrokerUser)}
+	for i := range m.EmbeddedBroker.Users {
+		user := &m.EmbeddedBroker.Users[i]
+		hook.users[user.Username] = user
+	}
+	if m.EmbeddedBroker.AllowAnonymous {
+		hook.anonymous = &BrokerUser{ACL: m.EmbeddedBroker.AnonymousACL}
+	}
+	if err := server.AddHook(hook, nil); err != nil {
+		return err
+	}
+
+	for i, l := range m.EmbeddedBroker.Listeners {
+		id := fmt.Sprintf("%v-%v", l.Type, i)
+		config := &listeners.Config{TLSConfig: l.tlsConfig}
+		var listener listeners.Listener
+		if l.Type == listenerWebsocket {
+			listener = &websocketListener{id: id, address: l.Address, tlsConfig: l.tlsConfig}
+		} else {
+			listener = listeners.NewTCP(id, l.Address, config)
+		}
+		if err := server.AddListener(listener); err != nil {
+			server.Close()
+			return fmt.Errorf("failed to start %v listener of embedded broker on %v: %v", l.Type, l.Address, err)
+		}
+		logp.Info("[MQTT] Embedded broker listens on %v (%v, TLS %t)", l.Address, l.Type, l.tlsConfig != nil)
+	}
+
+	if err := server.Serve(); err != nil {
+		server.Close()
+		return err
+	}
+	m.conn = &embeddedConnection{server: server}
+	m.publishBirth()
+	return nil
+}
+
+// brokerHook authenticates the clients of the embedded broker, checks their
+// ACL rules and ingests the messages they publish. anonymous holds the ACL
+// rules of clients without username, it is nil unless they are allowed.
+type brokerHook struct {
+	mqtt.HookBase
+	m         *MetricSet
+	users     map[string]*BrokerUser
+	anonymous *BrokerUser
+}
+
+func (h *brokerHook) ID() string {
+	return "machinebeat"
+}
+
+func (h *brokerHook) Provides(b byte) bool {
+	return b == mqtt.OnConnectAuthenticate || b == mqtt.OnACLCheck || b == mqtt.OnPublish
+}
+
+func (h *brokerHook) OnConnectAuthenticate(cl *mqtt.Client, pk packets.Packet) bool {
+	username := string(pk.Connect.Username)
+	user := h.user(username)
+	if user == nil {
+		if username == "" {
+			logp.Warn("[MQTT] Embedded broker rejected anonymous client from %v", cl.Net.Remote)
+		} else {
+			logp.Warn("[MQTT] Embedded broker rejected unknown user %v from %v", username, cl.Net.Remote)
+		}
+		return false
+	}
+	if username != "" && subtle.ConstantTimeCompare([]byte(user.Password), pk.Connect.Password) != 1 {
+		logp.Warn("[MQTT] Embedded broker rejected user %v from %v with wrong password", username, cl.Net.Remote)
+		return false
+	}
+	// The broker publishes wills without checking the ACL
+	if pk.Connect.WillFlag && !user.allowed(pk.Connect.WillTopic, true) {
+		logp.Warn("[MQTT] Embedded broker rejected user %v from %v with will to %v", username, cl.Net.Remote, pk.Connect.WillTopic)
+		return false
+	}
+	return true
+}
+
+// OnACLCheck checks the subscriptions of the clients. Publishing is checked
+// by OnPublish.
+func (h *brokerHook) OnACLCheck(cl *mqtt.Client, topic string, write bool) bool {
+	return write || h.allowed(cl, topic, false)
+}
+
+// user returns the user of a username, or the anonymous user for an empty
+// username. It returns nil for clients that may not connect.
+func (h *brokerHook) user(username string) *BrokerUser {
+	if username == "" {
+		return h.anonymous
+	}
+	return h.users[username]
+}
+
+func (h *brokerHook) allowed(cl *mqtt.Client, topic string, write bool) bool {
+	user := h.user(string(cl.Properties.Username))
+	if user == nil || !user.allowed(topic, write) {
+		logp.Debug("MQTT", "Embedded broker denied access of %q to %v", cl.Properties.Username, topic)
+		return false
+	}
+	return true
+}
+
+// OnPublish ingests the messages of the clients that match a subscription.
+// If the event buffer is full and blocks, the broker doesn't acknowledge the
+// message until there is room again.
+func (h *brokerHook) OnPublish(cl *mqtt.Client, pk packets.Packet) (packets.Packet, error) {
+	if cl.Net.Inline {
+		// Messages of Machinebeat itself, like the status messages
+		return pk, nil
+	}
+	if !h.allowed(cl, pk.TopicName, true) {
+		// MQTT 3.1.1 clients can't be told, their messages are acknowledged
+		// and dropped, so they don't wait for the acknowledgement
+		if pk.ProtocolVersion == 5 && pk.FixedHeader.Qos > 0 {
+			return pk, packets.ErrNotAuthorized
+		}
+		pk.Ignore = true
+		return pk, nil
+	}
+	for i := range h.m.TopicsSubscribe {
+		if h.m.TopicsSubscribe[i].matches(pk.TopicName) {
+			h.m.handleMessage(messageFromPacket(pk))
+			break
+		}
+	}
+	return pk, nil
+}
+
+// embeddedConnection publishes the messages of the MetricSet to the clients
+// of the embedded broker.
+type embeddedConnection struct {
+	server *mqtt.Server
+}
+
+func (c *embeddedConnection) publish(topic string, qos byte, retain bool, payload []byte) {
+	if err := c.server.Publish(topic, payload, retain, qos); err != nil {
+		logp.Warn("[MQTT] Failed to publish to %v: %v", topic, err)
+	}
+}
+
+func (c *embeddedConnection) publishWait(topic string, qos byte, retain bool, payload []byte, timeout time.Duration) error {
+	return c.server.Publish(topic, payload, retain, qos)
+}
+
+func (c *embeddedConnection) disconnect() {
+	c.server.Close()
+}
+
+// websocketListener accepts MQTT clients over websocket connections. Unlike
+// the listener of the broker it reports if the address can't be used.
+type websocketListener struct {
+	id        string
+	address   string
+	tlsConfig *tls.Config
+
+	listener net.Listener
+	server   *http.Server
+}
+
+func (l *websocketListener) ID() string       { return l.id }
+func (l *websocketListener) Address() string  { return l.address }
+func (l *websocketListener) Protocol() string { return "ws" }
+
+func (l *websocketListener) Init(log *zerolog.Logger) error {
+	listener, err := net.Listen("tcp", l.address)
+	if err != nil {
+		return err
+	}
+	if l.tlsConfig != nil {
+		listener = tls.NewListener(listener, l.tlsConfig)
+	}
+	l.listener = listener
+	return nil
+}
+
+func (l *websocketListener) Serve(establish listeners.EstablishFn) {
+	upgrader := websocket.Upgrader{
+		Subprotocols: []string{"mqtt"},
+		CheckOrigin:  func(r *http.Request) bool { return true },
+	}
+	l.server = &http.Server{
+		Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			conn, err := upgrader.Upgrade(w, r, nil)
+			if err != nil {
+				return
+			}
+			// establish returns when the client disconnects
+			if err := establish(l.id, &websocketConn{Conn: conn}); err != nil {
+				logp.Debug("MQTT", "Embedded broker websocket client %v: %v", r.RemoteAddr, err)
+			}
+		}),
+	}
+	l.server.Serve(l.listener)
+}
+
+func (l *websocketListener) Close(closeClients listeners.CloseFn) {
+	closeClients(l.id)
+	if l.server != nil {
+		l.server.Close()
+	} else {
+		l.listener.Close()
+	}
+}
+
+// brokerLog writes the log of the embedded broker to the log of the beat.
+type brokerLog struct {
+	log *logp.Logger
+}
+
+func (l brokerLog) Write(p []byte) (int, error) {
+	var entry map[string]interface{}
+	if err := json.Unmarshal(p, &entry); err != nil {
+		l.log.Info(strings.TrimSpace(string(p)))
+		return len(p), nil
+	}
+	level, _ := entry[zerolog.LevelFieldName].(string)
+	message, _ := entry[zerolog.MessageFieldName].(string)
+	delete(entry, zerolog.LevelFieldName)
+	delete(entry, zerolog.MessageFieldName)
+	if message == "" {
+		// Errors of client connections are logged without a message
+		message, _ = entry[zerolog.ErrorFieldName].(string)
+		delete(entry, zerolog.ErrorFieldName)
+	}
+	// Packets are logged with their payload
+	delete(entry, "packet")
+	fields := make([]interface{}, 0, 2*len(entry))
+	for key, value := range entry {
+		fields = append(fields, key, value)
+	}
+
+	switch level {
+	case "trace", "debug":
+		l.log.Debugw(message, fields...)
+	case "warn":
+		l.log.Warnw(message, fields...)
+	case "error", "fatal", "panic":
+		l.log.Errorw(message, fields...)
+	default:
+		l.log.Infow(message, fields...)
+	}
+	return len(p), nil
+}
@@ -0,0 +1,226 @@
+package topic
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"github.com/elastic/beats/v7/metricbeat/mb"
+	mbtest "github.com/elastic/beats/v7/metricbeat/mb/testing"
+
+	MQTT "github.com/eclipse/paho.mqtt.golang"
+)
+
+// freeAddress returns a free local address. The TCP listener of the broker
+// doesn't report the port it got for 127.0.0.1:0, so the test reserves one.
+func freeAddress(t *testing.T) string {
+	t.Helper()
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	return l.Addr().String()
+}
+
+// startEmbeddedBroker starts a MetricSet with an embedded broker that has the
+// users press1, which may only publish to its own topics, and hmi. With
+// anonymous clients without username may connect and read factory/#.
+func startEmbeddedBroker(t *testing.T, anonymous bool) (mb.ReportingMetricSetV2Error, string) {
+	t.Helper()
+	address := freeAddress(t)
+	broker := map[string]interface{}{
+		"enabled":   true,
+		"listeners": []map[string]interface{}{{"type": "tcp", "address": address}},
+		"users": []map[string]interface{}{
+			{
+				"username": "press1",
+				"password": "secret",
+				"acl": []map[string]interface{}{
+					{"topic": "factory/press1/#", "access": "write"},
+					{"topic": "spBv1.0/factory/+/press1/#", "access": "write"},
+				},
+			},
+			{"username": "hmi", "password": "secret"},
+		},
+	}
+	if anonymous {
+		broker["allow_anonymous"] = true
+		broker["anonymous_acl"] = []map[string]interface{}{{"topic": "factory/#", "access": "read"}}
+	}
+	ms := mbtest.NewReportingMetricSetV2Error(t, map[string]interface{}{
+		"module":          "mqtt",
+		"metricsets":      []string{"topic"},
+		"topics":          []string{"factory/#", "spBv1.0/#"},
+		"embedded_broker": broker,
+	})
+	t.Cleanup(func() { ms.(*MetricSet).Close() })
+	return ms, address
+}
+
+func connectClient(address, username, password string) (MQTT.Client, error) {
+	options := MQTT.NewClientOptions().
+		AddBroker("tcp://" + address).
+		SetClientID(username + "-test").
+		SetUsername(username).
+		SetPassword(password).
+		SetAutoReconnect(false).
+		SetConnectRetry(false)
+	client := MQTT.NewClient(options)
+	token := client.Connect()
+	if !token.WaitTimeout(5 * time.Second) {
+		return nil, net.ErrClosed
+	}
+	return client, token.Error()
+}
+
+func publish(t *testing.T, client MQTT.Client, topic string, retain bool, payload []byte) {
+	t.Helper()
+	token := client.Publish(topic, 1, retain, payload)
+	if !token.WaitTimeout(5*time.Second) || token.Error() != nil {
+		t.Fatalf("failed to publish to %v: %v", topic, token.Error())
+	}
+}
+
+// fetchEvents fetches the events of the MetricSet until it got n of them.
+func fetchEvents(t *testing.T, ms mb.ReportingMetricSetV2Error, n int) []mb.Event {
+	t.Helper()
+	var events []mb.Event
+	deadline := time.Now().Add(5 * time.Second)
+	for len(events) < n && time.Now().Before(deadline) {
+		fetched, errs := mbtest.ReportingFetchV2Error(ms)
+		if len(errs) > 0 {
+			t.Fatal(errs)
+		}
+		events = append(events, fetched...)
+		time.Sleep(10 * time.Millisecond)
+	}
+	if len(events) != n {
+		t.Fatalf("got %v events, want %v", len(events), n)
+	}
+	return events
+}
+
+func TestEmbeddedBroker(t *testing.T) {
+	ms, address := startEmbeddedBroker(t, false)
+	client, err := connectClient(address, "press1", "secret")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Disconnect(0)
+
+	publish(t, client, "factory/press1/temperature", false, []byte(`{"value": 21.5}`))
+	publish(t, client, "factory/press1/state", true, []byte(`"running"`))
+	publish(t, client, "spBv1.0/factory/NBIRTH/press1", false, tahuPayload(t, `
+		timestamp: 1681914102000
+		seq: 0
+		metrics {name: "bdSeq" datatype: 8 long_value: 3}
+		metrics {name: "Pressure" datatype: 10 double_value: 1.25}
+	`))
+	events := fetchEvents(t, ms, 4)
+
+	checkField(t, events[0], "event.dataset", "factory/press1/temperature")
+	checkField(t, events[0], "payload.value", 21.5)
+	if retained, _ := events[0].ModuleFields.GetValue("retained"); retained != nil {
+		t.Errorf("got retained %v for a message that isn't retained", retained)
+	}
+
+	checkField(t, events[1], "event.dataset", "factory/press1/state")
+	checkField(t, events[1], "payload", "running")
+	if retained, _ := events[1].ModuleFields.GetValue("retained"); retained != true {
+		t.Errorf("got retained %v, want true", retained)
+	}
+
+	for i, name := range []string{"bdSeq", "Pressure"} {
+		event := events[2+i]
+		checkField(t, event, "sparkplug.message_type", "NBIRTH")
+		checkField(t, event, "sparkplug.edge_node_id", "press1")
+		checkField(t, event, "sensor.name", name)
+	}
+	checkField(t, events[2], "value.value_uint64", uint64(3))
+	checkField(t, events[3], "value.value_float64", 1.25)
+}
+
+func TestEmbeddedBrokerACL(t *testing.T) {
+	ms, address := startEmbeddedBroker(t, false)
+	client, err := connectClient(address, "press1", "secret")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Disconnect(0)
+
+	// MQTT 3.1.1 clients get the acknowledgement of denied messages, so the
+	// message that is allowed shows that the denied one was handled before
+	publish(t, client, "factory/press2/temperature", false, []byte("20"))
+	publish(t, client, "factory/press1/temperature", false, []byte("21"))
+	events := fetchEvents(t, ms, 1)
+	checkField(t, events[0], "event.dataset", "factory/press1/temperature")
+
+	token := client.Subscribe("factory/#", 1, nil)
+	if !token.WaitTimeout(5 * time.Second) {
+		t.Fatal("subscription timed out")
+	}
+	if sub, ok := token.(*MQTT.SubscribeToken); !ok || sub.Result()["factory/#"] != 0x80 {
+		t.Errorf("subscription of press1 to factory/# wasn't denied")
+	}
+}
+
+func TestEmbeddedBrokerAnonymousACL(t *testing.T) {
+	ms, address := startEmbeddedBroker(t, true)
+	anonymous, err := connectClient(address, "", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer anonymous.Disconnect(0)
+	press1, err := connectClient(address, "press1", "secret")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer press1.Disconnect(0)
+
+	token := anonymous.Subscribe("factory/#", 1, nil)
+	if !token.WaitTimeout(5*time.Second) || token.Error() != nil {
+		t.Fatalf("anonymous subscription to factory/# failed: %v", token.Error())
+	}
+	if sub := token.(*MQTT.SubscribeToken); sub.Result()["factory/#"] == 0x80 {
+		t.Errorf("anonymous subscription to factory/# was denied")
+	}
+
+	publish(t, anonymous, "factory/press1/temperature", false, []byte("20"))
+	publish(t, press1, "factory/press1/temperature", false, []byte("21"))
+	events := fetchEvents(t, ms, 1)
+	checkField(t, events[0], "message", "21")
+}
+
+func TestEmbeddedBrokerAuthentication(t *testing.T) {
+	_, address := startEmbeddedBroker(t, false)
+	tests := []struct {
+		name     string
+		username string
+		password string
+		accepted bool
+	}{
+		{name: "user", username: "hmi", password: "secret", accepted: true},
+		{name: "wrong password", username: "hmi", password: "wrong"},
+		{name: "unknown user", username: "press2", password: "secret"},
+		{name: "anonymous", username: ""},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			client, err := connectClient(address, test.username, test.password)
+			if err == nil {
+				defer client.Disconnect(0)
+			}
+			if accepted := err == nil; accepted != test.accepted {
+				t.Errorf("got accepted %v (%v), want %v", accepted, err, test.accepted)
+			}
+		})
+	}
+}
+
+func checkField(t *testing.T, event mb.Event, key string, want interface{}) {
+	t.Helper()
+	if got, _ := event.RootFields.GetValue(key); got != want {
+		t.Errorf("got %v %#v, want %#v", key, got, want)
+	}
+}
@@ -0,0 +1,228 @@
+package topic
+
+import (
+	"fmt"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/elastic/beats/v7/libbeat/common"
+)
+
+// jsonPath is a compiled JSONPath expression. The supported subset are the
+// roots $ (the payload) and @ (the current element of a split payload), keys
+// as .key or ['key'], array indexes like [0] or [-1], the wildcards .* and [*]
+// and the recursive descent ..key.
+type jsonPath struct {
+	expr    string
+	current bool
+	steps   []pathStep
+}
+
+type stepKind int
+
+const (
+	stepKey stepKind = iota
+	stepIndex
+	stepWildcard
+)
+
+type pathStep struct {
+	kind      stepKind
+	key       string
+	index     int
+	recursive bool
+}
+
+func compileJSONPath(expr string) (*jsonPath, error) {
+	if expr == "" || (expr[0] != '$' && expr[0] != '@') {
+		return nil, fmt.Errorf("JSONPath %q must start with $ or @", expr)
+	}
+	path := &jsonPath{expr: expr, current: expr[0] == '@'}
+	for i := 1; i < len(expr); {
+		var step pathStep
+		switch {
+		case strings.HasPrefix(expr[i:], ".."):
+			step.recursive = true
+			i += 2
+			if i < len(expr) && expr[i] == '[' {
+				n, err := parseBracket(expr, i, &step)
+				if err != nil {
+					return nil, err
+				}
+				i = n
+				path.steps = append(path.steps, step)
+				continue
+			}
+		case expr[i] == '.':
+			i++
+		case expr[i] == '[':
+			n, err := parseBracket(expr, i, &step)
+			if err != nil {
+				return nil, err
+			}
+			i = n
+			path.steps = append(path.steps, step)
+			continue
+		default:
+			return nil, fmt.Errorf("unexpected %q at position %v of JSONPath %q", expr[i], i, expr)
+		}
+
+		end := i
+		for end < len(expr) && expr[end] != '.' && expr[end] != '[' {
+			end++
+		}
+		name := expr[i:end]
+		switch name {
+		case "":
+			return nil, fmt.Errorf("missing key at position %v of JSONPath %q", i, expr)
+		case "*":
+			step.kind = stepWildcard
+		default:
+			step.kind = stepKey
+			step.key = name
+		}
+		path.steps = append(path.steps, step)
+		i = end
+	}
+	return path, nil
+}
+
+// parseBracket parses a [*], [index] or ['key'] step that starts at i and
+// returns the position after it.
+func parseBracket(expr string, i int, step *pathStep) (int, error) {
+	end := strings.IndexByte(expr[i:], ']')
+	if end < 0 {
+		return 0, fmt.Errorf("missing ] in JSONPath %q", expr)
+	}
+	content := strings.TrimSpace(expr[i+1 : i+end])
+	switch {
+	case content == "*":
+		step.kind = stepWildcard
+	case len(content) >= 2 && (content[0] == '\'' || content[0] == '"') && content[len(content)-1] == content[0]:
+		step.kind = stepKey
+		step.key = content[1 : len(content)-1]
+	default:
+		index, err := strconv.Atoi(content)
+		if err != nil {
+			return 0, fmt.Errorf("invalid index %q in JSONPath %q", content, expr)
+		}
+		step.kind = stepIndex
+		step.index = index
+	}
+	return i + end + 1, nil
+}
+
+// eval returns all values the path matches in the payload root or, for paths
+// starting with @, in the current element.
+func (p *jsonPath) eval(root, current interface{}) []interface{} {
+	values := []interface{}{root}
+	if p.current {
+		values[0] = current
+	}
+	for _, step := range p.steps {
+		var next []interface{}
+		for _, value := range values {
+			if step.recursive {
+				for _, descendant := range descendants(value) {
+					next = step.apply(descendant, next)
+				}
+			} else {
+				next = step.apply(value, next)
+			}
+		}
+		values = next
+	}
+	return values
+}
+
+// first returns the first value the path matches.
+func (p *jsonPath) first(root, current interface{}) (interface{}, bool) {
+	values := p.eval(root, current)
+	if len(values) == 0 {
+		return nil, false
+	}
+	return values[0], true
+}
+
+func (s *pathStep) apply(value interface{}, matches []interface{}) []interface{} {
+	switch s.kind {
+	case stepKey:
+		if fields, ok := toMapStr(value); ok {
+			if v, found := fields[s.key]; found {
+				matches = append(matches, v)
+			}
+		}
+	case stepIndex:
+		if list, ok := toList(value); ok {
+			index := s.index
+			if index < 0 {
+				index += len(list)
+			}
+			if index >= 0 && index < len(list) {
+				matches = append(matches, list[index])
+			}
+		}
+	case stepWildcard:
+		if fields, ok := toMapStr(value); ok {
+			for _, key := range sortedKeys(fields) {
+				matches = append(matches, fields[key])
+			}
+		} else if list, ok := toList(value); ok {
+			matches = append(matches, list...)
+		}
+	}
+	return matches
+}
+
+// descendants returns a value and all values nested in it.
+func descendants(value interface{}) []interface{} {
+	all := []interface{}{value}
+	if fields, ok := toMapStr(value); ok {
+		for _, key := range sortedKeys(fields) {
+			all = append(all, descendants(fields[key])...)
+		}
+	} else if list, ok := toList(value); ok {
+		for _, item := range list {
+			all = append(all, descendants(item)...)
+		}
+	}
+	return all
+}
+
+func toMapStr(value interface{}) (common.MapStr, bool) {
+	switch v := value.(type) {
+	case common.MapStr:
+		return v, true
+	case map[string]interface{}:
+		return common.MapStr(v), true
+	}
+	return nil, false
+}
+
+// toList returns the items of arrays, which decoders may return as slices
+// of any type.
+func toList(value interface{}) ([]interface{}, bool) {
+	if list, ok := value.([]interface{}); ok {
+		return list, true
+	}
+	v := reflect.ValueOf(value)
+	if v.Kind() != reflect.Slice || v.Type().Elem().Kind() == reflect.Uint8 {
+		return nil, false
+	}
+	list := make([]interface{}, v.Len())
+	for i := range list {
+		list[i] = v.Index(i).Interface()
+	}
+	return list, true
+}
+
+func sortedKeys(fields common.MapStr) []string {
+	keys := make([]string, 0, len(fields))
+	for key := range fields {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
@@ -0,0 +1,128 @@
+package topic
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestCompileJSONPath(t *testing.T) {
+	tests := []struct {
+		expr    string
+		current bool
+		steps   []pathStep
+	}{
+		{expr: "$"},
+		{expr: "@", current: true},
+		{expr: "$.machine.name", steps: []pathStep{{kind: stepKey, key: "machine"}, {kind: stepKey, key: "name"}}},
+		{expr: "@.value", current: true, steps: []pathStep{{kind: stepKey, key: "value"}}},
+		{expr: "$['machine name']", steps: []pathStep{{kind: stepKey, key: "machine name"}}},
+		{expr: `$["a.b"]`, steps: []pathStep{{kind: stepKey, key: "a.b"}}},
+		{expr: "$[ 'key' ]", steps: []pathStep{{kind: stepKey, key: "key"}}},
+		{expr: "$[0]", steps: []pathStep{{kind: stepIndex, index: 0}}},
+		{expr: "$.values[-1]", steps: []pathStep{{kind: stepKey, key: "values"}, {kind: stepIndex, index: -1}}},
+		{expr: "$.*", steps: []pathStep{{kind: stepWildcard}}},
+		{expr: "$[*].name", steps: []pathStep{{kind: stepWildcard}, {kind: stepKey, key: "name"}}},
+		{expr: "$..name", steps: []pathStep{{kind: stepKey, key: "name", recursive: true}}},
+		{expr: "$..*", steps: []pathStep{{kind: stepWildcard, recursive: true}}},
+		{expr: "$..[1]", steps: []pathStep{{kind: stepIndex, index: 1, recursive: true}}},
+		{expr: "$.sensors..['value']", steps: []pathStep{{kind: stepKey, key: "sensors"}, {kind: stepKey, key: "value", recursive: true}}},
+	}
+	for _, test := range tests {
+		path, err := compileJSONPath(test.expr)
+		if err != nil {
+			t.Errorf("%v: %v", test.expr, err)
+			continue
+		}
+		if path.expr != test.expr || path.current != test.current || !reflect.DeepEqual(path.steps, test.steps) {
+			t.Errorf("%v: got %+v, want current %v and steps %+v", test.expr, path, test.current, test.steps)
+		}
+	}
+}
+
+func TestCompileJSONPathErrors(t *testing.T) {
+	tests := map[string]string{
+		"empty":                     "",
+		"no root":                   "machine.name",
+		"key without dot":           "$machine",
+		"missing key":               "$.machine.",
+		"empty key":                 "$..",
+		"missing ]":                 "$.values[0",
+		"invalid index":             "$.values[first]",
+		"empty brackets":            "$.values[]",
+		"mismatched quotes":         `$['name"]`,
+		"recursive missing ]":       "$..[0",
+		"recursive invalid index":   "$..[x]",
+		"missing key after bracket": "$[0].",
+	}
+	for name, expr := range tests {
+		if path, err := compileJSONPath(expr); err == nil {
+			t.Errorf("%v: expected an error for %q, got %+v", name, expr, path)
+		}
+	}
+}
+
+func TestJSONPathEval(t *testing.T) {
+	root := map[string]interface{}{
+		"machine": map[string]interface{}{
+			"name": "press1",
+			"sensors": []interface{}{
+				map[string]interface{}{"name": "temperature", "value": 21.5},
+				map[string]interface{}{"name": "pressure", "value": 1.2},
+			},
+		},
+		"values": []float64{1, 2, 3},
+		"raw":    []byte("abc"),
+		"a.b":    true,
+	}
+	current := map[string]interface{}{"value": 7}
+
+	tests := []struct {
+		expr string
+		want []interface{}
+	}{
+		{expr: "$.machine.name", want: []interface{}{"press1"}},
+		{expr: "$['machine']['name']", want: []interface{}{"press1"}},
+		{expr: "$['a.b']", want: []interface{}{true}},
+		{expr: "$.machine.sensors[0].value", want: []interface{}{21.5}},
+		{expr: "$.machine.sensors[-1].name", want: []interface{}{"pressure"}},
+		{expr: "$.values[1]", want: []interface{}{float64(2)}},
+		{expr: "$.values[-3]", want: []interface{}{float64(1)}},
+		{expr: "$.values[*]", want: []interface{}{float64(1), float64(2), float64(3)}},
+		{expr: "$.machine.sensors[*].name", want: []interface{}{"temperature", "pressure"}},
+		{expr: "$.machine.sensors.*.value", want: []interface{}{21.5, 1.2}},
+		{expr: "$..name", want: []interface{}{"press1", "temperature", "pressure"}},
+		{expr: "$..value", want: []interface{}{21.5, 1.2}},
+		{expr: "$..[1]", want: []interface{}{map[string]interface{}{"name": "pressure", "value": 1.2}, float64(2)}},
+		{expr: "$.machine..*", want: []interface{}{
+			"press1",
+			root["machine"].(map[string]interface{})["sensors"],
+			root["machine"].(map[string]interface{})["sensors"].([]interface{})[0],
+			root["machine"].(map[string]interface{})["sensors"].([]interface{})[1],
+			"temperature", 21.5, "pressure", 1.2,
+		}},
+		{expr: "@.value", want: []interface{}{7}},
+		{expr: "@", want: []interface{}{current}},
+		// Missing keys, indexes out of range and steps that don't fit the value
+		{expr: "$.machine.serial"},
+		{expr: "$.values[3]"},
+		{expr: "$.values[-4]"},
+		{expr: "$.machine.name.first"},
+		{expr: "$.machine[0]"},
+		{expr: "$.raw[0]"},
+		{expr: "$.machine.name[*]"},
+	}
+	for _, test := range tests {
+		path, err := compileJSONPath(test.expr)
+		if err != nil {
+			t.Errorf("%v: %v", test.expr, err)
+			continue
+		}
+		if got := path.eval(root, current); !reflect.DeepEqual(got, test.want) {
+			t.Errorf("%v: got %#v, want %#v", test.expr, got, test.want)
+		}
+		first, found := path.first(root, current)
+		if found != (len(test.want) > 0) || (found && !reflect.DeepEqual(first, test.want[0])) {
+			t.Errorf("%v: got first %#v, %v", test.expr, first, found)
+		}
+	}
+}
@@ -0,0 +1,147 @@
+package topic
+
+import (
+	"fmt"
+	"sort"
+
+	"github.com/elastic/beats/v7/libbeat/common"
+	"github.com/elastic/beats/v7/metricbeat/mb"
+	"github.com/elastic/machinebeat/helper/typed"
+)
+
+// Mapping maps decoded payloads into events with the fields of the OPC UA
+// module. The settings are JSONPath expressions, paths starting with @ are
+// evaluated on every element of a split payload.
+type Mapping struct {
+	// Split publishes one event per element of the array at the path
+	Split string `config:"split"`
+	// Timestamp is the @timestamp and value.source_timestamp of the event
+	Timestamp       string `config:"timestamp"`
+	TimestampFormat string `config:"timestamp_format"`
+	// Name is the sensor.name and Value the value.value_<type> of the event
+	Name  string `config:"name"`
+	Value string `config:"value"`
+	// Fields maps event fields to paths
+	Fields common.MapStr `config:"fields"`
+
+	split     *jsonPath
+	timestamp *jsonPath
+	name      *jsonPath
+	value     *jsonPath
+	fields    []fieldMapping
+}
+
+type fieldMapping struct {
+	field string
+	path  *jsonPath
+}
+
+// validate compiles the paths of the mapping.
+func (mp *Mapping) validate() error {
+	var err error
+	compile := func(expr string) *jsonPath {
+		if expr == "" || err != nil {
+			return nil
+		}
+		var path *jsonPath
+		path, err = compileJSONPath(expr)
+		return path
+	}
+	mp.split = compile(mp.Split)
+	mp.timestamp = compile(mp.Timestamp)
+	mp.name = compile(mp.Name)
+	mp.value = compile(mp.Value)
+
+	fields := mp.Fields.Flatten()
+	names := make([]string, 0, len(fields))
+	for name := range fields {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	mp.fields = nil
+	for _, name := range names {
+		expr, ok := fields[name].(string)
+		if !ok {
+			return fmt.Errorf("path of mapped field %v must be a string", name)
+		}
+		mp.fields = append(mp.fields, fieldMapping{field: name, path: compile(expr)})
+	}
+	return err
+}
+
+// mapsFields reports whether the mapping sets fields. Otherwise the elements
+// of a split payload are written to the decode target like whole payloads.
+func (mp *Mapping) mapsFields() bool {
+	return mp.name != nil || mp.value != nil || len(mp.fields) > 0
+}
+
+// mapMessage decodes a message and maps it into one event, or one event per
+// element of a split payload. The events are copies of the base event.
+func mapMessage(m *MetricSet, msg *message, sub *Subscription, decoder Decoder, base mb.Event) []mb.Event {
+	root, ok := decodeValue(m, msg, sub, decoder, &base)
+	if !ok {
+		return []mb.Event{base}
+	}
+
+	mp := sub.Mapping
+	elements := []interface{}{root}
+	if mp.split != nil {
+		elements = mp.split.eval(root, root)
+		// A path to an array splits the array
+		if len(elements) == 1 {
+			if list, ok := toList(elements[0]); ok {
+				elements = list
+			}
+		}
+		if len(elements) == 0 {
+			addDecodeFailure(&base, fmt.Errorf("split path %v matches no elements", mp.Split))
+			return []mb.Event{base}
+		}
+	}
+
+	events := make([]mb.Event, 0, len(elements))
+	for _, element := range elements {
+		event := base
+		event.RootFields = base.RootFields.Clone()
+		event.ModuleFields = base.ModuleFields.Clone()
+		target := event.ModuleFields
+		if m.ECSFields {
+			target = event.RootFields
+		}
+
+		if mp.timestamp != nil {
+			if value, found := mp.timestamp.first(root, element); found {
+				ts, err := toTimestamp(value, mp.TimestampFormat)
+				if err != nil {
+					addDecodeFailure(&event, fmt.Errorf("invalid timestamp at %v: %v", mp.Timestamp, err))
+				} else {
+					event.Timestamp = ts
+					event.RootFields.Put("value.source_timestamp", ts.UTC())
+				}
+			}
+		}
+
+		if !mp.mapsFields() {
+			putDecoded(m, element, target)
+			events = append(events, event)
+			continue
+		}
+		if mp.name != nil {
+			if name, found := mp.name.first(root, element); found {
+				event.RootFields.Put("sensor.name", fmt.Sprint(name))
+			}
+		}
+		if mp.value != nil {
+			if value, found := mp.value.first(root, element); found {
+				typed.Put(event.RootFields, value)
+			}
+		}
+		for _, f := range mp.fields {
+			if value, found := f.path.first(root, element); found {
+				event.RootFields.Put(f.field, value)
+			}
+		}
+		events = append(events, event)
+	}
+	return events
+}
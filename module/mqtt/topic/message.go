@@ -0,0 +1,169 @@
+package topic
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/elastic/beats/v7/libbeat/common"
+
+	"github.com/eclipse/paho.golang/paho"
+	MQTT "github.com/eclipse/paho.mqtt.golang"
+	"github.com/mochi-mqtt/server/v2/packets"
+)
+
+// connection is the connection of a MetricSet to its broker. It hides the
+// differences between the MQTT 3.1.1 and the MQTT 5 client.
+type connection interface {
+	// publish sends a message without waiting for the acknowledgement of the broker.
+	publish(topic string, qos byte, retain bool, payload []byte)
+	// publishWait sends a message and waits for the acknowledgement of the broker.
+	publishWait(topic string, qos byte, retain bool, payload []byte, timeout time.Duration) error
+	disconnect()
+}
+
+// message is a received MQTT message. The properties are only set by MQTT 5 brokers.
+type message struct {
+	topic     string
+	payload   []byte
+	qos       byte
+	retained  bool
+	duplicate bool
+	id        uint16
+
+	contentType     string
+	responseTopic   string
+	correlationData []byte
+	messageExpiry   *uint32
+	payloadFormat   *byte
+	userProperties  common.MapStr
+}
+
+func messageFromV3(msg MQTT.Message) *message {
+	return &message{
+		topic:     msg.Topic(),
+		payload:   msg.Payload(),
+		qos:       msg.Qos(),
+		retained:  msg.Retained(),
+		duplicate: msg.Duplicate(),
+		id:        msg.MessageID(),
+	}
+}
+
+func messageFromV5(p *paho.Publish) *message {
+	msg := &message{
+		topic:    p.Topic,
+		payload:  p.Payload,
+		qos:      p.QoS,
+		retained: p.Retain,
+		id:       p.PacketID,
+	}
+	if p.Properties == nil {
+		return msg
+	}
+
+	msg.contentType = p.Properties.ContentType
+	msg.responseTopic = p.Properties.ResponseTopic
+	msg.correlationData = p.Properties.CorrelationData
+	msg.messageExpiry = p.Properties.MessageExpiry
+	msg.payloadFormat = p.Properties.PayloadFormat
+	for _, property := range p.Properties.User {
+		msg.addUserProperty(property.Key, property.Value)
+	}
+	return msg
+}
+
+// messageFromPacket converts a message that a client published to the
+// embedded broker.
+func messageFromPacket(pk packets.Packet) *message {
+	msg := &message{
+		topic:     pk.TopicName,
+		payload:   pk.Payload,
+		qos:       pk.FixedHeader.Qos,
+		retained:  pk.FixedHeader.Retain,
+		duplicate: pk.FixedHeader.Dup,
+		id:        pk.PacketID,
+	}
+	if pk.ProtocolVersion != 5 {
+		return msg
+	}
+
+	msg.contentType = pk.Properties.ContentType
+	msg.responseTopic = pk.Properties.ResponseTopic
+	msg.correlationData = pk.Properties.CorrelationData
+	if expiry := pk.Properties.MessageExpiryInterval; expiry > 0 {
+		msg.messageExpiry = &expiry
+	}
+	if pk.Properties.PayloadFormatFlag {
+		format := pk.Properties.PayloadFormat
+		msg.payloadFormat = &format
+	}
+	for _, property := range pk.Properties.User {
+		msg.addUserProperty(property.Key, property.Val)
+	}
+	return msg
+}
+
+// addUserProperty adds a MQTT 5 user property. User properties may be
+// repeated, repeated keys become arrays.
+func (msg *message) addUserProperty(key, value string) {
+	if msg.userProperties == nil {
+		msg.userProperties = make(common.MapStr)
+	}
+	switch existing := msg.userProperties[key].(type) {
+	case nil:
+		msg.userProperties[key] = value
+	case string:
+		msg.userProperties[key] = []string{existing, value}
+	case []string:
+		msg.userProperties[key] = append(existing, value)
+	}
+}
+
+// properties returns the MQTT 5 properties of a message as event fields.
+func (msg *message) properties() common.MapStr {
+	properties := make(common.MapStr)
+	if msg.contentType != "" {
+		properties["content_type"] = msg.contentType
+	}
+	if msg.responseTopic != "" {
+		properties["response_topic"] = msg.responseTopic
+	}
+	if len(msg.correlationData) > 0 {
+		properties["correlation_data"] = string(msg.correlationData)
+	}
+	if msg.messageExpiry != nil {
+		properties["message_expiry"] = *msg.messageExpiry
+	}
+	if msg.payloadFormat != nil {
+		if *msg.payloadFormat == 1 {
+			properties["payload_format"] = "utf8"
+		} else {
+			properties["payload_format"] = "bytes"
+		}
+	}
+	if len(msg.userProperties) > 0 {
+		properties["user"] = msg.userProperties
+	}
+	return properties
+}
+
+// v3Connection is the connection of the MQTT 3.1.1 client.
+type v3Connection struct {
+	client MQTT.Client
+}
+
+func (c *v3Connection) publish(topic string, qos byte, retain bool, payload []byte) {
+	c.client.Publish(topic, qos, retain, payload)
+}
+
+func (c *v3Connection) publishWait(topic string, qos byte, retain bool, payload []byte, timeout time.Duration) error {
+	token := c.client.Publish(topic, qos, retain, payload)
+	if !token.WaitTimeout(timeout) {
+		return fmt.Errorf("timeout after %v", timeout)
+	}
+	return token.Error()
+}
+
+func (c *v3Connection) disconnect() {
+	c.client.Disconnect(250)
+}
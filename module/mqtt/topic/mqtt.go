@@ -1,9 +1,19 @@
 package topic
 
 import (
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"strings"
+	"sync/atomic"
+	"time"
+
 	"github.com/elastic/beats/v7/libbeat/common/cfgwarn"
-	_ "github.com/elastic/beats/v7/libbeat/logp"
+	"github.com/elastic/beats/v7/libbeat/logp"
 	"github.com/elastic/beats/v7/metricbeat/mb"
+	"github.com/elastic/machinebeat/helper/ssl"
+
+	MQTT "github.com/eclipse/paho.mqtt.golang"
 )
 
 // init registers the MetricSet with the central registry as soon as the program
@@ -20,39 +30,137 @@ func init() {
 // interface methods except for Fetch.
 type MetricSet struct {
 	mb.BaseMetricSet
-	BrokerURL       string   `config:"host"`
-	BrokerUsername  string   `config:"user"`
-	BrokerPassword  string   `config:"password"`
-	TopicsSubscribe []string `config:"topics"`
-	QoS             int      `config:"QoS"`
-	DecodePaylod    bool     `config:"decode_payload"`
-	SSL             bool     `config:"ssl"`
-	CA              string   `config:"CA"`
-	ClientCert      string   `config:"clientCert"`
-	ClientKey       string   `config:"clientKey"`
-	ClientID        string   `config:"clientID"`
-	LegacyFields    bool     `config:"legacyFields"`
-	ECSFields       bool     `config:"ECSFields"`
+	BrokerURL        string               `config:"host"`
+	BrokerUsername   string               `config:"user"`
+	BrokerPassword   string               `config:"password"`
+	TopicsSubscribe  []Subscription       `config:"topics"`
+	QoS              int                  `config:"QoS"`
+	DecodePaylod     bool                 `config:"decode_payload"`
+	DecodeTarget     string               `config:"decode_target"`
+	DecodeFlatten    bool                 `config:"decode_flatten"`
+	TimestampPath    string               `config:"timestamp_path"`
+	TimestampFormat  string               `config:"timestamp_format"`
+	Sparkplug        SparkplugConfig      `config:"sparkplug"`
+	SSL              ssl.Config           `config:"ssl"`
+	Websocket        WebsocketConfig      `config:"websocket"`
+	ProxyURL         string               `config:"proxy_url"`
+	CA               string               `config:"CA"`
+	ClientCert       string               `config:"clientCert"`
+	ClientKey        string               `config:"clientKey"`
+	ClientID         string               `config:"clientID"`
+	LegacyFields     bool                 `config:"legacyFields"`
+	ECSFields        bool                 `config:"ECSFields"`
+	BufferSize       int                  `config:"buffer_size"`
+	BufferOverflow   string               `config:"buffer_overflow"`
+	CleanSession     bool                 `config:"clean_session"`
+	SessionStore     string               `config:"session_store"`
+	SessionExpiry    time.Duration        `config:"session_expiry"`
+	ProtocolVersion  string               `config:"protocol_version"`
+	ShareGroup       string               `config:"share_group"`
+	BirthMessage     *StatusMessage       `config:"birth_message"`
+	WillMessage      *StatusMessage       `config:"will_message"`
+	ShutdownMessage  *StatusMessage       `config:"shutdown_message"`
+	RetainedMessages string               `config:"retained_messages"`
+	Deduplication    DeduplicationConfig  `config:"deduplication"`
+	EmbeddedBroker   EmbeddedBrokerConfig `config:"embedded_broker"`
+
+	conn      connection
+	client    MQTT.Client
+	connected bool
+	events    chan mb.Event
+	dropped   *atomic.Uint64
+	sparkplug *sparkplugDecoder
+	dedup     *deduplicator
 }
 
 var (
 	DefaultConfig = MetricSet{
 		BrokerURL:       "localhost",
-		ClientID:        "Machinebeat",
 		BrokerUsername:  "",
 		BrokerPassword:  "",
-		TopicsSubscribe: []string{"#"},
+		TopicsSubscribe: []Subscription{{Topic: "#"}},
 		DecodePaylod:    true,
-		QoS:             0,
-		SSL:             false,
-		CA:              "",
-		ClientCert:      "",
-		ClientKey:       "",
-		LegacyFields:    false,
-		ECSFields:       true,
+		DecodeTarget:    "payload",
+		Sparkplug: SparkplugConfig{
+			Enabled:         true,
+			Rebirth:         true,
+			RebirthInterval: 30 * time.Second,
+		},
+		QoS:              0,
+		CA:               "",
+		ClientCert:       "",
+		ClientKey:        "",
+		LegacyFields:     false,
+		ECSFields:        true,
+		BufferSize:       500,
+		BufferOverflow:   "block",
+		CleanSession:     true,
+		SessionExpiry:    24 * time.Hour,
+		ProtocolVersion:  protocolV311,
+		RetainedMessages: retainedMark,
+		Deduplication: DeduplicationConfig{
+			Enabled:    false,
+			Window:     time.Minute,
+			MaxEntries: 100000,
+		},
 	}
 )
 
+// Validate checks the configuration. It is called by the config unpacker.
+func (m *MetricSet) Validate() error {
+	if m.BufferSize <= 0 {
+		return fmt.Errorf("buffer_size must be larger than 0")
+	}
+	switch m.BufferOverflow {
+	case overflowBlock, overflowDropNewest, overflowDropOldest:
+	default:
+		return fmt.Errorf("unknown buffer_overflow %q, use %v, %v or %v", m.BufferOverflow, overflowBlock, overflowDropNewest, overflowDropOldest)
+	}
+	if m.ProtocolVersion != protocolV311 && m.ProtocolVersion != protocolV5 {
+		return fmt.Errorf("unknown protocol_version %q, use %v or %v", m.ProtocolVersion, protocolV311, protocolV5)
+	}
+	switch m.RetainedMessages {
+	case retainedPublish, retainedMark, retainedIgnore:
+	default:
+		return fmt.Errorf("unknown retained_messages %q, use %v, %v or %v", m.RetainedMessages, retainedPublish, retainedMark, retainedIgnore)
+	}
+	if m.Deduplication.Enabled && (m.Deduplication.Window <= 0 || m.Deduplication.MaxEntries <= 0) {
+		return fmt.Errorf("deduplication.window and deduplication.max_entries must be larger than 0")
+	}
+	if strings.Contains(m.ShareGroup, "/") || strings.ContainsAny(m.ShareGroup, "+#") {
+		return fmt.Errorf("share_group must not contain /, + or #")
+	}
+	if !m.CleanSession && m.ClientID == "" {
+		return fmt.Errorf("a persistent session (clean_session: false) requires a clientID")
+	}
+	if _, err := parseBrokerURL(m.BrokerURL); err != nil {
+		return err
+	}
+	if m.ProxyURL != "" {
+		if _, err := parseProxyURL(m.ProxyURL); err != nil {
+			return err
+		}
+	}
+	if err := m.EmbeddedBroker.validate(); err != nil {
+		return err
+	}
+	m.SSL.MergeLegacy(m.CA, m.ClientCert, m.ClientKey)
+	if err := m.SSL.Load(); err != nil {
+		return err
+	}
+	return nil
+}
+
+// defaultClientID returns a client ID with a random suffix, so that module
+// blocks on the same broker don't take over each other's session.
+func defaultClientID() string {
+	suffix := make([]byte, 4)
+	if _, err := rand.Read(suffix); err != nil {
+		return "Machinebeat"
+	}
+	return "Machinebeat-" + hex.EncodeToString(suffix)
+}
+
 // New creates a new instance of the MetricSet. New is responsible for unpacking
 // any MetricSet specific configuration options if there are any.
 func New(base mb.BaseMetricSet) (mb.MetricSet, error) {
@@ -62,25 +170,50 @@ func New(base mb.BaseMetricSet) (mb.MetricSet, error) {
 	if err := base.Module().UnpackConfig(&config); err != nil {
 		return nil, err
 	}
+	if config.ClientID == "" {
+		config.ClientID = defaultClientID()
+	}
 
 	metricset := &MetricSet{
-		BaseMetricSet:   base,
-		BrokerURL:       config.BrokerURL,
-		BrokerUsername:  config.BrokerUsername,
-		BrokerPassword:  config.BrokerPassword,
-		TopicsSubscribe: config.TopicsSubscribe,
-		DecodePaylod:    config.DecodePaylod,
-		QoS:             config.QoS,
-		SSL:             config.SSL,
-		CA:              config.CA,
-		ClientCert:      config.ClientCert,
-		ClientKey:       config.ClientKey,
-		ClientID:        config.ClientID,
-		LegacyFields:    config.LegacyFields,
-		ECSFields:       config.ECSFields,
-	}
-
-	setupMqttClient(metricset)
+		BaseMetricSet:    base,
+		BrokerURL:        config.BrokerURL,
+		BrokerUsername:   config.BrokerUsername,
+		BrokerPassword:   config.BrokerPassword,
+		TopicsSubscribe:  config.TopicsSubscribe,
+		DecodePaylod:     config.DecodePaylod,
+		DecodeTarget:     config.DecodeTarget,
+		DecodeFlatten:    config.DecodeFlatten,
+		TimestampPath:    config.TimestampPath,
+		TimestampFormat:  config.TimestampFormat,
+		Sparkplug:        config.Sparkplug,
+		QoS:              config.QoS,
+		SSL:              config.SSL,
+		Websocket:        config.Websocket,
+		ProxyURL:         config.ProxyURL,
+		CA:               config.CA,
+		ClientCert:       config.ClientCert,
+		ClientKey:        config.ClientKey,
+		ClientID:         config.ClientID,
+		LegacyFields:     config.LegacyFields,
+		ECSFields:        config.ECSFields,
+		BufferSize:       config.BufferSize,
+		BufferOverflow:   config.BufferOverflow,
+		CleanSession:     config.CleanSession,
+		SessionStore:     config.SessionStore,
+		SessionExpiry:    config.SessionExpiry,
+		ProtocolVersion:  config.ProtocolVersion,
+		ShareGroup:       config.ShareGroup,
+		BirthMessage:     config.BirthMessage,
+		WillMessage:      config.WillMessage,
+		ShutdownMessage:  config.ShutdownMessage,
+		RetainedMessages: config.RetainedMessages,
+		Deduplication:    config.Deduplication,
+		EmbeddedBroker:   config.EmbeddedBroker,
+	}
+
+	if err := metricset.setupMqttClient(); err != nil {
+		return nil, err
+	}
 
 	return metricset, nil
 }
@@ -91,20 +224,40 @@ func New(base mb.BaseMetricSet) (mb.MetricSet, error) {
 func (m *MetricSet) Fetch(report mb.ReporterV2) error {
 	// we are working in a subscriber mode
 	// we send the collected data after the configured timeframe
+	if dropped := m.dropped.Swap(0); dropped > 0 {
+		logp.Warn("[MQTT] Event buffer of %v events was full, %v messages were dropped", m.BufferSize, dropped)
+	}
 	for {
 		select {
-		case event := <-events:
+		case event := <-m.events:
 			if m.LegacyFields {
 				event.ModuleFields["broker"] = m.BrokerURL
 			}
 			if m.ECSFields {
 				event.RootFields.Put("event.provider", "mqtt")
-				event.RootFields.Put("event.url", m.BrokerURL)
+				if !m.EmbeddedBroker.Enabled {
+					event.RootFields.Put("event.url", m.BrokerURL)
+				}
 			}
 			report.Event(event)
 		default:
 			return nil
 		}
 	}
+}
+
+// Close publishes the shutdown message and disconnects the MQTT client of the
+// MetricSet. The broker doesn't publish the will after a disconnect.
+func (m *MetricSet) Close() error {
+	if m.conn == nil {
+		return nil
+	}
+	if s := m.ShutdownMessage; s != nil {
+		payload := m.statusPayload(s, "shutdown", statusOffline)
+		if err := m.conn.publishWait(s.Topic, byte(s.QoS), s.Retain, payload, 5*time.Second); err != nil {
+			logp.Warn("[MQTT] Failed to publish shutdown message to %v: %v", s.Topic, err)
+		}
+	}
+	m.conn.disconnect()
 	return nil
 }
@@ -0,0 +1,250 @@
+package topic
+
+import (
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/elastic/beats/v7/libbeat/common"
+	"github.com/elastic/beats/v7/libbeat/logp"
+	"github.com/elastic/beats/v7/metricbeat/mb"
+)
+
+// sparkplugNamespace is the first topic level of all Sparkplug B messages.
+const sparkplugNamespace = "spBv1.0"
+
+// SparkplugConfig holds the settings of the Sparkplug B decoder.
+type SparkplugConfig struct {
+	Enabled         bool          `config:"enabled"`
+	Rebirth         bool          `config:"rebirth"`
+	RebirthInterval time.Duration `config:"rebirth_interval"`
+}
+
+// sparkplugTopic holds the levels of a Sparkplug B topic:
+// spBv1.0/group_id/message_type/edge_node_id[/device_id]
+type sparkplugTopic struct {
+	group       string
+	messageType string
+	edgeNode    string
+	device      string
+}
+
+func parseSparkplugTopic(topic string) (*sparkplugTopic, bool) {
+	levels := strings.Split(topic, "/")
+	if len(levels) < 4 || len(levels) > 5 || levels[0] != sparkplugNamespace {
+		return nil, false
+	}
+	t := &sparkplugTopic{group: levels[1], messageType: levels[2], edgeNode: levels[3]}
+	if len(levels) == 5 {
+		t.device = levels[4]
+	}
+	return t, true
+}
+
+// edgeNode is the session state of a Sparkplug B edge node. The aliases and
+// data types are learned from the birth certificates of the node and its devices.
+type edgeNode struct {
+	online      bool
+	bdSeq       uint64
+	seq         uint64
+	aliases     map[uint64]string
+	datatypes   map[string]uint32
+	lastRebirth time.Time
+}
+
+// sparkplugDecoder tracks the sessions of all edge nodes and turns their
+// messages into one event per metric.
+type sparkplugDecoder struct {
+	config SparkplugConfig
+	mutex  sync.Mutex
+	nodes  map[string]*edgeNode
+}
+
+func newSparkplugDecoder(config SparkplugConfig) *sparkplugDecoder {
+	return &sparkplugDecoder{
+		config: config,
+		nodes:  make(map[string]*edgeNode),
+	}
+}
+
+// decode decodes a Sparkplug B message. Messages that can't be decoded
+// result in a single tagged event with the raw payload.
+func (d *sparkplugDecoder) decode(conn connection, topic *sparkplugTopic, msg *message) []mb.Event {
+	payload, err := decodeSparkplugPayload(msg.payload)
+	if err != nil {
+		event := d.newEvent(topic, msg.topic, nil)
+		addDecodeFailure(&event, fmt.Errorf("invalid Sparkplug B payload: %v", err))
+		return []mb.Event{event}
+	}
+
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+
+	nodeKey := topic.group + "/" + topic.edgeNode
+	node, found := d.nodes[nodeKey]
+	if !found {
+		node = &edgeNode{}
+		d.nodes[nodeKey] = node
+	}
+
+	switch topic.messageType {
+	case "NBIRTH":
+		node.online = true
+		node.bdSeq, _ = bdSeqOf(payload)
+		node.seq = payload.seq
+		node.aliases = make(map[uint64]string)
+		node.datatypes = make(map[string]uint32)
+		d.learn(node, topic.device, payload)
+	case "NDEATH":
+		// An old NDEATH of a previous session must not end the current one
+		if bdSeq, ok := bdSeqOf(payload); !ok || bdSeq == node.bdSeq {
+			node.online = false
+		}
+		event := d.newEvent(topic, msg.topic, payload)
+		event.RootFields.Put("sparkplug.online", false)
+		return []mb.Event{event}
+	case "DBIRTH", "NDATA", "DDATA", "DDEATH":
+		if !node.online {
+			d.rebirth(conn, topic, node, "no NBIRTH received")
+		} else if payload.hasSeq && payload.seq != (node.seq+1)%256 {
+			d.rebirth(conn, topic, node, fmt.Sprintf("expected seq %v, got %v", (node.seq+1)%256, payload.seq))
+		}
+		node.seq = payload.seq
+		if topic.messageType == "DBIRTH" {
+			d.learn(node, topic.device, payload)
+		}
+		for _, metric := range payload.metrics {
+			if _, known := node.aliases[metric.alias]; metric.name == "" && metric.hasAlias && !known {
+				d.rebirth(conn, topic, node, fmt.Sprintf("unknown alias %v", metric.alias))
+				break
+			}
+		}
+		if topic.messageType == "DDEATH" {
+			event := d.newEvent(topic, msg.topic, payload)
+			event.RootFields.Put("sparkplug.online", false)
+			return []mb.Event{event}
+		}
+	}
+
+	return d.metricEvents(node, topic, msg.topic, payload)
+}
+
+// learn remembers the aliases and data types of the metrics of a birth certificate.
+func (d *sparkplugDecoder) learn(node *edgeNode, device string, payload *spPayload) {
+	if node.aliases == nil {
+		node.aliases = make(map[uint64]string)
+		node.datatypes = make(map[string]uint32)
+	}
+	for _, metric := range payload.metrics {
+		if metric.name == "" {
+			continue
+		}
+		if metric.hasAlias {
+			node.aliases[metric.alias] = metric.name
+		}
+		node.datatypes[device+"/"+metric.name] = metric.datatype
+	}
+}
+
+// rebirth asks an edge node to publish its birth certificates again. Requests
+// are sent at most once per rebirth_interval and edge node.
+func (d *sparkplugDecoder) rebirth(conn connection, topic *sparkplugTopic, node *edgeNode, reason string) {
+	logp.Debug("Sparkplug", "Edge node %v/%v needs a rebirth: %v", topic.group, topic.edgeNode, reason)
+	if !d.config.Rebirth || conn == nil || time.Since(node.lastRebirth) < d.config.RebirthInterval {
+		return
+	}
+	node.lastRebirth = time.Now()
+
+	cmdTopic := strings.Join([]string{sparkplugNamespace, topic.group, "NCMD", topic.edgeNode}, "/")
+	logp.Info("[Sparkplug] Request rebirth of edge node %v/%v", topic.group, topic.edgeNode)
+	conn.publish(cmdTopic, 0, false, encodeRebirth(time.Now()))
+}
+
+// metricEvents creates an event for every metric of a payload.
+func (d *sparkplugDecoder) metricEvents(node *edgeNode, topic *sparkplugTopic, mqttTopic string, payload *spPayload) []mb.Event {
+	var events []mb.Event
+	for _, metric := range payload.metrics {
+		event := d.newEvent(topic, mqttTopic, payload)
+		root := event.RootFields
+
+		name := metric.name
+		if name == "" && metric.hasAlias {
+			name = node.aliases[metric.alias]
+			if name == "" {
+				name = aliasName(metric.alias)
+				addDecodeFailure(&event, fmt.Errorf("unknown alias %v", metric.alias))
+			}
+		}
+		datatype := metric.datatype
+		if datatype == 0 && node.datatypes != nil {
+			datatype = node.datatypes[topic.device+"/"+name]
+		}
+
+		root.Put("sensor.name", name)
+		if metric.hasAlias {
+			root.Put("sensor.id", metric.alias)
+		}
+		timestamp := metric.timestamp
+		if timestamp == 0 {
+			timestamp = payload.timestamp
+		}
+		if timestamp != 0 {
+			root.Put("value.source_timestamp", time.UnixMilli(int64(timestamp)).UTC())
+		}
+		if metric.historical {
+			root.Put("sparkplug.metric.historical", true)
+		}
+		if metric.transient {
+			root.Put("sparkplug.metric.transient", true)
+		}
+		if len(metric.properties) > 0 {
+			root.Put("sparkplug.metric.properties", metric.properties)
+		}
+
+		if metric.isNull || metric.value == nil {
+			root.Put("value.null", true)
+		} else if datatype == 0 && metric.value.num != spBytesValue {
+			addDecodeFailure(&event, fmt.Errorf("metric %v: unknown data type", name))
+		} else {
+			value, typeName, err := metricValue(datatype, metric.value)
+			if err != nil {
+				addDecodeFailure(&event, fmt.Errorf("metric %v: %v", name, err))
+			} else {
+				root.Put("value.datatype", typeName)
+				root.Put("value.value_"+typeName, value)
+			}
+		}
+		events = append(events, event)
+	}
+	return events
+}
+
+func (d *sparkplugDecoder) newEvent(topic *sparkplugTopic, mqttTopic string, payload *spPayload) mb.Event {
+	root := common.MapStr{
+		"event": common.MapStr{
+			"creation": time.Now(),
+			"dataset":  mqttTopic,
+		},
+		"sparkplug": common.MapStr{
+			"group_id":     topic.group,
+			"edge_node_id": topic.edgeNode,
+			"message_type": topic.messageType,
+		},
+	}
+	if topic.device != "" {
+		root.Put("sparkplug.device_id", topic.device)
+	}
+	if payload != nil && payload.hasSeq {
+		root.Put("sparkplug.seq", payload.seq)
+	}
+	if payload != nil && (topic.messageType == "NBIRTH" || topic.messageType == "NDEATH") {
+		if bdSeq, ok := bdSeqOf(payload); ok {
+			root.Put("sparkplug.bd_seq", bdSeq)
+		}
+	}
+	return mb.Event{
+		RootFields:   root,
+		ModuleFields: make(common.MapStr),
+	}
+}
@@ -0,0 +1,678 @@
+package topic
+
+import (
+	"encoding/binary"
+	"fmt"
+	"math"
+	"strconv"
+	"time"
+
+	"github.com/elastic/beats/v7/libbeat/common"
+
+	"google.golang.org/protobuf/encoding/protowire"
+)
+
+// Sparkplug B data types as defined in sparkplug_b.proto
+const (
+	spInt8            = 1
+	spInt16           = 2
+	spInt32           = 3
+	spInt64           = 4
+	spUInt8           = 5
+	spUInt16          = 6
+	spUInt32          = 7
+	spUInt64          = 8
+	spFloat           = 9
+	spDouble          = 10
+	spBoolean         = 11
+	spString          = 12
+	spDateTime        = 13
+	spText            = 14
+	spUUID            = 15
+	spDataSet         = 16
+	spBytes           = 17
+	spFile            = 18
+	spTemplate        = 19
+	spPropertySet     = 20
+	spPropertySetList = 21
+	spInt8Array       = 22
+	spInt16Array      = 23
+	spInt32Array      = 24
+	spInt64Array      = 25
+	spUInt8Array      = 26
+	spUInt16Array     = 27
+	spUInt32Array     = 28
+	spUInt64Array     = 29
+	spFloatArray      = 30
+	spDoubleArray     = 31
+	spBooleanArray    = 32
+	spStringArray     = 33
+	spDateTimeArray   = 34
+)
+
+// Field numbers of the metric values that are no scalars. The data type of a
+// metric is optional for bytes_value.
+const (
+	spBytesValue    protowire.Number = 16
+	spDataSetValue  protowire.Number = 17
+	spTemplateValue protowire.Number = 18
+)
+
+// spPayload is a decoded Sparkplug B payload.
+type spPayload struct {
+	timestamp uint64
+	metrics   []*spMetric
+	seq       uint64
+	hasSeq    bool
+}
+
+// spMetric is a decoded metric. The value is kept as raw protobuf field until
+// the data type of the metric is known, which may require the birth certificate.
+type spMetric struct {
+	name       string
+	alias      uint64
+	hasAlias   bool
+	timestamp  uint64
+	datatype   uint32
+	historical bool
+	transient  bool
+	isNull     bool
+	properties common.MapStr
+	value      *spField
+}
+
+// spField is a single field of a protobuf message.
+type spField struct {
+	num    protowire.Number
+	typ    protowire.Type
+	varint uint64
+	fixed  uint64
+	bytes  []byte
+}
+
+// spFields splits a protobuf message into its fields.
+func spFields(b []byte) ([]spField, error) {
+	var fields []spField
+	for len(b) > 0 {
+		num, typ, n := protowire.ConsumeTag(b)
+		if n < 0 {
+			return nil, protowire.ParseError(n)
+		}
+		b = b[n:]
+
+		field := spField{num: num, typ: typ}
+		switch typ {
+		case protowire.VarintType:
+			field.varint, n = protowire.ConsumeVarint(b)
+		case protowire.Fixed32Type:
+			var v uint32
+			v, n = protowire.ConsumeFixed32(b)
+			field.fixed = uint64(v)
+		case protowire.Fixed64Type:
+			field.fixed, n = protowire.ConsumeFixed64(b)
+		case protowire.BytesType:
+			field.bytes, n = protowire.ConsumeBytes(b)
+		default:
+			n = protowire.ConsumeFieldValue(num, typ, b)
+		}
+		if n < 0 {
+			return nil, protowire.ParseError(n)
+		}
+		b = b[n:]
+		fields = append(fields, field)
+	}
+	return fields, nil
+}
+
+// decodeSparkplugPayload decodes the protobuf encoded payload of a Sparkplug B message.
+func decodeSparkplugPayload(b []byte) (*spPayload, error) {
+	fields, err := spFields(b)
+	if err != nil {
+		return nil, err
+	}
+
+	payload := &spPayload{}
+	for _, field := range fields {
+		switch field.num {
+		case 1:
+			payload.timestamp = field.varint
+		case 2:
+			metric, err := decodeSparkplugMetric(field.bytes)
+			if err != nil {
+				return nil, fmt.Errorf("invalid metric: %v", err)
+			}
+			payload.metrics = append(payload.metrics, metric)
+		case 3:
+			payload.seq = field.varint
+			payload.hasSeq = true
+		}
+	}
+	return payload, nil
+}
+
+func decodeSparkplugMetric(b []byte) (*spMetric, error) {
+	fields, err := spFields(b)
+	if err != nil {
+		return nil, err
+	}
+
+	metric := &spMetric{}
+	for i := range fields {
+		field := &fields[i]
+		switch field.num {
+		case 1:
+			metric.name = string(field.bytes)
+		case 2:
+			metric.alias = field.varint
+			metric.hasAlias = true
+		case 3:
+			metric.timestamp = field.varint
+		case 4:
+			metric.datatype = uint32(field.varint)
+		case 5:
+			metric.historical = field.varint != 0
+		case 6:
+			metric.transient = field.varint != 0
+		case 7:
+			metric.isNull = field.varint != 0
+		case 9:
+			properties, err := decodePropertySet(field.bytes)
+			if err != nil {
+				return nil, fmt.Errorf("invalid properties: %v", err)
+			}
+			metric.properties = properties
+		case 10, 11, 12, 13, 14, 15, 16, 17, 18:
+			metric.value = field
+		}
+	}
+	return metric, nil
+}
+
+// scalarValue returns the value of a oneof field that uses the common order
+// of Sparkplug B value fields, starting at the field number first:
+// int_value, long_value, float_value, double_value, boolean_value, string_value
+func scalarValue(field *spField, first protowire.Number) (interface{}, bool) {
+	switch field.num - first {
+	case 0:
+		return uint32(field.varint), true
+	case 1:
+		return field.varint, true
+	case 2:
+		return math.Float32frombits(uint32(field.fixed)), true
+	case 3:
+		return math.Float64frombits(field.fixed), true
+	case 4:
+		return field.varint != 0, true
+	case 5:
+		return string(field.bytes), true
+	}
+	return nil, false
+}
+
+// typedValue converts a scalar value into the Go type of the Sparkplug B data
+// type and returns it with the data type name used for value.value_<type>.
+func typedValue(datatype uint32, raw interface{}) (interface{}, string, error) {
+	var u uint64
+	integer := true
+	switch v := raw.(type) {
+	case uint32:
+		u = uint64(v)
+	case uint64:
+		u = v
+	default:
+		integer = false
+	}
+
+	switch datatype {
+	case spInt8, spInt16, spInt32, spInt64, spUInt8, spUInt16, spUInt32, spUInt64, spDateTime:
+		if integer {
+			return integerValue(datatype, u)
+		}
+	case spFloat:
+		if f, ok := raw.(float32); ok {
+			return f, "float32", nil
+		}
+	case spDouble:
+		if f, ok := raw.(float64); ok {
+			return f, "float64", nil
+		}
+	case spBoolean:
+		if b, ok := raw.(bool); ok {
+			return b, "bool", nil
+		}
+	case spString, spText, spUUID:
+		if s, ok := raw.(string); ok {
+			return s, "string", nil
+		}
+	default:
+		return nil, "", fmt.Errorf("unsupported data type %v", datatype)
+	}
+	return nil, "", fmt.Errorf("value %v doesn't match data type %v", raw, datatype)
+}
+
+// integerValue converts the int_value or long_value of a metric into the Go
+// type of its integer data type.
+func integerValue(datatype uint32, u uint64) (interface{}, string, error) {
+	switch datatype {
+	case spInt8:
+		return int8(u), "int8", nil
+	case spInt16:
+		return int16(u), "int16", nil
+	case spInt32:
+		return int32(u), "int32", nil
+	case spInt64:
+		return int64(u), "int64", nil
+	case spUInt8:
+		return uint8(u), "byte", nil
+	case spUInt16:
+		return uint16(u), "uint16", nil
+	case spUInt32:
+		return uint32(u), "uint32", nil
+	case spUInt64:
+		return u, "uint64", nil
+	}
+	return time.UnixMilli(int64(u)).UTC(), "time.Time", nil
+}
+
+// metricValue decodes the value of a metric with the given data type.
+func metricValue(datatype uint32, field *spField) (interface{}, string, error) {
+	switch field.num {
+	case spBytesValue:
+		return arrayValue(datatype, field.bytes)
+	case spDataSetValue:
+		value, err := decodeDataSet(field.bytes)
+		return value, "dataset", err
+	case spTemplateValue:
+		value, err := decodeTemplate(field.bytes)
+		return value, "template", err
+	}
+	raw, ok := scalarValue(field, 10)
+	if !ok {
+		return nil, "", fmt.Errorf("unsupported value field %v", field.num)
+	}
+	return typedValue(datatype, raw)
+}
+
+// arrayValue decodes bytes and the little endian encoded arrays of Sparkplug B 3.0.
+func arrayValue(datatype uint32, b []byte) (interface{}, string, error) {
+	size := map[uint32]int{
+		spInt8Array: 1, spUInt8Array: 1,
+		spInt16Array: 2, spUInt16Array: 2,
+		spInt32Array: 4, spUInt32Array: 4, spFloatArray: 4,
+		spInt64Array: 8, spUInt64Array: 8, spDoubleArray: 8, spDateTimeArray: 8,
+	}[datatype]
+	if size > 0 && len(b)%size != 0 {
+		return nil, "", fmt.Errorf("array of data type %v has invalid length %v", datatype, len(b))
+	}
+
+	switch datatype {
+	case spBytes, spFile, 0:
+		return b, "bytes", nil
+	case spInt8Array:
+		values := make([]int8, len(b))
+		for i := range b {
+			values[i] = int8(b[i])
+		}
+		return values, "int8", nil
+	case spUInt8Array:
+		return b, "byte", nil
+	case spInt16Array:
+		values := make([]int16, len(b)/2)
+		for i := range values {
+			values[i] = int16(binary.LittleEndian.Uint16(b[i*2:]))
+		}
+		return values, "int16", nil
+	case spUInt16Array:
+		values := make([]uint16, len(b)/2)
+		for i := range values {
+			values[i] = binary.LittleEndian.Uint16(b[i*2:])
+		}
+		return values, "uint16", nil
+	case spInt32Array:
+		values := make([]int32, len(b)/4)
+		for i := range values {
+			values[i] = int32(binary.LittleEndian.Uint32(b[i*4:]))
+		}
+		return values, "int32", nil
+	case spUInt32Array:
+		values := make([]uint32, len(b)/4)
+		for i := range values {
+			values[i] = binary.LittleEndian.Uint32(b[i*4:])
+		}
+		return values, "uint32", nil
+	case spFloatArray:
+		values := make([]float32, len(b)/4)
+		for i := range values {
+			values[i] = math.Float32frombits(binary.LittleEndian.Uint32(b[i*4:]))
+		}
+		return values, "float32", nil
+	case spInt64Array:
+		values := make([]int64, len(b)/8)
+		for i := range values {
+			values[i] = int64(binary.LittleEndian.Uint64(b[i*8:]))
+		}
+		return values, "int64", nil
+	case spUInt64Array:
+		values := make([]uint64, len(b)/8)
+		for i := range values {
+			values[i] = binary.LittleEndian.Uint64(b[i*8:])
+		}
+		return values, "uint64", nil
+	case spDoubleArray:
+		values := make([]float64, len(b)/8)
+		for i := range values {
+			values[i] = math.Float64frombits(binary.LittleEndian.Uint64(b[i*8:]))
+		}
+		return values, "float64", nil
+	case spDateTimeArray:
+		values := make([]time.Time, len(b)/8)
+		for i := range values {
+			values[i] = time.UnixMilli(int64(binary.LittleEndian.Uint64(b[i*8:]))).UTC()
+		}
+		return values, "time.Time", nil
+	case spBooleanArray:
+		// 4 byte element count followed by the packed bits, most significant bit first
+		if len(b) < 4 {
+			return nil, "", fmt.Errorf("boolean array too short")
+		}
+		count := int(binary.LittleEndian.Uint32(b))
+		if count > (len(b)-4)*8 {
+			return nil, "", fmt.Errorf("boolean array has %v elements but only %v bytes", count, len(b)-4)
+		}
+		values := make([]bool, count)
+		for i := range values {
+			values[i] = b[4+i/8]&(0x80>>uint(i%8)) != 0
+		}
+		return values, "bool", nil
+	case spStringArray:
+		// null terminated strings
+		var values []string
+		start := 0
+		for i, c := range b {
+			if c == 0 {
+				values = append(values, string(b[start:i]))
+				start = i + 1
+			}
+		}
+		if start < len(b) {
+			values = append(values, string(b[start:]))
+		}
+		return values, "string", nil
+	}
+	return nil, "", fmt.Errorf("data type %v isn't encoded as bytes", datatype)
+}
+
+// decodeDataSet returns the columns, types and rows of a DataSet. Every row is
+// an object with the column names as keys.
+func decodeDataSet(b []byte) (common.MapStr, error) {
+	fields, err := spFields(b)
+	if err != nil {
+		return nil, err
+	}
+
+	var columns []string
+	var types []uint32
+	var rows [][]spField
+	for _, field := range fields {
+		switch field.num {
+		case 2:
+			columns = append(columns, string(field.bytes))
+		case 3:
+			if field.typ == protowire.BytesType {
+				// packed encoding
+				for packed := field.bytes; len(packed) > 0; {
+					v, n := protowire.ConsumeVarint(packed)
+					if n < 0 {
+						return nil, protowire.ParseError(n)
+					}
+					types = append(types, uint32(v))
+					packed = packed[n:]
+				}
+			} else {
+				types = append(types, uint32(field.varint))
+			}
+		case 4:
+			rowFields, err := spFields(field.bytes)
+			if err != nil {
+				return nil, err
+			}
+			var elements []spField
+			for _, element := range rowFields {
+				if element.num == 1 {
+					elements = append(elements, element)
+				}
+			}
+			rows = append(rows, elements)
+		}
+	}
+
+	rowValues := make([]common.MapStr, 0, len(rows))
+	for _, elements := range rows {
+		row := make(common.MapStr)
+		for i, element := range elements {
+			if i >= len(columns) || i >= len(types) {
+				break
+			}
+			valueFields, err := spFields(element.bytes)
+			if err != nil {
+				return nil, err
+			}
+			for j := range valueFields {
+				raw, ok := scalarValue(&valueFields[j], 1)
+				if !ok {
+					continue
+				}
+				value, _, err := typedValue(types[i], raw)
+				if err != nil {
+					return nil, fmt.Errorf("column %v: %v", columns[i], err)
+				}
+				row[columns[i]] = value
+			}
+		}
+		rowValues = append(rowValues, row)
+	}
+
+	return common.MapStr{
+		"columns": columns,
+		"rows":    rowValues,
+	}, nil
+}
+
+// decodeTemplate returns a Template with its parameters and member metrics as
+// objects with the names as keys.
+func decodeTemplate(b []byte) (common.MapStr, error) {
+	fields, err := spFields(b)
+	if err != nil {
+		return nil, err
+	}
+
+	template := make(common.MapStr)
+	metrics := make(common.MapStr)
+	parameters := make(common.MapStr)
+	for _, field := range fields {
+		switch field.num {
+		case 1:
+			template["version"] = string(field.bytes)
+		case 2:
+			metric, err := decodeSparkplugMetric(field.bytes)
+			if err != nil {
+				return nil, err
+			}
+			if metric.value == nil || metric.isNull {
+				metrics[metric.name] = nil
+				continue
+			}
+			value, _, err := metricValue(metric.datatype, metric.value)
+			if err != nil {
+				return nil, fmt.Errorf("template metric %v: %v", metric.name, err)
+			}
+			metrics[metric.name] = value
+		case 3:
+			name, value, err := decodeParameter(field.bytes)
+			if err != nil {
+				return nil, err
+			}
+			parameters[name] = value
+		case 4:
+			template["template_ref"] = string(field.bytes)
+		case 5:
+			template["is_definition"] = field.varint != 0
+		}
+	}
+	if len(metrics) > 0 {
+		template["metrics"] = metrics
+	}
+	if len(parameters) > 0 {
+		template["parameters"] = parameters
+	}
+	return template, nil
+}
+
+func decodeParameter(b []byte) (string, interface{}, error) {
+	fields, err := spFields(b)
+	if err != nil {
+		return "", nil, err
+	}
+
+	var name string
+	var datatype uint32
+	var raw interface{}
+	for i := range fields {
+		switch fields[i].num {
+		case 1:
+			name = string(fields[i].bytes)
+		case 2:
+			datatype = uint32(fields[i].varint)
+		default:
+			if v, ok := scalarValue(&fields[i], 3); ok {
+				raw = v
+			}
+		}
+	}
+	if raw == nil {
+		return name, nil, nil
+	}
+	value, _, err := typedValue(datatype, raw)
+	if err != nil {
+		return "", nil, fmt.Errorf("template parameter %v: %v", name, err)
+	}
+	return name, value, nil
+}
+
+func decodePropertySet(b []byte) (common.MapStr, error) {
+	fields, err := spFields(b)
+	if err != nil {
+		return nil, err
+	}
+
+	var keys []string
+	var values []interface{}
+	for _, field := range fields {
+		switch field.num {
+		case 1:
+			keys = append(keys, string(field.bytes))
+		case 2:
+			value, err := decodePropertyValue(field.bytes)
+			if err != nil {
+				return nil, err
+			}
+			values = append(values, value)
+		}
+	}
+
+	properties := make(common.MapStr)
+	for i, key := range keys {
+		if i < len(values) {
+			properties[key] = values[i]
+		}
+	}
+	return properties, nil
+}
+
+func decodePropertyValue(b []byte) (interface{}, error) {
+	fields, err := spFields(b)
+	if err != nil {
+		return nil, err
+	}
+
+	var datatype uint32
+	for i := range fields {
+		field := &fields[i]
+		switch field.num {
+		case 1:
+			datatype = uint32(field.varint)
+		case 2:
+			if field.varint != 0 {
+				return nil, nil
+			}
+		case 9:
+			return decodePropertySet(field.bytes)
+		case 10:
+			list, err := spFields(field.bytes)
+			if err != nil {
+				return nil, err
+			}
+			var sets []common.MapStr
+			for _, set := range list {
+				properties, err := decodePropertySet(set.bytes)
+				if err != nil {
+					return nil, err
+				}
+				sets = append(sets, properties)
+			}
+			return sets, nil
+		default:
+			if raw, ok := scalarValue(field, 3); ok {
+				value, _, err := typedValue(datatype, raw)
+				return value, err
+			}
+		}
+	}
+	return nil, nil
+}
+
+// encodeRebirth returns the payload of a NCMD message that asks an edge node
+// to publish its birth certificates again.
+func encodeRebirth(now time.Time) []byte {
+	timestamp := uint64(now.UnixMilli())
+
+	var metric []byte
+	metric = protowire.AppendTag(metric, 1, protowire.BytesType)
+	metric = protowire.AppendString(metric, "Node Control/Rebirth")
+	metric = protowire.AppendTag(metric, 3, protowire.VarintType)
+	metric = protowire.AppendVarint(metric, timestamp)
+	metric = protowire.AppendTag(metric, 4, protowire.VarintType)
+	metric = protowire.AppendVarint(metric, spBoolean)
+	metric = protowire.AppendTag(metric, 14, protowire.VarintType)
+	metric = protowire.AppendVarint(metric, 1)
+
+	var payload []byte
+	payload = protowire.AppendTag(payload, 1, protowire.VarintType)
+	payload = protowire.AppendVarint(payload, timestamp)
+	payload = protowire.AppendTag(payload, 2, protowire.BytesType)
+	payload = protowire.AppendBytes(payload, metric)
+	return payload
+}
+
+// bdSeqOf returns the bdSeq metric of a NBIRTH or NDEATH payload.
+func bdSeqOf(payload *spPayload) (uint64, bool) {
+	for _, metric := range payload.metrics {
+		if metric.name != "bdSeq" || metric.value == nil {
+			continue
+		}
+		if raw, ok := scalarValue(metric.value, 10); ok {
+			switch v := raw.(type) {
+			case uint32:
+				return uint64(v), true
+			case uint64:
+				return v, true
+			}
+		}
+	}
+	return 0, false
+}
+
+// aliasName is used for metrics whose alias isn't known from a birth certificate.
+func aliasName(alias uint64) string {
+	return "alias_" + strconv.FormatUint(alias, 10)
+}
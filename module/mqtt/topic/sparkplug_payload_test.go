@@ -0,0 +1,351 @@
+package topic
+
+import (
+	"io/ioutil"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/elastic/beats/v7/libbeat/common"
+	"github.com/elastic/beats/v7/metricbeat/mb"
+
+	"google.golang.org/protobuf/encoding/prototext"
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/types/dynamicpb"
+)
+
+// tahuPayload encodes a Sparkplug B payload in the protobuf text format with
+// the schema of Eclipse Tahu.
+func tahuPayload(t *testing.T, text string) []byte {
+	t.Helper()
+	descriptor, err := messageFromProtoFiles([]string{"sparkplug_b.proto"}, []string{"testdata"}, "org.eclipse.tahu.protobuf.Payload")
+	if err != nil {
+		t.Fatal(err)
+	}
+	message := dynamicpb.NewMessage(descriptor)
+	if err := prototext.Unmarshal([]byte(text), message); err != nil {
+		t.Fatal(err)
+	}
+	payload, err := proto.MarshalOptions{Deterministic: true}.Marshal(message)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return payload
+}
+
+func TestDecodeSparkplugPayload(t *testing.T) {
+	payload, err := decodeSparkplugPayload(tahuPayload(t, `
+		timestamp: 1681914102000
+		seq: 5
+		metrics {
+			name: "Temperature"
+			alias: 7
+			timestamp: 1681914101000
+			datatype: 10
+			is_historical: true
+			is_transient: true
+			properties {
+				keys: "engUnit"
+				keys: "quality"
+				keys: "limits"
+				values { type: 12 string_value: "degC" }
+				values { type: 3 int_value: 192 }
+				values { type: 20 propertyset_value { keys: "high" values { type: 10 double_value: 80 } } }
+			}
+			double_value: 21.5
+		}
+		metrics { alias: 8 datatype: 11 is_null: true }
+	`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if payload.timestamp != 1681914102000 || payload.seq != 5 || !payload.hasSeq {
+		t.Errorf("got timestamp %v, seq %v (%v), want 1681914102000, 5", payload.timestamp, payload.seq, payload.hasSeq)
+	}
+	if len(payload.metrics) != 2 {
+		t.Fatalf("got %v metrics, want 2", len(payload.metrics))
+	}
+
+	metric := payload.metrics[0]
+	if metric.name != "Temperature" || metric.alias != 7 || !metric.hasAlias || metric.timestamp != 1681914101000 {
+		t.Errorf("got name %q, alias %v (%v), timestamp %v", metric.name, metric.alias, metric.hasAlias, metric.timestamp)
+	}
+	if !metric.historical || !metric.transient || metric.isNull {
+		t.Errorf("got historical %v, transient %v, null %v", metric.historical, metric.transient, metric.isNull)
+	}
+	properties := common.MapStr{
+		"engUnit": "degC",
+		"quality": int32(192),
+		"limits":  common.MapStr{"high": float64(80)},
+	}
+	if !reflect.DeepEqual(metric.properties, properties) {
+		t.Errorf("got properties %v, want %v", metric.properties, properties)
+	}
+	if value, _, err := metricValue(metric.datatype, metric.value); err != nil || value != 21.5 {
+		t.Errorf("got value %v (%v), want 21.5", value, err)
+	}
+
+	if null := payload.metrics[1]; !null.isNull || null.name != "" || null.alias != 8 {
+		t.Errorf("got null %v, name %q, alias %v", null.isNull, null.name, null.alias)
+	}
+}
+
+func TestSparkplugMetricValues(t *testing.T) {
+	timestamp := time.Date(2023, 4, 19, 14, 21, 42, 0, time.UTC)
+	tests := []struct {
+		name     string
+		metric   string
+		value    interface{}
+		typeName string
+	}{
+		{"Int8", `datatype: 1 int_value: 4294967289`, int8(-7), "int8"},
+		{"Int16", `datatype: 2 int_value: 4294934528`, int16(-32768), "int16"},
+		{"Int32", `datatype: 3 int_value: 4294967295`, int32(-1), "int32"},
+		{"Int64", `datatype: 4 long_value: 18446744073709551615`, int64(-1), "int64"},
+		{"UInt8", `datatype: 5 int_value: 200`, uint8(200), "byte"},
+		{"UInt16", `datatype: 6 int_value: 65535`, uint16(65535), "uint16"},
+		{"UInt32", `datatype: 7 int_value: 4294967295`, uint32(4294967295), "uint32"},
+		{"UInt64", `datatype: 8 long_value: 18446744073709551615`, uint64(18446744073709551615), "uint64"},
+		{"Float", `datatype: 9 float_value: 1.5`, float32(1.5), "float32"},
+		{"Double", `datatype: 10 double_value: 21.3`, 21.3, "float64"},
+		{"Boolean", `datatype: 11 boolean_value: true`, true, "bool"},
+		{"String", `datatype: 12 string_value: "running"`, "running", "string"},
+		{"DateTime", `datatype: 13 long_value: 1681914102000`, timestamp, "time.Time"},
+		{"Text", `datatype: 14 string_value: "ok"`, "ok", "string"},
+		{"UUID", `datatype: 15 string_value: "72962b91-fa75-4ae6-8d28-b404dc7daf63"`, "72962b91-fa75-4ae6-8d28-b404dc7daf63", "string"},
+		{"Bytes", `datatype: 17 bytes_value: "\x01\x02"`, []byte{1, 2}, "bytes"},
+		{"Bytes without data type", `bytes_value: "\x01\x02"`, []byte{1, 2}, "bytes"},
+		{"Int8Array", `datatype: 22 bytes_value: "\xf9\x2a"`, []int8{-7, 42}, "int8"},
+		{"Int16Array", `datatype: 23 bytes_value: "\xf9\xff\x2a\x00"`, []int16{-7, 42}, "int16"},
+		{"Int32Array", `datatype: 24 bytes_value: "\xff\xff\xff\xff\x2a\x00\x00\x00"`, []int32{-1, 42}, "int32"},
+		{"Int64Array", `datatype: 25 bytes_value: "\xff\xff\xff\xff\xff\xff\xff\xff"`, []int64{-1}, "int64"},
+		{"UInt8Array", `datatype: 26 bytes_value: "\xc8\x2a"`, []byte{200, 42}, "byte"},
+		{"UInt16Array", `datatype: 27 bytes_value: "\xff\xff"`, []uint16{65535}, "uint16"},
+		{"UInt32Array", `datatype: 28 bytes_value: "\xff\xff\xff\xff"`, []uint32{4294967295}, "uint32"},
+		{"UInt64Array", `datatype: 29 bytes_value: "\x2a\x00\x00\x00\x00\x00\x00\x00"`, []uint64{42}, "uint64"},
+		{"FloatArray", `datatype: 30 bytes_value: "\x00\x00\xc0\x3f"`, []float32{1.5}, "float32"},
+		{"DoubleArray", `datatype: 31 bytes_value: "\x00\x00\x00\x00\x00\x80\x35\x40"`, []float64{21.5}, "float64"},
+		{"BooleanArray", `datatype: 32 bytes_value: "\x05\x00\x00\x00\xa8"`, []bool{true, false, true, false, true}, "bool"},
+		{"StringArray", `datatype: 33 bytes_value: "a\x00bc\x00"`, []string{"a", "bc"}, "string"},
+		{"StringArray without terminator", `datatype: 33 bytes_value: "a\x00bc"`, []string{"a", "bc"}, "string"},
+		{"DateTimeArray", `datatype: 34 bytes_value: "\xf0\x80\xe4\x99\x87\x01\x00\x00"`, []time.Time{timestamp}, "time.Time"},
+		{
+			"DataSet",
+			`datatype: 16 dataset_value {
+				num_of_columns: 3
+				columns: "name" columns: "speed" columns: "count"
+				types: 12 types: 10 types: 7
+				rows { elements { string_value: "press1" } elements { double_value: 1.5 } elements { int_value: 3 } }
+				rows { elements { string_value: "press2" } elements { double_value: 2.5 } elements { int_value: 4 } }
+			}`,
+			common.MapStr{
+				"columns": []string{"name", "speed", "count"},
+				"rows": []common.MapStr{
+					{"name": "press1", "speed": 1.5, "count": uint32(3)},
+					{"name": "press2", "speed": 2.5, "count": uint32(4)},
+				},
+			},
+			"dataset",
+		},
+		{
+			"Template",
+			`datatype: 19 template_value {
+				version: "1.0"
+				template_ref: "Motor"
+				metrics { name: "rpm" datatype: 3 int_value: 1500 }
+				metrics { name: "fault" datatype: 11 is_null: true }
+				parameters { name: "max_rpm" type: 10 double_value: 3000 }
+				parameters { name: "unit" type: 12 string_value: "rpm" }
+				parameters { name: "serial" type: 12 }
+			}`,
+			common.MapStr{
+				"version":      "1.0",
+				"template_ref": "Motor",
+				"metrics":      common.MapStr{"rpm": int32(1500), "fault": nil},
+				"parameters":   common.MapStr{"max_rpm": float64(3000), "unit": "rpm", "serial": nil},
+			},
+			"template",
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			payload, err := decodeSparkplugPayload(tahuPayload(t, "metrics { name: \"m\" "+test.metric+" }"))
+			if err != nil {
+				t.Fatal(err)
+			}
+			metric := payload.metrics[0]
+			value, typeName, err := metricValue(metric.datatype, metric.value)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if typeName != test.typeName {
+				t.Errorf("got type %v, want %v", typeName, test.typeName)
+			}
+			if !reflect.DeepEqual(value, test.value) {
+				t.Errorf("got %#v, want %#v", value, test.value)
+			}
+		})
+	}
+}
+
+func TestSparkplugMetricValueErrors(t *testing.T) {
+	tests := map[string]string{
+		"wrong value field":          `datatype: 9 int_value: 1`,
+		"unsupported data type":      `datatype: 99 int_value: 1`,
+		"array length":               `datatype: 23 bytes_value: "\x01\x02\x03"`,
+		"short boolean array":        `datatype: 32 bytes_value: "\x05\x00"`,
+		"boolean array count":        `datatype: 32 bytes_value: "\x09\x00\x00\x00\xff"`,
+		"scalar encoded as bytes":    `datatype: 10 bytes_value: "\x01"`,
+		"data set column type":       `datatype: 16 dataset_value { columns: "a" types: 9 rows { elements { string_value: "x" } } }`,
+		"template metric data type":  `datatype: 19 template_value { metrics { name: "a" datatype: 11 string_value: "x" } }`,
+		"template parameter type":    `datatype: 19 template_value { parameters { name: "a" type: 3 string_value: "x" } }`,
+		"template without data type": `datatype: 19 template_value { metrics { name: "a" int_value: 1 } }`,
+	}
+	for name, metricText := range tests {
+		payload, err := decodeSparkplugPayload(tahuPayload(t, "metrics { "+metricText+" }"))
+		if err != nil {
+			t.Errorf("%v: %v", name, err)
+			continue
+		}
+		metric := payload.metrics[0]
+		if value, _, err := metricValue(metric.datatype, metric.value); err == nil {
+			t.Errorf("%v: expected an error, got %#v", name, value)
+		}
+	}
+
+	for _, payload := range [][]byte{{0x12}, {0x12, 0x05, 0x0a}, {0x12, 0x02, 0x4a, 0x05}} {
+		if _, err := decodeSparkplugPayload(payload); err == nil {
+			t.Errorf("%x: expected an error for a truncated payload", payload)
+		}
+	}
+}
+
+// recordingConnection records the topics of the published messages.
+type recordingConnection struct {
+	topics []string
+}
+
+func (c *recordingConnection) publish(topic string, qos byte, retain bool, payload []byte) {
+	c.topics = append(c.topics, topic)
+}
+
+func (c *recordingConnection) publishWait(topic string, qos byte, retain bool, payload []byte, timeout time.Duration) error {
+	c.publish(topic, qos, retain, payload)
+	return nil
+}
+
+func (c *recordingConnection) disconnect() {}
+
+func TestSparkplugAliases(t *testing.T) {
+	conn := &recordingConnection{}
+	decoder := newSparkplugDecoder(SparkplugConfig{Enabled: true, Rebirth: true})
+	decode := func(topic string, text string) []mb.Event {
+		t.Helper()
+		sparkplugTopic, ok := parseSparkplugTopic(topic)
+		if !ok {
+			t.Fatalf("%v is no Sparkplug B topic", topic)
+		}
+		return decoder.decode(conn, sparkplugTopic, &message{topic: topic, payload: tahuPayload(t, text)})
+	}
+
+	decode("spBv1.0/plant/NBIRTH/edge1", `
+		timestamp: 1681914102000
+		seq: 0
+		metrics { name: "bdSeq" datatype: 8 long_value: 3 }
+		metrics { name: "Temperature" alias: 1 datatype: 10 double_value: 20 }
+	`)
+	decode("spBv1.0/plant/DBIRTH/edge1/press1", `
+		seq: 1
+		metrics { name: "Counter" alias: 2 datatype: 7 int_value: 0 }
+	`)
+
+	events := decode("spBv1.0/plant/DDATA/edge1/press1", `
+		seq: 2
+		metrics { alias: 2 int_value: 42 }
+	`)
+	if len(events) != 1 {
+		t.Fatalf("got %v events, want 1", len(events))
+	}
+	fields := events[0].RootFields
+	for key, want := range map[string]interface{}{
+		"sensor.name":            "Counter",
+		"sensor.id":              uint64(2),
+		"value.datatype":         "uint32",
+		"value.value_uint32":     uint32(42),
+		"sparkplug.device_id":    "press1",
+		"sparkplug.seq":          uint64(2),
+		"sparkplug.group_id":     "plant",
+		"sparkplug.edge_node_id": "edge1",
+	} {
+		if got, _ := fields.GetValue(key); !reflect.DeepEqual(got, want) {
+			t.Errorf("%v: got %#v, want %#v", key, got, want)
+		}
+	}
+	if len(conn.topics) != 0 {
+		t.Errorf("unexpected rebirth requests %v", conn.topics)
+	}
+
+	events = decode("spBv1.0/plant/NDATA/edge1", `
+		seq: 3
+		metrics { alias: 9 double_value: 1 }
+	`)
+	fields = events[0].RootFields
+	if name, _ := fields.GetValue("sensor.name"); name != "alias_9" {
+		t.Errorf("got sensor.name %v, want alias_9", name)
+	}
+	if tags, _ := fields.GetValue("tags"); !containsTag(tags, decodeFailureTag) {
+		t.Errorf("got tags %v, want %v", tags, decodeFailureTag)
+	}
+	if !reflect.DeepEqual(conn.topics, []string{"spBv1.0/plant/NCMD/edge1"}) {
+		t.Errorf("got rebirth requests %v, want one for edge1", conn.topics)
+	}
+}
+
+// TestDecodeEncodedSparkplugPayload decodes the payload the Sparkplug B
+// encoding of the mqtt output publishes for its golden event.
+func TestDecodeEncodedSparkplugPayload(t *testing.T) {
+	payload, err := ioutil.ReadFile("../../../output/mqtt/testdata/sparkplug_ddata.pb")
+	if err != nil {
+		t.Fatal(err)
+	}
+	topic := "spBv1.0/plant/DDATA/edge1/press1"
+	sparkplugTopic, _ := parseSparkplugTopic(topic)
+	decoder := newSparkplugDecoder(SparkplugConfig{Enabled: true})
+	events := decoder.decode(nil, sparkplugTopic, &message{topic: topic, payload: payload})
+
+	want := map[string]common.MapStr{
+		"sensor/active":       {"value.datatype": "bool", "value.value_bool": true},
+		"sensor/name":         {"value.datatype": "string", "value.value_string": "temperature"},
+		"tags":                {"value.datatype": "string", "value.value_string": `["line1"]`},
+		"value/raw":           {"value.datatype": "bytes", "value.value_bytes": []byte{1, 2}},
+		"value/unit":          {"value.null": true},
+		"value/value_float32": {"value.datatype": "float32", "value.value_float32": float32(1.5)},
+		"value/value_float64": {"value.datatype": "float64", "value.value_float64": 21.5},
+		"value/value_int64":   {"value.datatype": "int64", "value.value_int64": int64(-7)},
+		"value/value_uint64":  {"value.datatype": "uint64", "value.value_uint64": uint64(42)},
+	}
+	if len(events) != len(want) {
+		t.Fatalf("got %v events, want %v", len(events), len(want))
+	}
+	timestamp := time.Date(2023, 4, 19, 14, 21, 42, 0, time.UTC)
+	for _, event := range events {
+		fields := event.RootFields
+		name, _ := fields.GetValue("sensor.name")
+		expected, found := want[name.(string)]
+		if !found {
+			t.Errorf("unexpected metric %v", name)
+			continue
+		}
+		for key, value := range expected {
+			if got, _ := fields.GetValue(key); !reflect.DeepEqual(got, value) {
+				t.Errorf("%v: got %v %#v, want %#v", name, key, got, value)
+			}
+		}
+		if got, _ := fields.GetValue("value.source_timestamp"); got != timestamp {
+			t.Errorf("%v: got source timestamp %v, want %v", name, got, timestamp)
+		}
+		if tags, _ := fields.GetValue("tags"); tags != nil {
+			t.Errorf("%v: got tags %v", name, tags)
+		}
+	}
+}
@@ -0,0 +1,126 @@
+package topic
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+	"text/template"
+	"time"
+
+	"github.com/elastic/beats/v7/libbeat/logp"
+	"github.com/elastic/beats/v7/libbeat/monitoring"
+	"github.com/elastic/beats/v7/libbeat/version"
+)
+
+// Status of Machinebeat in the status messages
+const (
+	statusOnline  = "online"
+	statusOffline = "offline"
+)
+
+// StatusMessage is a message that tells subscribers of the broker whether
+// Machinebeat is online. The payload is a Go template, by default a JSON
+// object with all fields of statusInfo.
+type StatusMessage struct {
+	Topic   string `config:"topic"`
+	Payload string `config:"payload"`
+	QoS     int    `config:"qos"`
+	Retain  bool   `config:"retain"`
+
+	template *template.Template
+}
+
+// Validate checks the message and parses its template. It is called by the config unpacker.
+func (s *StatusMessage) Validate() error {
+	if s.Topic == "" {
+		return fmt.Errorf("topic of status message must not be empty")
+	}
+	if strings.ContainsAny(s.Topic, "+#") {
+		return fmt.Errorf("topic %v of status message must not contain wildcards", s.Topic)
+	}
+	if s.QoS < 0 || s.QoS > 2 {
+		return fmt.Errorf("qos of status message %v must be 0, 1 or 2", s.Topic)
+	}
+	if s.Payload != "" {
+		t, err := template.New(s.Topic).Funcs(template.FuncMap{"json": toJSON}).Parse(s.Payload)
+		if err != nil {
+			return fmt.Errorf("invalid payload of status message %v: %v", s.Topic, err)
+		}
+		s.template = t
+	}
+	return nil
+}
+
+// statusInfo is the data of the payload templates of the status messages.
+type statusInfo struct {
+	Event     string    `json:"event"`
+	Status    string    `json:"status"`
+	Hostname  string    `json:"hostname"`
+	Version   string    `json:"version"`
+	ClientID  string    `json:"client_id"`
+	Broker    string    `json:"broker"`
+	Modules   []string  `json:"modules"`
+	Timestamp time.Time `json:"@timestamp"`
+}
+
+// statusPayload renders the payload of a status message. event is birth,
+// will or shutdown.
+func (m *MetricSet) statusPayload(s *StatusMessage, event string, status string) []byte {
+	hostname, _ := os.Hostname()
+	info := statusInfo{
+		Event:     event,
+		Status:    status,
+		Hostname:  hostname,
+		Version:   version.GetDefaultVersion(),
+		ClientID:  m.ClientID,
+		Broker:    m.BrokerURL,
+		Modules:   runningModules(),
+		Timestamp: time.Now().UTC(),
+	}
+	if s.template == nil {
+		payload, _ := json.Marshal(info)
+		return payload
+	}
+
+	var buf bytes.Buffer
+	if err := s.template.Execute(&buf, info); err != nil {
+		logp.Warn("[MQTT] Failed to render the payload of status message %v: %v", s.Topic, err)
+	}
+	return buf.Bytes()
+}
+
+// publishBirth publishes the birth message after the client is connected.
+func (m *MetricSet) publishBirth() {
+	if m.BirthMessage == nil || m.conn == nil {
+		return
+	}
+	s := m.BirthMessage
+	logp.Info("[MQTT] Publish birth message to %v", s.Topic)
+	m.conn.publish(s.Topic, byte(s.QoS), s.Retain, m.statusPayload(s, "birth", statusOnline))
+}
+
+// runningModules returns the module.metricset names of all metricsets of the
+// beat. They are read from the monitoring registry, in which every running
+// metricset has its stats.
+func runningModules() []string {
+	registry := monitoring.Default.GetRegistry("metricbeat")
+	if registry == nil {
+		return []string{}
+	}
+	modules := []string{}
+	for key := range monitoring.CollectFlatSnapshot(registry, monitoring.Full, false).Ints {
+		if strings.HasSuffix(key, ".events") {
+			modules = append(modules, strings.TrimSuffix(key, ".events"))
+		}
+	}
+	sort.Strings(modules)
+	return modules
+}
+
+func toJSON(value interface{}) (string, error) {
+	b, err := json.Marshal(value)
+	return string(b), err
+}
@@ -0,0 +1,209 @@
+package topic
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/elastic/beats/v7/libbeat/common"
+	"github.com/elastic/beats/v7/libbeat/logp"
+	"github.com/elastic/beats/v7/metricbeat/mb"
+)
+
+// Subscription is an entry of the topics setting. It is either a topic filter,
+// a topic template or an object with the filter and the settings of the
+// messages it matches.
+type Subscription struct {
+	Topic      string         `config:"topic"`
+	Template   string         `config:"template"`
+	QoS        *int           `config:"qos"`
+	Format     string         `config:"format"`
+	Decoder    *common.Config `config:"decoder"`
+	Decompress string         `config:"decompress"`
+	Dataset    string         `config:"dataset"`
+	Index      string         `config:"index"`
+	Fields     common.MapStr  `config:"fields"`
+	Mapping    *Mapping       `config:"mapping"`
+
+	template *topicTemplate
+	decoder  Decoder
+}
+
+// subscriptionConfig has the fields of a Subscription without its Unpack method.
+type subscriptionConfig Subscription
+
+// Unpack accepts a topic filter or an object with the topic filter and the
+// settings of the subscription. It is called by the config unpacker.
+func (s *Subscription) Unpack(value interface{}) error {
+	switch v := value.(type) {
+	case string:
+		if strings.Contains(v, "{") {
+			*s = Subscription{Template: v}
+		} else {
+			*s = Subscription{Topic: v}
+		}
+	case map[string]interface{}:
+		config, err := common.NewConfigFrom(v)
+		if err != nil {
+			return err
+		}
+		var sub subscriptionConfig
+		if err := config.Unpack(&sub); err != nil {
+			return err
+		}
+		*s = Subscription(sub)
+	default:
+		return fmt.Errorf("topics must be topic filters or objects, got %v", value)
+	}
+	return s.validate()
+}
+
+func (s *Subscription) validate() error {
+	if s.Template != "" {
+		template, err := parseTopicTemplate(s.Template)
+		if err != nil {
+			return err
+		}
+		s.template = template
+		// Without a topic filter all topics of the template are subscribed
+		if s.Topic == "" {
+			s.Topic = template.filter
+		}
+	}
+	if s.Topic == "" {
+		return fmt.Errorf("topic or template of subscription must not be empty")
+	}
+	if s.QoS != nil && (*s.QoS < 0 || *s.QoS > 2) {
+		return fmt.Errorf("qos of topic %v must be 0, 1 or 2", s.Topic)
+	}
+	if s.Mapping != nil {
+		if s.Format == formatNone {
+			return fmt.Errorf("topic %v: mapping requires a format", s.Topic)
+		}
+		// Mapped payloads are decoded even if decode_payload is disabled
+		if s.Format == "" {
+			s.Format = formatAuto
+		}
+		if err := s.Mapping.validate(); err != nil {
+			return fmt.Errorf("topic %v: %v", s.Topic, err)
+		}
+	}
+	if s.Format != "" {
+		decoder, err := newDecoder(s.Format, s.Decoder)
+		if err != nil {
+			return fmt.Errorf("topic %v: %v", s.Topic, err)
+		}
+		s.decoder = decoder
+	} else if s.Decoder != nil {
+		return fmt.Errorf("topic %v: decoder settings require a format", s.Topic)
+	}
+	switch s.Decompress {
+	case "", decompressAuto, decompressGzip, decompressDeflate, decompressNone:
+	default:
+		return fmt.Errorf("unknown decompress %q of topic %v, use %v, %v, %v or %v", s.Decompress, s.Topic, decompressAuto, decompressGzip, decompressDeflate, decompressNone)
+	}
+	return nil
+}
+
+// matches reports whether a topic matches the topic filter of the subscription.
+func (s *Subscription) matches(topic string) bool {
+	return topicMatches(s.Topic, topic)
+}
+
+// topicMatches reports whether a topic matches a topic filter with the
+// wildcards + and #. The prefix of shared subscriptions is ignored.
+func topicMatches(filter string, topic string) bool {
+	if strings.HasPrefix(filter, "$share/") {
+		parts := strings.SplitN(filter, "/", 3)
+		if len(parts) < 3 {
+			return false
+		}
+		filter = parts[2]
+	}
+
+	// Wildcards at the first level don't match topics starting with $
+	if strings.HasPrefix(topic, "$") && (strings.HasPrefix(filter, "+") || strings.HasPrefix(filter, "#")) {
+		return false
+	}
+
+	filterLevels := strings.Split(filter, "/")
+	topicLevels := strings.Split(topic, "/")
+	for i, level := range filterLevels {
+		if level == "#" {
+			return true
+		}
+		if i >= len(topicLevels) {
+			return false
+		}
+		if level != "+" && level != topicLevels[i] {
+			return false
+		}
+	}
+	return len(filterLevels) == len(topicLevels)
+}
+
+// subscriptionFor returns the first subscription whose filter matches the
+// topic of a message. The broker may deliver messages that match none, e.g.
+// of a persistent session with other subscriptions.
+func (m *MetricSet) subscriptionFor(topic string) *Subscription {
+	for i := range m.TopicsSubscribe {
+		if m.TopicsSubscribe[i].matches(topic) {
+			return &m.TopicsSubscribe[i]
+		}
+	}
+	return &Subscription{Topic: topic}
+}
+
+// apply sets the dataset, index and static fields of the subscription and
+// the fields captured by its topic template.
+func (s *Subscription) apply(event *mb.Event, topic string) {
+	if s.Dataset != "" {
+		event.RootFields.Put("event.dataset", s.Dataset)
+	}
+	if s.Index != "" {
+		event.Index = s.Index
+	}
+	if len(s.Fields) > 0 {
+		event.RootFields.DeepUpdate(s.Fields.Clone())
+	}
+	if s.template != nil {
+		if fields, ok := s.template.match(topic); ok {
+			event.RootFields.DeepUpdate(fields)
+		}
+	}
+}
+
+// decoderFor returns the decoder of a message, or nil if it isn't decoded.
+// The format of the subscription has precedence over the content type of
+// MQTT 5 messages.
+func (m *MetricSet) decoderFor(sub *Subscription, msg *message) Decoder {
+	if sub.Format != "" {
+		return sub.decoder
+	}
+	if !m.DecodePaylod {
+		return nil
+	}
+	// The formats of content types need no settings
+	decoder, _ := newDecoder(payloadFormat(msg.contentType), nil)
+	return decoder
+}
+
+// ParseTopics will parse the config file and return a map with topic:QoS
+func ParseTopics(subscriptions []Subscription, qos int, shareGroup string) map[string]byte {
+	topics := make(map[string]byte)
+	for _, sub := range subscriptions {
+		topic := sub.Topic
+		if shareGroup != "" && !strings.HasPrefix(topic, "$share/") {
+			topic = "$share/" + shareGroup + "/" + topic
+		}
+		topicQoS := qos
+		if sub.QoS != nil {
+			topicQoS = *sub.QoS
+		}
+		// The same filter may be configured with different settings, use the highest QoS
+		if existing, found := topics[topic]; !found || byte(topicQoS) > existing {
+			topics[topic] = byte(topicQoS)
+		}
+		logp.Info("Subscribe to %v with QoS %v", topic, topicQoS)
+	}
+	return topics
+}
@@ -0,0 +1,94 @@
+package topic
+
+import (
+	"testing"
+)
+
+func TestTopicMatches(t *testing.T) {
+	tests := []struct {
+		filter string
+		topic  string
+		match  bool
+	}{
+		{"sport/tennis/player1", "sport/tennis/player1", true},
+		{"sport/tennis/player1", "sport/tennis/player2", false},
+		{"sport/tennis/player1", "sport/tennis/player1/ranking", false},
+		{"sport/tennis/player1/#", "sport/tennis/player1", true},
+		{"sport/tennis/player1/#", "sport/tennis/player1/ranking/wimbledon", true},
+		{"sport/#", "sport", true},
+		{"sport/#", "sports", false},
+		{"#", "sport/tennis", true},
+		{"#", "/", true},
+		{"sport/tennis/+", "sport/tennis/player1", true},
+		{"sport/tennis/+", "sport/tennis/player1/ranking", false},
+		{"sport/+", "sport", false},
+		{"sport/+", "sport/", true},
+		{"+/+", "/finance", true},
+		{"/+", "/finance", true},
+		{"+", "/finance", false},
+		{"+/tennis/#", "sport/tennis/player1", true},
+		// Wildcards at the first level don't match topics starting with $
+		{"#", "$SYS/broker/uptime", false},
+		{"+/broker/uptime", "$SYS/broker/uptime", false},
+		{"$SYS/#", "$SYS/broker/uptime", true},
+		{"$SYS/+/uptime", "$SYS/broker/uptime", true},
+		// The prefix of shared subscriptions is ignored
+		{"$share/machinebeat/sport/#", "sport/tennis", true},
+		{"$share/machinebeat/sport/#", "$share/machinebeat/sport/tennis", false},
+		{"$share/machinebeat", "machinebeat", false},
+	}
+	for _, test := range tests {
+		if match := topicMatches(test.filter, test.topic); match != test.match {
+			t.Errorf("topicMatches(%q, %q) = %v, want %v", test.filter, test.topic, match, test.match)
+		}
+	}
+}
+
+func TestSubscriptionFor(t *testing.T) {
+	m := &MetricSet{TopicsSubscribe: []Subscription{
+		{Topic: "factory/+/alarms", Dataset: "alarms"},
+		{Topic: "factory/#", Dataset: "factory"},
+	}}
+	tests := map[string]string{
+		"factory/press1/alarms": "alarms",
+		"factory/press1/temp":   "factory",
+		"office/temp":           "",
+	}
+	for topic, dataset := range tests {
+		sub := m.subscriptionFor(topic)
+		if sub.Dataset != dataset {
+			t.Errorf("%v: got dataset %q, want %q", topic, sub.Dataset, dataset)
+		}
+		if dataset == "" && sub.Topic != topic {
+			t.Errorf("%v: got topic %q for an unmatched message", topic, sub.Topic)
+		}
+	}
+}
+
+func TestParseTopics(t *testing.T) {
+	qos1, qos2 := 1, 2
+	subscriptions := []Subscription{
+		{Topic: "factory/#"},
+		{Topic: "factory/#", QoS: &qos2},
+		{Topic: "office/+", QoS: &qos1},
+		{Topic: "$share/other/lab/#"},
+	}
+
+	topics := ParseTopics(subscriptions, 0, "")
+	want := map[string]byte{"factory/#": 2, "office/+": 1, "$share/other/lab/#": 0}
+	if len(topics) != len(want) {
+		t.Errorf("got %v, want %v", topics, want)
+	}
+	for topic, qos := range want {
+		if got, found := topics[topic]; !found || got != qos {
+			t.Errorf("%v: got QoS %v (%v), want %v", topic, got, found, qos)
+		}
+	}
+
+	topics = ParseTopics(subscriptions, 0, "machinebeat")
+	for _, topic := range []string{"$share/machinebeat/factory/#", "$share/machinebeat/office/+", "$share/other/lab/#"} {
+		if _, found := topics[topic]; !found {
+			t.Errorf("%v not subscribed, got %v", topic, topics)
+		}
+	}
+}
@@ -0,0 +1,80 @@
+package topic
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/elastic/beats/v7/libbeat/common"
+)
+
+// topicTemplate is a topic filter whose levels may be named placeholders like
+// site/{site.name}/line/{machine.line}/+/{sensor.name}. The levels matched by
+// the placeholders are added to the events under the placeholder names.
+type topicTemplate struct {
+	levels []templateLevel
+	filter string
+}
+
+type templateLevel struct {
+	// field is the name of the placeholder, empty for fixed levels and wildcards
+	field string
+	// value is the fixed level or the wildcard + or #
+	value string
+}
+
+func parseTopicTemplate(template string) (*topicTemplate, error) {
+	t := &topicTemplate{}
+	fields := make(map[string]bool)
+	parts := strings.Split(template, "/")
+	for i, part := range parts {
+		switch {
+		case strings.HasPrefix(part, "{") && strings.HasSuffix(part, "}"):
+			field := strings.TrimSpace(part[1 : len(part)-1])
+			if field == "" {
+				return nil, fmt.Errorf("empty placeholder in topic template %v", template)
+			}
+			if fields[field] {
+				return nil, fmt.Errorf("placeholder {%v} is used twice in topic template %v", field, template)
+			}
+			fields[field] = true
+			t.levels = append(t.levels, templateLevel{field: field})
+		case part == "#":
+			if i != len(parts)-1 {
+				return nil, fmt.Errorf("wildcard # must be the last level of topic template %v", template)
+			}
+			t.levels = append(t.levels, templateLevel{value: part})
+		case strings.ContainsAny(part, "{}#") || (part != "+" && strings.Contains(part, "+")):
+			return nil, fmt.Errorf("invalid level %q in topic template %v, placeholders and wildcards must be whole levels", part, template)
+		default:
+			t.levels = append(t.levels, templateLevel{value: part})
+		}
+	}
+
+	// The filter subscribes to all topics of the template
+	levels := make([]string, len(t.levels))
+	for i, level := range t.levels {
+		if level.field != "" {
+			levels[i] = "+"
+		} else {
+			levels[i] = level.value
+		}
+	}
+	t.filter = strings.Join(levels, "/")
+	return t, nil
+}
+
+// match returns the fields captured by the placeholders of the template, or
+// false if the topic doesn't match the template.
+func (t *topicTemplate) match(topic string) (common.MapStr, bool) {
+	if !topicMatches(t.filter, topic) {
+		return nil, false
+	}
+	fields := make(common.MapStr)
+	topicLevels := strings.Split(topic, "/")
+	for i, level := range t.levels {
+		if level.field != "" {
+			fields.Put(level.field, topicLevels[i])
+		}
+	}
+	return fields, true
+}
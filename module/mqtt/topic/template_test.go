@@ -0,0 +1,104 @@
+package topic
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/elastic/beats/v7/libbeat/common"
+	"github.com/elastic/beats/v7/metricbeat/mb"
+)
+
+func TestTopicTemplate(t *testing.T) {
+	tests := []struct {
+		template string
+		filter   string
+		topic    string
+		fields   common.MapStr
+	}{
+		{
+			template: "site/{site}/line/{machine.line}/machine/{machine.name}/{sensor.name}",
+			filter:   "site/+/line/+/machine/+/+",
+			topic:    "site/berlin/line/2/machine/press1/temperature",
+			fields: common.MapStr{
+				"site":    "berlin",
+				"machine": common.MapStr{"line": "2", "name": "press1"},
+				"sensor":  common.MapStr{"name": "temperature"},
+			},
+		},
+		{
+			template: "factory/{machine.name}/+/#",
+			filter:   "factory/+/+/#",
+			topic:    "factory/press1/telemetry/a/b",
+			fields:   common.MapStr{"machine": common.MapStr{"name": "press1"}},
+		},
+		{
+			template: "factory/{ machine.name }/#",
+			filter:   "factory/+/#",
+			topic:    "factory/press1",
+			fields:   common.MapStr{"machine": common.MapStr{"name": "press1"}},
+		},
+		{
+			template: "factory/{machine.name}",
+			filter:   "factory/+",
+			topic:    "factory/press1/temperature",
+		},
+		{
+			template: "factory/{machine.name}",
+			filter:   "factory/+",
+			topic:    "office/press1",
+		},
+	}
+	for _, test := range tests {
+		template, err := parseTopicTemplate(test.template)
+		if err != nil {
+			t.Errorf("%v: %v", test.template, err)
+			continue
+		}
+		if template.filter != test.filter {
+			t.Errorf("%v: got filter %v, want %v", test.template, template.filter, test.filter)
+		}
+		fields, match := template.match(test.topic)
+		if match != (test.fields != nil) {
+			t.Errorf("%v: got match %v for %v", test.template, match, test.topic)
+		}
+		if match && !reflect.DeepEqual(fields, test.fields) {
+			t.Errorf("%v: got fields %v, want %v", test.template, fields, test.fields)
+		}
+	}
+}
+
+func TestTopicTemplateErrors(t *testing.T) {
+	for _, template := range []string{
+		"factory/{}/temp",
+		"factory/{name}/{name}",
+		"factory/#/{name}",
+		"factory/press{name}",
+		"factory/{name}x",
+		"factory/a+b",
+		"factory/a#",
+	} {
+		if _, err := parseTopicTemplate(template); err == nil {
+			t.Errorf("%v: expected an error", template)
+		}
+	}
+}
+
+func TestSubscriptionTemplate(t *testing.T) {
+	var sub Subscription
+	if err := sub.Unpack("site/{site}/+/{sensor.name}"); err != nil {
+		t.Fatal(err)
+	}
+	if sub.Topic != "site/+/+/+" {
+		t.Errorf("got topic %v, want site/+/+/+", sub.Topic)
+	}
+
+	event := mb.Event{RootFields: common.MapStr{"sensor": common.MapStr{"id": "1"}}}
+	sub.apply(&event, "site/berlin/line2/temperature")
+	want := common.MapStr{
+		"site":   "berlin",
+		"sensor": common.MapStr{"id": "1", "name": "temperature"},
+	}
+	if !reflect.DeepEqual(event.RootFields, want) {
+		t.Errorf("got %v, want %v", event.RootFields, want)
+	}
+}
@@ -0,0 +1,16 @@
+package topic
+
+import (
+	"crypto/tls"
+)
+
+// tlsConfig returns the TLS configuration of the connection to the broker, or
+// nil if ssl is not enabled. Brokers with a TLS scheme like ssl:// are then
+// verified with the system certificates.
+func (m *MetricSet) tlsConfig() *tls.Config {
+	var host string
+	if u, err := parseBrokerURL(m.BrokerURL); err == nil {
+		host = u.Hostname()
+	}
+	return m.SSL.ClientConfig(host)
+}
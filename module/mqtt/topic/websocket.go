@@ -0,0 +1,100 @@
+package topic
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// dialWebsocket connects to a ws:// or wss:// broker. The MQTT packets are
+// sent as binary messages to the path of the broker URL.
+func (d *brokerDialer) dialWebsocket(ctx context.Context, u *url.URL) (net.Conn, error) {
+	secure := strings.ToLower(u.Scheme) == "wss"
+	dialer := websocket.Dialer{
+		NetDialContext: func(ctx context.Context, network, address string) (net.Conn, error) {
+			return d.dialTCP(ctx, address)
+		},
+		TLSClientConfig: d.tlsConfig,
+		Subprotocols:    d.websocket.Subprotocols,
+	}
+	if len(dialer.Subprotocols) == 0 {
+		dialer.Subprotocols = []string{"mqtt"}
+	}
+
+	header := make(http.Header)
+	for name, value := range d.websocket.Headers {
+		header.Set(name, value)
+	}
+
+	wsURL := *u
+	wsURL.Scheme = "ws"
+	if secure {
+		wsURL.Scheme = "wss"
+	}
+	conn, resp, err := dialer.DialContext(ctx, wsURL.String(), header)
+	if err != nil {
+		if resp != nil {
+			return nil, fmt.Errorf("websocket handshake with %v failed with status %v: %v", wsURL.Redacted(), resp.Status, err)
+		}
+		return nil, err
+	}
+	return &websocketConn{Conn: conn}, nil
+}
+
+// websocketConn is a websocket connection that can be used as net.Conn by the
+// MQTT clients. Messages of the broker may contain parts of packets or
+// several packets, so they are read as a stream.
+type websocketConn struct {
+	*websocket.Conn
+	reader io.Reader
+
+	writeMutex sync.Mutex
+}
+
+func (c *websocketConn) Read(b []byte) (int, error) {
+	for {
+		if c.reader == nil {
+			messageType, reader, err := c.NextReader()
+			if err != nil {
+				return 0, err
+			}
+			if messageType != websocket.BinaryMessage {
+				continue
+			}
+			c.reader = reader
+		}
+		n, err := c.reader.Read(b)
+		if err == io.EOF {
+			c.reader = nil
+			if n == 0 {
+				continue
+			}
+			err = nil
+		}
+		return n, err
+	}
+}
+
+func (c *websocketConn) Write(b []byte) (int, error) {
+	c.writeMutex.Lock()
+	defer c.writeMutex.Unlock()
+	if err := c.WriteMessage(websocket.BinaryMessage, b); err != nil {
+		return 0, err
+	}
+	return len(b), nil
+}
+
+func (c *websocketConn) SetDeadline(t time.Time) error {
+	if err := c.SetReadDeadline(t); err != nil {
+		return err
+	}
+	return c.SetWriteDeadline(t)
+}
@@ -0,0 +1,257 @@
+package nodevalue
+
+import (
+	"github.com/elastic/beats/v7/libbeat/common"
+	"github.com/elastic/beats/v7/libbeat/logp"
+
+	"github.com/gopcua/opcua/id"
+	"github.com/gopcua/opcua/ua"
+
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+	"unicode"
+)
+
+// maxAttributeID is the highest attribute id defined by the OPC UA specification.
+// A snapshot reads every attribute up to this id.
+const maxAttributeID = ua.AttributeIDAccessLevelEx
+
+// parseAttributeID returns the attribute id for names like "Description",
+// "AccessLevel" or "access_level".
+func parseAttributeID(name string) (ua.AttributeID, error) {
+	normalized := strings.ToLower(strings.Replace(name, "_", "", -1))
+	for attrID := ua.AttributeIDNodeID; attrID <= maxAttributeID; attrID++ {
+		if strings.ToLower(attributeName(attrID)) == normalized {
+			return attrID, nil
+		}
+	}
+	return ua.AttributeIDInvalid, fmt.Errorf("unknown attribute %v", name)
+}
+
+// attributeName returns the attribute name without the AttributeID prefix.
+func attributeName(attrID ua.AttributeID) string {
+	return strings.TrimPrefix(attrID.String(), "AttributeID")
+}
+
+// fieldName converts a CamelCase attribute or property name to snake_case.
+func fieldName(name string) string {
+	var b strings.Builder
+	runes := []rune(name)
+	for i, r := range runes {
+		if unicode.IsUpper(r) {
+			if i > 0 && (unicode.IsLower(runes[i-1]) || (i+1 < len(runes) && unicode.IsLower(runes[i+1]))) {
+				b.WriteRune('_')
+			}
+			b.WriteRune(unicode.ToLower(r))
+		} else if r == ' ' || r == '.' {
+			b.WriteRune('_')
+		} else {
+			b.WriteRune(r)
+		}
+	}
+	return b.String()
+}
+
+// resolveExtras parses the configured attributes and looks up the node ids of
+// the configured properties. A property "*" selects every property of the node.
+func (client *Client) resolveExtras(nodeCfg *Node) error {
+	nodeCfg.attributeIDs = nil
+	for _, name := range nodeCfg.Attributes {
+		attrID, err := parseAttributeID(name)
+		if err != nil {
+			return err
+		}
+		nodeCfg.attributeIDs = append(nodeCfg.attributeIDs, attrID)
+	}
+
+	if len(nodeCfg.Properties) == 0 {
+		return nil
+	}
+
+	refs, err := client.opcua.Node(nodeCfg.NodeId).References(id.HasProperty, ua.BrowseDirectionForward, ua.NodeClassVariable, true)
+	if err != nil {
+		return err
+	}
+	nodeCfg.propertyIDs = make(map[string]*ua.NodeID)
+	for _, ref := range refs {
+		if ref.BrowseName == nil || ref.NodeID == nil {
+			continue
+		}
+		for _, name := range nodeCfg.Properties {
+			if name == "*" || name == ref.BrowseName.Name {
+				nodeCfg.propertyIDs[ref.BrowseName.Name] = ref.NodeID.NodeID
+			}
+		}
+	}
+	for _, name := range nodeCfg.Properties {
+		if _, found := nodeCfg.propertyIDs[name]; !found && name != "*" {
+			logp.Warn("[OPCUA] Node %v has no property %v", nodeCfg.ID, name)
+		}
+	}
+	return nil
+}
+
+func (nodeCfg *Node) hasExtras() bool {
+	return len(nodeCfg.attributeIDs) > 0 || len(nodeCfg.propertyIDs) > 0
+}
+
+// extraReadValueIDs returns the read requests for the configured attributes and
+// properties of a node. The order matches the one used by extrasOf.
+func (nodeCfg *Node) extraReadValueIDs() []*ua.ReadValueID {
+	var nodesToRead []*ua.ReadValueID
+	for _, attrID := range nodeCfg.attributeIDs {
+		nodesToRead = append(nodesToRead, &ua.ReadValueID{NodeID: nodeCfg.NodeId, AttributeID: attrID})
+	}
+	for _, name := range nodeCfg.propertyNames() {
+		nodesToRead = append(nodesToRead, &ua.ReadValueID{NodeID: nodeCfg.propertyIDs[name], AttributeID: ua.AttributeIDValue})
+	}
+	return nodesToRead
+}
+
+// extrasOf returns the fields of the results of the requests built by
+// extraReadValueIDs.
+func (nodeCfg *Node) extrasOf(results []*ua.DataValue) common.MapStr {
+	extras := common.MapStr{}
+	i := 0
+	for _, attrID := range nodeCfg.attributeIDs {
+		if value := attributeValue(attrID, results[i]); value != nil {
+			extras.Put("attributes."+fieldName(attributeName(attrID)), value)
+		}
+		i++
+	}
+	for _, name := range nodeCfg.propertyNames() {
+		if value := attributeValue(ua.AttributeIDValue, results[i]); value != nil {
+			extras.Put("properties."+fieldName(name), value)
+		}
+		i++
+	}
+	return extras
+}
+
+func (nodeCfg *Node) propertyNames() []string {
+	var names []string
+	for name := range nodeCfg.propertyIDs {
+		names = append(names, name)
+	}
+	//Keep the order stable between building the request and evaluating the response
+	sort.Strings(names)
+	return names
+}
+
+// readExtras reads the configured attributes and properties of all nodes by
+// node id. This is used in subscribe mode, where the values are pushed by the
+// server.
+func (client *Client) readExtras() (map[string]common.MapStr, error) {
+	var nodesToRead []*ua.ReadValueID
+	var nodes []*Node
+	for _, nodeCfg := range client.nodesToCollect {
+		if nodeCfg.hasExtras() {
+			nodesToRead = append(nodesToRead, nodeCfg.extraReadValueIDs()...)
+			nodes = append(nodes, nodeCfg)
+		}
+	}
+	if len(nodesToRead) == 0 {
+		return nil, nil
+	}
+
+	results, err := client.read(nodesToRead, 2000, ua.TimestampsToReturnNeither)
+	if err != nil {
+		return nil, err
+	}
+
+	extras := make(map[string]common.MapStr, len(nodes))
+	offset := 0
+	for _, nodeCfg := range nodes {
+		count := len(nodeCfg.attributeIDs) + len(nodeCfg.propertyIDs)
+		extras[nodeCfg.ID] = nodeCfg.extrasOf(results[offset : offset+count])
+		offset += count
+	}
+	return extras, nil
+}
+
+// snapshotDue reports whether the nodes configured with snapshot should be read again.
+func (client *Client) snapshotDue() bool {
+	if len(client.nodesToSnapshot) == 0 {
+		return false
+	}
+	return time.Since(client.lastSnapshot) >= client.config.SnapshotInterval
+}
+
+// collectSnapshots reads every attribute of the nodes configured with snapshot.
+func (client *Client) collectSnapshots() ([]*ResponseObject, error) {
+	var retVal []*ResponseObject
+	var nodesToRead []*ua.ReadValueID
+
+	for _, nodeCfg := range client.nodesToSnapshot {
+		for attrID := ua.AttributeIDNodeID; attrID <= maxAttributeID; attrID++ {
+			nodesToRead = append(nodesToRead, &ua.ReadValueID{NodeID: nodeCfg.NodeId, AttributeID: attrID})
+		}
+	}
+
+	results, err := client.read(nodesToRead, 0, ua.TimestampsToReturnBoth)
+	if err != nil {
+		return retVal, err
+	}
+	client.lastSnapshot = time.Now()
+
+	perNode := int(maxAttributeID)
+	for index, nodeCfg := range client.nodesToSnapshot {
+		var response ResponseObject
+		response.node = *nodeCfg
+		response.snapshot = true
+		response.extras = common.MapStr{}
+		for i, result := range results[index*perNode : (index+1)*perNode] {
+			//Attributes that do not exist for the node class are not part of the snapshot
+			if result.Status != ua.StatusOK {
+				continue
+			}
+			attrID := ua.AttributeID(i + 1)
+			if attrID == ua.AttributeIDValue {
+				response.value = result
+				continue
+			}
+			if value := attributeValue(attrID, result); value != nil {
+				response.extras.Put("attributes."+fieldName(attributeName(attrID)), value)
+			}
+		}
+		retVal = append(retVal, &response)
+	}
+	return retVal, nil
+}
+
+// attributeValue converts the value of an attribute into a type that can be
+// published. Structured types are published with their textual representation.
+func attributeValue(attrID ua.AttributeID, dv *ua.DataValue) interface{} {
+	if dv == nil || dv.Status != ua.StatusOK || dv.Value == nil {
+		return nil
+	}
+	if attrID == ua.AttributeIDNodeClass {
+		return strings.TrimPrefix(ua.NodeClass(dv.Value.Int()).String(), "NodeClass")
+	}
+	switch v := dv.Value.Value().(type) {
+	case *ua.LocalizedText:
+		return v.Text
+	case *ua.QualifiedName:
+		return v.Name
+	case *ua.NodeID:
+		return v.String()
+	case *ua.ExpandedNodeID:
+		return v.String()
+	case *ua.GUID:
+		return v.String()
+	case ua.StatusCode:
+		return v.Error()
+	case *ua.ExtensionObject:
+		return fmt.Sprintf("%v", v.Value)
+	case *ua.Variant:
+		return v.Value()
+	case time.Time:
+		return v
+	case nil:
+		return nil
+	default:
+		return v
+	}
+}
@@ -1,7 +1,10 @@
 package nodevalue
 
 import (
+	"github.com/elastic/beats/v7/libbeat/common"
 	"github.com/elastic/beats/v7/libbeat/logp"
+	"github.com/elastic/machinebeat/helper/change"
+	"github.com/elastic/machinebeat/helper/transform"
 
 	"github.com/gopcua/opcua"
 	"github.com/gopcua/opcua/debug"
@@ -9,6 +12,7 @@ import (
 	"github.com/gopcua/opcua/ua"
 
 	"context"
+	"fmt"
 	"strconv"
 	"time"
 
@@ -22,25 +26,40 @@ type Client struct {
 	endpoint         string
 	connected        bool
 	nodesToCollect   []*Node
+	nodesToSnapshot  []*Node
+	lastSnapshot     time.Time
 	sem              *semaphore.Weighted
 	counter          int
+	changes          *change.Detector
 	config           *MetricSet
 	ctx              context.Context
 }
 
 type ResponseObject struct {
-	node  Node
-	value *ua.DataValue
+	node        Node
+	value       *ua.DataValue
+	transformed interface{}
+	snapshot    bool
+	// extras are the attributes and properties read with the value
+	extras common.MapStr
 }
 
 type Node struct {
-	ID       string `config:"id"`
-	Label    string `config:"label"`
-	NodeId   *ua.NodeID
-	Object   *opcua.Node
-	Name     string
-	Path     string
-	DataType string
+	ID                string            `config:"id"`
+	Label             string            `config:"label"`
+	Attributes        []string          `config:"attributes"`
+	Properties        []string          `config:"properties"`
+	Snapshot          bool              `config:"snapshot"`
+	Transform         *transform.Config `config:"transform"`
+	ReportByException *change.Config    `config:"reportByException"`
+	NodeId            *ua.NodeID
+	Object            *opcua.Node
+	Name              string
+	Path              string
+	DataType          string
+
+	attributeIDs []ua.AttributeID
+	propertyIDs  map[string]*ua.NodeID
 }
 
 func join(a, b string) string {
@@ -145,6 +164,8 @@ func (client *Client) appendNodeInformation() error {
 
 		logp.Debug("Append Information", "Collect internal Object")
 		node := opcuaClient.Node(nodeId)
+		nodeCfg.NodeId = nodeId
+		nodeCfg.Object = node
 
 		if nodeCfg.Name == "" {
 			logp.Debug("Append Information", "Collect display name")
@@ -165,6 +186,19 @@ func (client *Client) appendNodeInformation() error {
 				nodeCfg.DataType = getDataType(attrs[0])
 			}
 		}
+
+		if config := client.config; config.ServerEnums {
+			logp.Debug("Append Information", "Collect enum strings")
+			client.resolveEnum(nodeCfg)
+		}
+
+		logp.Debug("Append Information", "Collect attributes and properties")
+		if err := client.resolveExtras(nodeCfg); err != nil {
+			return err
+		}
+		if nodeCfg.Snapshot {
+			client.nodesToSnapshot = append(client.nodesToSnapshot, nodeCfg)
+		}
 	}
 	return nil
 }
@@ -174,40 +208,70 @@ func (client *Client) collectData() ([]*ResponseObject, error) {
 	var retVal []*ResponseObject
 	var nodesToRead []*ua.ReadValueID
 
-	var opcuaClient = client.opcua
-
 	logp.Debug("Collect", "Building the request")
 	for _, nodeCfg := range client.nodesToCollect {
 		logp.Debug("Collect", "Add node to request %v", nodeCfg.ID)
-		nodesToRead = append(nodesToRead, &ua.ReadValueID{NodeID: nodeCfg.NodeId})
-	}
-
-	req := &ua.ReadRequest{
-		MaxAge:             2000,
-		NodesToRead:        nodesToRead,
-		TimestampsToReturn: ua.TimestampsToReturnBoth,
+		nodesToRead = append(nodesToRead, &ua.ReadValueID{NodeID: nodeCfg.NodeId, AttributeID: ua.AttributeIDValue})
+		nodesToRead = append(nodesToRead, nodeCfg.extraReadValueIDs()...)
 	}
 
 	logp.Debug("Collect", "Sending request")
-	m, err := opcuaClient.ReadWithContext(client.ctx, req)
+	results, err := client.read(nodesToRead, 2000, ua.TimestampsToReturnBoth)
 	if err != nil {
 		return retVal, err
 	}
 
 	logp.Debug("Collect", "Evaluating response")
 
-	for index, node := range client.nodesToCollect {
+	index := 0
+	for _, node := range client.nodesToCollect {
 		logp.Debug("Collect", "Add response from %v", node.ID)
-		logp.Debug("Collect", "Current result %v", m.Results[index])
+		logp.Debug("Collect", "Current result %v", results[index])
 		var response ResponseObject
+		response.value = results[index]
+		index++
+		if node.hasExtras() {
+			count := len(node.attributeIDs) + len(node.propertyIDs)
+			response.extras = node.extrasOf(results[index : index+count])
+			index += count
+		}
 		response.node = *node
-		response.value = m.Results[index]
 		retVal = append(retVal, &response)
 	}
 	logp.Debug("Collect", "Data collection done")
 	return retVal, nil
 }
 
+// read reads the values with one read request per maxNodesPerRead values,
+// servers reject larger requests with BadTooManyOperations.
+func (client *Client) read(nodesToRead []*ua.ReadValueID, maxAge float64, timestamps ua.TimestampsToReturn) ([]*ua.DataValue, error) {
+	size := client.config.MaxNodesPerRead
+	if size <= 0 {
+		size = len(nodesToRead)
+	}
+	var results []*ua.DataValue
+	for start := 0; start < len(nodesToRead); start += size {
+		end := start + size
+		if end > len(nodesToRead) {
+			end = len(nodesToRead)
+		}
+		req := &ua.ReadRequest{
+			MaxAge:             maxAge,
+			NodesToRead:        nodesToRead[start:end],
+			TimestampsToReturn: timestamps,
+		}
+		resp, err := client.opcua.ReadWithContext(client.ctx, req)
+		if err != nil {
+			return nil, err
+		}
+		if len(resp.Results) != end-start {
+			return nil, fmt.Errorf("read request of %v values returned %v results", end-start, len(resp.Results))
+		}
+		results = append(results, resp.Results...)
+	}
+	return results, nil
+}
+
 func (client *Client) startSubscription() {
 	logp.Info("[OPCUA] Starting subscribe process")
 	if client.subscription == nil {
@@ -369,10 +433,12 @@ func translateDeadbandtypeToUint32(value ua.DeadbandType) uint32 {
 func (client *Client) startBrowse() {
 
 	var nodeObjsToBrowse []*opcua.Node
+	var rootCfgs []*Node
 	var opcuaClient = client.opcua
 
 	if len(client.config.Nodes) > 0 {
-		for _, nodeCfg := range client.config.Nodes {
+		for i := range client.config.Nodes {
+			nodeCfg := &client.config.Nodes[i]
 			logp.Info("[OPCUA] Start browsing node: %v", nodeCfg.ID)
 			nodeId, err := ua.ParseNodeID(nodeCfg.ID)
 			if err != nil {
@@ -383,6 +449,7 @@ func (client *Client) startBrowse() {
 			}
 			nodeObj := opcuaClient.Node(nodeId)
 			nodeObjsToBrowse = append(nodeObjsToBrowse, nodeObj)
+			rootCfgs = append(rootCfgs, nodeCfg)
 		}
 	} else {
 		logp.Info("[OPCUA] No custom browse root node configuration found. Start browsing from Objects and Views folder")
@@ -392,12 +459,13 @@ func (client *Client) startBrowse() {
 
 		viewFolderObj := opcuaClient.Node(ua.NewTwoByteNodeID(id.ViewsFolder))
 		nodeObjsToBrowse = append(nodeObjsToBrowse, viewFolderObj)
+		rootCfgs = append(rootCfgs, &Node{}, &Node{})
 	}
 
 	//For each configured Node start browsing.
-	for _, nodeObj := range nodeObjsToBrowse {
+	for i, nodeObj := range nodeObjsToBrowse {
 		//This will browse through nodes and subscribe to every node that we found
-		err := client.browse(nodeObj, 0, "")
+		err := client.browse(nodeObj, 0, "", rootCfgs[i])
 		if err != nil {
 			logp.Info("Error occured")
 			logp.Error(err)
@@ -411,7 +479,8 @@ func (client *Client) startBrowse() {
 
 //browse() is a recursive function to iterate through the node tree
 // it returns the node ids of every node that produces values to subscribe to
-func (client *Client) browse(node *opcua.Node, level int, path string) error {
+// the attributes, properties and snapshot settings of the root node are inherited
+func (client *Client) browse(node *opcua.Node, level int, path string, rootCfg *Node) error {
 
 	var opcuaClient = client.opcua
 	var config = client.config
@@ -442,18 +511,36 @@ func (client *Client) browse(node *opcua.Node, level int, path string) error {
 
 		path = join(path, browseName)
 
+		nodeObject := &Node{
+			Attributes:        rootCfg.Attributes,
+			Properties:        rootCfg.Properties,
+			Snapshot:          rootCfg.Snapshot,
+			Transform:         rootCfg.Transform,
+			ReportByException: rootCfg.ReportByException,
+			Object:            opcuaClient.Node(node.ID),
+			Path:              path,
+			Name:              attrs[1].Value.String(),
+			NodeId:            node.ID,
+			ID:                node.ID.String(),
+		}
+		nodeObject.Label = nodeObject.Name
+
+		if rootCfg.Snapshot {
+			client.nodesToSnapshot = append(client.nodesToSnapshot, nodeObject)
+		}
+
 		//Only add nodes that have data
 		if getDataType(attrs[0]) != "" {
-			nodeObject := &Node{}
 			logp.Info("Add new node to list: ID: %v| Type %v| Name %v", node.ID.String(), getDataType(attrs[0]), attrs[1].Value.String())
 
-			nodeObject.Object = opcuaClient.Node(node.ID)
-			nodeObject.Path = path
-			nodeObject.Name = attrs[1].Value.String()
 			nodeObject.DataType = getDataType(attrs[0])
-			nodeObject.NodeId = node.ID
-			nodeObject.ID = node.ID.String()
-			nodeObject.Label = nodeObject.Name
+			if config.ServerEnums {
+				client.resolveEnum(nodeObject)
+			}
+			if err := client.resolveExtras(nodeObject); err != nil {
+				logp.Error(err)
+				logp.Debug("Browse", err.Error())
+			}
 
 			client.nodesToCollect = append(client.nodesToCollect, nodeObject)
 		}
@@ -462,7 +549,7 @@ func (client *Client) browse(node *opcua.Node, level int, path string) error {
 	children := findChildren(node, 0)
 
 	for i, child := range children {
-		err := client.browse(child, level+1, path)
+		err := client.browse(child, level+1, path, rootCfg)
 		if err != nil {
 			logp.Error(err)
 			logp.Debug("Browse", err.Error())
@@ -0,0 +1,229 @@
+package nodevalue
+
+import (
+	"github.com/elastic/beats/v7/libbeat/common"
+	"github.com/elastic/beats/v7/libbeat/logp"
+	"github.com/elastic/beats/v7/metricbeat/mb"
+
+	"github.com/gopcua/opcua/id"
+	"github.com/gopcua/opcua/ua"
+
+	"fmt"
+	"strconv"
+	"time"
+)
+
+// Method is a method that is called periodically. The output arguments and
+// the status of every call are published as an event.
+type Method struct {
+	Name           string        `config:"name"`
+	ObjectID       string        `config:"objectId"`
+	MethodID       string        `config:"methodId"`
+	InputArguments []Argument    `config:"inputArguments"`
+	Interval       time.Duration `config:"interval"`
+
+	objectID    *ua.NodeID
+	methodID    *ua.NodeID
+	inputs      []*ua.Variant
+	outputNames []string
+	lastCall    time.Time
+}
+
+// Argument is a typed input argument of a method call. The types use the same
+// names as value.datatype, e.g. int32, float64 or string.
+type Argument struct {
+	Type  string      `config:"type"`
+	Value interface{} `config:"value"`
+}
+
+type MethodResponse struct {
+	method *Method
+	result *ua.CallMethodResult
+	err    error
+}
+
+// prepareMethods parses the configured methods and reads the names of their
+// output arguments.
+func (client *Client) prepareMethods() error {
+	for i := range client.config.Methods {
+		method := &client.config.Methods[i]
+
+		objectID, err := ua.ParseNodeID(method.ObjectID)
+		if err != nil {
+			return fmt.Errorf("method %v: invalid objectId: %v", method.Name, err)
+		}
+		methodID, err := ua.ParseNodeID(method.MethodID)
+		if err != nil {
+			return fmt.Errorf("method %v: invalid methodId: %v", method.Name, err)
+		}
+		method.objectID = objectID
+		method.methodID = methodID
+		if method.Name == "" {
+			method.Name = method.MethodID
+		}
+
+		method.inputs = nil
+		for _, arg := range method.InputArguments {
+			v, err := argumentVariant(arg)
+			if err != nil {
+				return fmt.Errorf("method %v: %v", method.Name, err)
+			}
+			method.inputs = append(method.inputs, v)
+		}
+
+		method.outputNames = client.outputArgumentNames(methodID)
+	}
+	return nil
+}
+
+// outputArgumentNames reads the OutputArguments property of a method. If the
+// property can't be read the outputs are published by their index.
+func (client *Client) outputArgumentNames(methodID *ua.NodeID) []string {
+	var names []string
+
+	refs, err := client.opcua.Node(methodID).References(id.HasProperty, ua.BrowseDirectionForward, ua.NodeClassVariable, true)
+	if err != nil {
+		logp.Debug("Method", err.Error())
+		return names
+	}
+	for _, ref := range refs {
+		if ref.BrowseName == nil || ref.BrowseName.Name != "OutputArguments" {
+			continue
+		}
+		value, err := client.opcua.Node(ref.NodeID.NodeID).Value()
+		if err != nil {
+			logp.Debug("Method", err.Error())
+			return names
+		}
+		if extObjs, ok := value.Value().([]*ua.ExtensionObject); ok {
+			for _, extObj := range extObjs {
+				if arg, ok := extObj.Value.(*ua.Argument); ok {
+					names = append(names, arg.Name)
+				}
+			}
+		}
+	}
+	return names
+}
+
+// argumentVariant converts a configured argument into a variant of its type.
+func argumentVariant(arg Argument) (*ua.Variant, error) {
+	s := fmt.Sprint(arg.Value)
+	var value interface{}
+	var err error
+
+	switch arg.Type {
+	case "bool":
+		value, err = strconv.ParseBool(s)
+	case "int8":
+		var v int64
+		v, err = strconv.ParseInt(s, 10, 8)
+		value = int8(v)
+	case "byte":
+		var v uint64
+		v, err = strconv.ParseUint(s, 10, 8)
+		value = byte(v)
+	case "int16":
+		var v int64
+		v, err = strconv.ParseInt(s, 10, 16)
+		value = int16(v)
+	case "uint16":
+		var v uint64
+		v, err = strconv.ParseUint(s, 10, 16)
+		value = uint16(v)
+	case "int32":
+		var v int64
+		v, err = strconv.ParseInt(s, 10, 32)
+		value = int32(v)
+	case "uint32":
+		var v uint64
+		v, err = strconv.ParseUint(s, 10, 32)
+		value = uint32(v)
+	case "int64":
+		value, err = strconv.ParseInt(s, 10, 64)
+	case "uint64":
+		value, err = strconv.ParseUint(s, 10, 64)
+	case "float32":
+		var v float64
+		v, err = strconv.ParseFloat(s, 32)
+		value = float32(v)
+	case "float64":
+		value, err = strconv.ParseFloat(s, 64)
+	case "string", "":
+		value = s
+	case "time.Time":
+		value, err = time.Parse(time.RFC3339, s)
+	case "nodeId":
+		value, err = ua.ParseNodeID(s)
+	default:
+		return nil, fmt.Errorf("unsupported argument type %v", arg.Type)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("invalid %v argument %q: %v", arg.Type, s, err)
+	}
+	return ua.NewVariant(value)
+}
+
+// callMethods calls every method whose interval has passed.
+func (client *Client) callMethods() []*MethodResponse {
+	var retVal []*MethodResponse
+
+	for i := range client.config.Methods {
+		method := &client.config.Methods[i]
+		if time.Since(method.lastCall) < method.Interval {
+			continue
+		}
+		method.lastCall = time.Now()
+
+		logp.Debug("Method", "Calling method %v", method.Name)
+		req := &ua.CallMethodRequest{
+			ObjectID:       method.objectID,
+			MethodID:       method.methodID,
+			InputArguments: method.inputs,
+		}
+		result, err := client.opcua.CallWithContext(client.ctx, req)
+		retVal = append(retVal, &MethodResponse{method: method, result: result, err: err})
+	}
+	return retVal
+}
+
+func publishMethodResponses(data []*MethodResponse, report mb.ReporterV2, config *MetricSet) {
+	for _, response := range data {
+		var mbEvent mb.Event
+		root := make(common.MapStr)
+
+		root.Put("event.provider", "opcua")
+		root.Put("event.url", config.Endpoint)
+		root.Put("event.creation", time.Now())
+		root.Put("event.dataset", response.method.Name)
+
+		root.Put("method.name", response.method.Name)
+		root.Put("method.object_id", response.method.ObjectID)
+		root.Put("method.method_id", response.method.MethodID)
+
+		if response.err != nil {
+			root.Put("event.outcome", "failure")
+			root.Put("method.status", response.err.Error())
+		} else {
+			if response.result.StatusCode == ua.StatusOK {
+				root.Put("event.outcome", "success")
+			} else {
+				root.Put("event.outcome", "failure")
+			}
+			root.Put("method.status", response.result.StatusCode.Error())
+
+			for i, output := range response.result.OutputArguments {
+				name := strconv.Itoa(i)
+				if i < len(response.method.outputNames) && response.method.outputNames[i] != "" {
+					name = response.method.outputNames[i]
+				}
+				if value := attributeValue(ua.AttributeIDValue, &ua.DataValue{Value: output}); value != nil {
+					root.Put("method.outputs."+fieldName(name), value)
+				}
+			}
+		}
+
+		mbEvent.RootFields = root
+		report.Event(mbEvent)
+	}
+}
@@ -8,6 +8,8 @@ import (
 	"github.com/elastic/beats/v7/libbeat/common"
 	"github.com/elastic/beats/v7/libbeat/common/cfgwarn"
 	"github.com/elastic/beats/v7/metricbeat/mb"
+	"github.com/elastic/machinebeat/helper/change"
+	"github.com/elastic/machinebeat/helper/typed"
 
 	"context"
 	"errors"
@@ -15,6 +17,7 @@ import (
 	"math"
 	"reflect"
 
+	"github.com/gopcua/opcua/ua"
 	"golang.org/x/sync/semaphore"
 )
 
@@ -32,22 +35,27 @@ func init() {
 // interface methods except for Fetch.
 type MetricSet struct {
 	mb.BaseMetricSet
-	Endpoint            string       `config:"endpoint"`
-	Nodes               []Node       `config:"nodes"`
-	Browse              Browse       `config:"browse"`
-	RetryOnErrorCount   int          `config:"retryOnError"`
-	MaxThreads          int          `config:"maxThreads"`
-	MaxTriesToReconnect int          `config:"maxTriesToReconnect"`
-	Subscribe           bool         `config:"subscribe"`
-	Subscription        Subscription `config:"subscription"`
-	Monitoring          Monitoring   `config:"monitoring"`
-	Username            string       `config:"username"`
-	Password            string       `config:"password"`
-	Policy              string       `config:"policy"`
-	Mode                string       `config:"securityMode"`
-	ClientCert          string       `config:"clientCert"`
-	ClientKey           string       `config:"clientKey"`
-	AppName             string       `config:"appName"`
+	Endpoint            string        `config:"endpoint"`
+	Nodes               []Node        `config:"nodes"`
+	Browse              Browse        `config:"browse"`
+	RetryOnErrorCount   int           `config:"retryOnError"`
+	MaxThreads          int           `config:"maxThreads"`
+	MaxTriesToReconnect int           `config:"maxTriesToReconnect"`
+	Subscribe           bool          `config:"subscribe"`
+	Subscription        Subscription  `config:"subscription"`
+	Monitoring          Monitoring    `config:"monitoring"`
+	SnapshotInterval    time.Duration `config:"snapshotInterval"`
+	MaxNodesPerRead     int           `config:"maxNodesPerRead"`
+	Methods             []Method      `config:"methods"`
+	ServerEnums         bool          `config:"serverEnums"`
+	ReportByException   change.Config `config:"reportByException"`
+	Username            string        `config:"username"`
+	Password            string        `config:"password"`
+	Policy              string        `config:"policy"`
+	Mode                string        `config:"securityMode"`
+	ClientCert          string        `config:"clientCert"`
+	ClientKey           string        `config:"clientKey"`
+	AppName             string        `config:"appName"`
 	Client              Client
 	LegacyFields        bool `config:"legacyFields"`
 	ECSFields           bool `config:"ECSFields"`
@@ -125,6 +133,10 @@ var DefaultConfig = MetricSet{
 	Debug:               false,
 	Subscription:        subscriptionDefaults,
 	Monitoring:          monitoringDefaults,
+	SnapshotInterval:    1 * time.Hour,
+	MaxNodesPerRead:     1000,
+	Methods:             []Method{},
+	ServerEnums:         false,
 }
 
 // New creates a new instance of the MetricSet. New is responsible for unpacking
@@ -159,16 +171,26 @@ func New(base mb.BaseMetricSet) (mb.MetricSet, error) {
 		Debug:               config.Debug,
 		Subscription:        config.Subscription,
 		Monitoring:          config.Monitoring,
+		SnapshotInterval:    config.SnapshotInterval,
+		MaxNodesPerRead:     config.MaxNodesPerRead,
+		Methods:             config.Methods,
+		ServerEnums:         config.ServerEnums,
+		ReportByException:   config.ReportByException,
 	}
 
 	metricset.Client.counter = metricset.MaxTriesToReconnect
 	metricset.Client.config = metricset
+	metricset.Client.changes = change.NewDetector()
 
 	_, err := establishConnection(metricset, 1)
 	if err != nil {
 		return nil, err
 	}
 
+	if err := metricset.Client.prepareMethods(); err != nil {
+		return nil, err
+	}
+
 	//Check if browsing is activated in general.
 	//	If yes the collection will be started after browsing
 	//	If no the collection will be started with the configured nodes directly
@@ -239,11 +261,39 @@ func collect(m *MetricSet, report mb.ReporterV2) error {
 		return err
 	}
 
+	handleCounter(len(data), m.MaxTriesToReconnect, m)
+	applyTransforms(data)
+	data = m.Client.reportByException(data)
 	publishResponses(data, report, m)
 	logp.Debug("Collector", "Event collector instance finished sucessfully.")
 	return nil
 }
 
+// reportByException drops the values that did not change since they were last
+// published. This is only used for polling, in subscribe mode the server reports
+// changes only.
+func (client *Client) reportByException(data []*ResponseObject) []*ResponseObject {
+	var retVal []*ResponseObject
+	now := time.Now()
+	for _, response := range data {
+		config := response.node.ReportByException
+		if config == nil {
+			config = &client.config.ReportByException
+		}
+		var value interface{}
+		if response.transformed != nil {
+			value = response.transformed
+		} else if response.value.Value != nil {
+			value = response.value.Value.Value()
+		}
+		if client.changes.Report(config, response.node.ID, value, response.value.Status.Error(), now) {
+			retVal = append(retVal, response)
+		}
+	}
+	logp.Debug("Collector", "%v of %v values changed", len(retVal), len(data))
+	return retVal
+}
+
 func handleCounter(eventCount int, resetValue int, config *MetricSet) {
 	if eventCount == 0 {
 		config.Client.counter = config.Client.counter - 1
@@ -258,13 +308,17 @@ func handleCounter(eventCount int, resetValue int, config *MetricSet) {
 
 func publishResponses(data []*ResponseObject, report mb.ReporterV2, config *MetricSet) {
 	logp.Info("[OPCUA] Publishing %v new events", len(data))
-	handleCounter(len(data), config.MaxTriesToReconnect, config)
 	for _, response := range data {
 		var mbEvent mb.Event
 		event := make(common.MapStr)
 		module := make(common.MapStr)
 		root := make(common.MapStr)
 
+		//Nodes without value attribute, like objects, are only part of snapshots
+		if response.value == nil {
+			response.value = &ua.DataValue{Status: ua.StatusOK}
+		}
+
 		//Publish the event with the legacy field schema
 		if config.LegacyFields {
 			if response.value.Status == 0 {
@@ -274,7 +328,10 @@ func publishResponses(data []*ResponseObject, report mb.ReporterV2, config *Metr
 			}
 			event.Put("created", response.value.SourceTimestamp.String())
 
-			if response.value.Value != nil {
+			if response.transformed != nil {
+				event.Put("value", response.transformed)
+				event.Put("raw", response.value.Value.Value())
+			} else if response.value.Value != nil {
 				if response.node.DataType != "" {
 					if response.node.DataType == "float64" {
 						if !isArray(response.value.Value.Value()) {
@@ -291,6 +348,9 @@ func publishResponses(data []*ResponseObject, report mb.ReporterV2, config *Metr
 			}
 			module.Put("node", response.node)
 			module.Put("endpoint", config.Endpoint)
+			if response.extras != nil {
+				event.DeepUpdate(response.extras)
+			}
 
 		}
 
@@ -304,9 +364,23 @@ func publishResponses(data []*ResponseObject, report mb.ReporterV2, config *Metr
 			root.Put("sensor.id", response.node.ID)
 			root.Put("sensor.name", response.node.Name)
 			root.Put("sensor.label", response.node.Label)
+			if response.extras != nil {
+				sensor, _ := root.GetValue("sensor")
+				sensor.(common.MapStr).DeepUpdate(response.extras)
+			}
+			if response.snapshot {
+				root.Put("event.kind", "state")
+			}
 
 			root.Put("value.source_timestamp", response.value.SourceTimestamp.String())
-			if response.value.Value != nil {
+			if unit := response.node.Transform.OutputUnit(); unit != "" {
+				root.Put("value.unit", unit)
+			}
+			if response.transformed != nil {
+				//The raw value is kept next to the transformed value
+				root.Put("value.raw", response.value.Value.Value())
+				typed.Put(root, response.transformed)
+			} else if response.value.Value != nil {
 				if response.node.DataType != "" {
 					root.Put("value.datatype", response.node.DataType)
 					if response.node.DataType == "float64" {
@@ -337,13 +411,32 @@ func publishResponses(data []*ResponseObject, report mb.ReporterV2, config *Metr
 // of an error set the Error field of mb.Event or simply call report.Error().
 func (m *MetricSet) Fetch(report mb.ReporterV2) error {
 	if m.Client.connected {
+		if m.Client.snapshotDue() {
+			snapshots, err := m.Client.collectSnapshots()
+			if err != nil {
+				logp.Error(err)
+			} else {
+				applyTransforms(snapshots)
+				publishResponses(snapshots, report, m)
+			}
+		}
+		if len(m.Methods) > 0 {
+			publishMethodResponses(m.Client.callMethods(), report, m)
+		}
 		if m.Subscribe {
+			extras, err := m.Client.readExtras()
+			if err != nil {
+				logp.Error(err)
+			}
 			var data []*ResponseObject
 			for {
 				select {
 				case response := <-m.Client.subscription:
+					response.extras = extras[response.node.ID]
 					data = append(data, response)
 				default:
+					handleCounter(len(data), m.MaxTriesToReconnect, m)
+					applyTransforms(data)
 					publishResponses(data, report, m)
 					return nil
 				}
@@ -368,6 +461,8 @@ func (m *MetricSet) Fetch(report mb.ReporterV2) error {
 			logp.Info("[OPCUA] Reconnect was not successful")
 			return err
 		}
+		//Publish every value again after a reconnect
+		m.Client.changes.Reset()
 		if m.Subscribe {
 			m.Client.startSubscription()
 		}
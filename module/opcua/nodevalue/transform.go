@@ -0,0 +1,108 @@
+package nodevalue
+
+import (
+	"github.com/elastic/beats/v7/libbeat/logp"
+	"github.com/elastic/machinebeat/helper/transform"
+
+	"github.com/gopcua/opcua/id"
+	"github.com/gopcua/opcua/ua"
+
+	"strconv"
+)
+
+// resolveEnum reads the EnumStrings or EnumValues property of the node or of
+// its data type and uses it as enum mapping, unless an enum is configured.
+func (client *Client) resolveEnum(nodeCfg *Node) {
+	if nodeCfg.Transform != nil && len(nodeCfg.Transform.Enum) > 0 {
+		return
+	}
+	switch nodeCfg.DataType {
+	case "", "int8", "byte", "int16", "uint16", "int32", "uint32", "int64", "uint64":
+	default:
+		return
+	}
+
+	enum := client.readEnum(nodeCfg.NodeId)
+	if enum == nil {
+		dataType, err := client.opcua.Node(nodeCfg.NodeId).Attribute(ua.AttributeIDDataType)
+		if err != nil || dataType.NodeID() == nil {
+			return
+		}
+		//Built-in data types have no enum strings
+		if dataType.NodeID().Namespace() == 0 && dataType.NodeID().IntID() <= id.DiagnosticInfo {
+			return
+		}
+		enum = client.readEnum(dataType.NodeID())
+	}
+	if enum == nil {
+		return
+	}
+
+	logp.Debug("Append Information", "Use enum of node %v: %v", nodeCfg.ID, enum)
+	var config transform.Config
+	if nodeCfg.Transform != nil {
+		config = *nodeCfg.Transform
+	}
+	config.Enum = enum
+	nodeCfg.Transform = &config
+}
+
+func (client *Client) readEnum(nodeID *ua.NodeID) map[string]string {
+	refs, err := client.opcua.Node(nodeID).References(id.HasProperty, ua.BrowseDirectionForward, ua.NodeClassVariable, true)
+	if err != nil {
+		logp.Debug("Append Information", err.Error())
+		return nil
+	}
+
+	for _, ref := range refs {
+		if ref.BrowseName == nil || ref.NodeID == nil {
+			continue
+		}
+		if ref.BrowseName.Name != "EnumStrings" && ref.BrowseName.Name != "EnumValues" {
+			continue
+		}
+		value, err := client.opcua.Node(ref.NodeID.NodeID).Value()
+		if err != nil {
+			logp.Debug("Append Information", err.Error())
+			return nil
+		}
+
+		enum := make(map[string]string)
+		switch v := value.Value().(type) {
+		case []*ua.LocalizedText:
+			for i, text := range v {
+				enum[strconv.Itoa(i)] = text.Text
+			}
+		case []*ua.ExtensionObject:
+			for _, extObj := range v {
+				if enumValue, ok := extObj.Value.(*ua.EnumValueType); ok && enumValue.DisplayName != nil {
+					enum[strconv.FormatInt(enumValue.Value, 10)] = enumValue.DisplayName.Text
+				}
+			}
+		}
+		if len(enum) > 0 {
+			return enum
+		}
+	}
+	return nil
+}
+
+// applyTransforms converts the raw values of all responses with the transformations
+// configured for their nodes. The raw value is kept in the response.
+func applyTransforms(data []*ResponseObject) {
+	for _, response := range data {
+		if !response.node.Transform.Enabled() || response.value == nil || response.value.Value == nil {
+			continue
+		}
+		raw := response.value.Value.Value()
+		if raw == nil || isArray(raw) {
+			continue
+		}
+		transformed, err := response.node.Transform.Apply(raw)
+		if err != nil {
+			logp.Debug("Transform", "Node %v: %v", response.node.ID, err)
+			continue
+		}
+		response.transformed = transformed
+	}
+}
@@ -0,0 +1,341 @@
+package pubsub
+
+import (
+	"github.com/elastic/beats/v7/libbeat/logp"
+
+	MQTT "github.com/eclipse/paho.mqtt.golang"
+	"github.com/gopcua/opcua/ua"
+
+	"fmt"
+	"net"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+type Client struct {
+	subscription chan *ResponseObject
+	conn         *net.UDPConn
+	mqtt         MQTT.Client
+	config       *MetricSet
+	done         chan struct{}
+}
+
+type ResponseObject struct {
+	node    Node
+	value   *ua.DataValue
+	message *DataSetMessage
+	header  *NetworkMessage
+}
+
+// DataSetReader selects the DataSetMessages of one DataSetWriter and
+// describes the fields of the DataSet.
+type DataSetReader struct {
+	Name            string  `config:"name"`
+	PublisherId     string  `config:"publisherId"`
+	WriterGroupId   uint16  `config:"writerGroupId"`
+	DataSetWriterId uint16  `config:"dataSetWriterId"`
+	Fields          []Field `config:"fields"`
+}
+
+// Field is the metadata of a single field within a DataSet. The order of the
+// fields must match the order of the DataSet.
+type Field struct {
+	Name     string `config:"name"`
+	Label    string `config:"label"`
+	DataType string `config:"dataType"`
+}
+
+type Node struct {
+	ID       string
+	Label    string
+	Name     string
+	Path     string
+	DataType string
+}
+
+// findReader returns the DataSetReader that matches the given identifiers.
+// Identifiers that are not configured match every message.
+func findReader(readers []*DataSetReader, publisherId string, writerGroupId uint16, dataSetWriterId uint16) *DataSetReader {
+	for _, reader := range readers {
+		if reader.PublisherId != "" && reader.PublisherId != publisherId {
+			continue
+		}
+		if reader.WriterGroupId != 0 && writerGroupId != 0 && reader.WriterGroupId != writerGroupId {
+			continue
+		}
+		if reader.DataSetWriterId != 0 && reader.DataSetWriterId != dataSetWriterId {
+			continue
+		}
+		return reader
+	}
+	return nil
+}
+
+func (client *Client) connect() error {
+	var config = client.config
+
+	client.done = make(chan struct{})
+	if client.subscription == nil {
+		client.subscription = make(chan *ResponseObject, 50000)
+	}
+
+	u, err := url.Parse(config.URL)
+	if err != nil {
+		return err
+	}
+
+	switch u.Scheme {
+	case "opc.udp", "udp":
+		return client.listenUDP(u)
+	case "mqtt", "mqtts", "tcp", "ssl", "tls", "ws", "wss":
+		return client.connectMQTT(u)
+	}
+	return fmt.Errorf("unsupported PubSub transport %v", u.Scheme)
+}
+
+func (client *Client) listenUDP(u *url.URL) error {
+	var config = client.config
+
+	addr, err := net.ResolveUDPAddr("udp", u.Host)
+	if err != nil {
+		return err
+	}
+
+	if addr.IP != nil && addr.IP.IsMulticast() {
+		var ifi *net.Interface
+		if config.Interface != "" {
+			ifi, err = net.InterfaceByName(config.Interface)
+			if err != nil {
+				return err
+			}
+		}
+		logp.Info("[OPCUA] Join multicast group %v", addr)
+		client.conn, err = net.ListenMulticastUDP("udp", ifi, addr)
+	} else {
+		logp.Info("[OPCUA] Listen for UADP messages on %v", addr)
+		client.conn, err = net.ListenUDP("udp", addr)
+	}
+	if err != nil {
+		return err
+	}
+
+	go client.readUDP(client.conn)
+	return nil
+}
+
+func (client *Client) readUDP(conn *net.UDPConn) {
+	buf := make([]byte, 65535)
+	for {
+		n, _, err := conn.ReadFromUDP(buf)
+		if err != nil {
+			select {
+			case <-client.done:
+				logp.Info("[OPCUA] Stopped listening")
+				return
+			default:
+			}
+			logp.Error(err)
+			continue
+		}
+		msg, err := decodeUADP(buf[:n], client.config.Readers)
+		if err != nil {
+			logp.Debug("PubSub", "[OPCUA] Dropping NetworkMessage: %v", err)
+			continue
+		}
+		client.dispatch(msg)
+	}
+}
+
+func (client *Client) connectMQTT(u *url.URL) error {
+	var config = client.config
+
+	broker := *u
+	switch u.Scheme {
+	case "mqtt":
+		broker.Scheme = "tcp"
+	case "mqtts":
+		broker.Scheme = "ssl"
+	}
+	logp.Info("[OPCUA] Connect to broker URL: %s", broker.String())
+
+	opts := MQTT.NewClientOptions()
+	opts.AddBroker(broker.String())
+	opts.SetClientID(config.ClientID)
+	opts.SetAutoReconnect(true)
+	opts.SetMaxReconnectInterval(1 * time.Second)
+	opts.SetOnConnectHandler(client.subscribeOnConnect)
+	opts.SetConnectionLostHandler(func(c MQTT.Client, reason error) {
+		logp.Warn("[OPCUA] Connection to broker lost: %s", reason.Error())
+	})
+	if config.Username != "" {
+		opts.SetUsername(config.Username)
+		opts.SetPassword(config.Password)
+	}
+	if tlsConfig := config.SSL.ClientConfig(u.Hostname()); tlsConfig != nil {
+		opts.SetTLSConfig(tlsConfig)
+	}
+
+	client.mqtt = MQTT.NewClient(opts)
+	if token := client.mqtt.Connect(); token.Wait() && token.Error() != nil {
+		return token.Error()
+	}
+	return nil
+}
+
+func (client *Client) subscribeOnConnect(c MQTT.Client) {
+	subscriptions := make(map[string]byte)
+	for _, topic := range client.config.Topics {
+		subscriptions[topic] = byte(client.config.QoS)
+		logp.Info("[OPCUA] Subscribe to %v with QoS %v", topic, client.config.QoS)
+	}
+	if token := c.SubscribeMultiple(subscriptions, client.onMessage); token.Wait() && token.Error() != nil {
+		logp.Error(token.Error())
+	}
+}
+
+func (client *Client) onMessage(c MQTT.Client, m MQTT.Message) {
+	var msg *NetworkMessage
+	var err error
+	if client.config.Encoding == "uadp" {
+		msg, err = decodeUADP(m.Payload(), client.config.Readers)
+	} else {
+		msg, err = decodeJSON(m.Payload())
+	}
+	if err != nil {
+		logp.Debug("PubSub", "[OPCUA] Dropping NetworkMessage from topic %v: %v", m.Topic(), err)
+		return
+	}
+	client.dispatch(msg)
+}
+
+// dispatch maps the fields of every DataSetMessage to nodes and hands them
+// over to the next Fetch.
+func (client *Client) dispatch(msg *NetworkMessage) {
+	var config = client.config
+
+	for _, dsm := range msg.DataSetMessages {
+		reader := findReader(config.Readers, msg.PublisherId, msg.WriterGroupId, dsm.DataSetWriterId)
+		if reader == nil && len(config.Readers) > 0 {
+			continue
+		}
+
+		for i, value := range dsm.Values {
+			var field Field
+			if dsm.Names != nil {
+				field = Field{Name: dsm.Names[i]}
+				if reader != nil && len(reader.Fields) > 0 {
+					var found bool
+					for _, f := range reader.Fields {
+						if f.Name == field.Name {
+							field, found = f, true
+							break
+						}
+					}
+					if !found {
+						continue
+					}
+				}
+			} else {
+				index := dsm.Indexes[i]
+				if reader != nil && index < len(reader.Fields) {
+					field = reader.Fields[index]
+				} else {
+					field = Field{Name: strconv.Itoa(index)}
+				}
+			}
+
+			if value.SourceTimestamp.IsZero() {
+				value.SourceTimestamp = msg.Timestamp
+			}
+
+			var response ResponseObject
+			response.node = newNode(msg, dsm, reader, field, value)
+			response.value = value
+			response.message = dsm
+			response.header = msg
+			select {
+			case client.subscription <- &response:
+			default:
+				logp.Warn("[OPCUA] Too many buffered values. Increase the period or reduce the number of readers")
+				return
+			}
+		}
+	}
+}
+
+func newNode(msg *NetworkMessage, dsm *DataSetMessage, reader *DataSetReader, field Field, value *ua.DataValue) Node {
+	node := Node{
+		ID:       strings.Join([]string{msg.PublisherId, strconv.Itoa(int(msg.WriterGroupId)), strconv.Itoa(int(dsm.DataSetWriterId)), field.Name}, "/"),
+		Name:     field.Name,
+		Label:    field.Label,
+		DataType: field.DataType,
+	}
+	if node.Label == "" {
+		node.Label = node.Name
+	}
+	if reader != nil && reader.Name != "" {
+		node.Path = reader.Name + "." + field.Name
+	} else {
+		node.Path = field.Name
+	}
+	if value.Value != nil {
+		node.DataType = getDataType(value.Value)
+	}
+	return node
+}
+
+// getDataType returns the Go type name of the value. This is the same naming
+// the nodevalue metricset uses for value.datatype.
+func getDataType(v *ua.Variant) string {
+	if v.ArrayLength() > 0 {
+		return ""
+	}
+	switch v.Type() {
+	case ua.TypeIDDateTime:
+		return "time.Time"
+	case ua.TypeIDBoolean:
+		return "bool"
+	case ua.TypeIDSByte:
+		return "int8"
+	case ua.TypeIDInt16:
+		return "int16"
+	case ua.TypeIDInt32:
+		return "int32"
+	case ua.TypeIDInt64:
+		return "int64"
+	case ua.TypeIDByte:
+		return "byte"
+	case ua.TypeIDUint16:
+		return "uint16"
+	case ua.TypeIDUint32:
+		return "uint32"
+	case ua.TypeIDUint64:
+		return "uint64"
+	case ua.TypeIDString:
+		return "string"
+	case ua.TypeIDFloat:
+		return "float32"
+	case ua.TypeIDDouble:
+		return "float64"
+	}
+	return ""
+}
+
+func (client *Client) closeConnection() {
+	logp.Debug("Shutdown", "Will shutdown connection savely")
+	if client.done != nil {
+		close(client.done)
+		client.done = nil
+	}
+	if client.conn != nil {
+		client.conn.Close()
+		client.conn = nil
+	}
+	if client.mqtt != nil {
+		client.mqtt.Disconnect(250)
+		client.mqtt = nil
+	}
+	logp.Debug("Shutdown", "Shutdown successfully")
+}
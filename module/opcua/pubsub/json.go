@@ -0,0 +1,244 @@
+package pubsub
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"time"
+
+	"github.com/gopcua/opcua/ua"
+)
+
+// jsonNetworkMessage is the JSON NetworkMessage as defined in OPC UA Part 14, 7.2.3.2
+type jsonNetworkMessage struct {
+	MessageId   string               `json:"MessageId"`
+	MessageType string               `json:"MessageType"`
+	PublisherId json.RawMessage      `json:"PublisherId"`
+	Messages    []jsonDataSetMessage `json:"Messages"`
+}
+
+// jsonDataSetMessage is the JSON DataSetMessage as defined in OPC UA Part 14, 7.2.3.3
+type jsonDataSetMessage struct {
+	DataSetWriterId json.RawMessage            `json:"DataSetWriterId"`
+	SequenceNumber  uint16                     `json:"SequenceNumber"`
+	Timestamp       time.Time                  `json:"Timestamp"`
+	Status          uint32                     `json:"Status"`
+	MessageType     string                     `json:"MessageType"`
+	Payload         map[string]json.RawMessage `json:"Payload"`
+}
+
+// jsonDataValue covers the reversible and non-reversible DataValue encoding.
+type jsonDataValue struct {
+	Value           json.RawMessage `json:"Value"`
+	Status          *uint32         `json:"Status"`
+	SourceTimestamp time.Time       `json:"SourceTimestamp"`
+}
+
+// jsonVariant is the reversible Variant encoding.
+type jsonVariant struct {
+	Type *uint8          `json:"Type"`
+	Body json.RawMessage `json:"Body"`
+}
+
+// decodeJSON decodes a JSON NetworkMessage. Publishers may omit the
+// NetworkMessage header and send a single DataSetMessage instead.
+func decodeJSON(b []byte) (*NetworkMessage, error) {
+	var nm jsonNetworkMessage
+	if err := json.Unmarshal(b, &nm); err != nil {
+		return nil, err
+	}
+
+	var dsms []jsonDataSetMessage
+	if nm.Messages == nil {
+		if nm.MessageType != "" && nm.MessageType != "ua-data" {
+			// Metadata and discovery messages do not carry data
+			return &NetworkMessage{}, nil
+		}
+		var dsm jsonDataSetMessage
+		if err := json.Unmarshal(b, &dsm); err != nil {
+			return nil, err
+		}
+		dsms = append(dsms, dsm)
+	} else {
+		if nm.MessageType != "ua-data" {
+			return &NetworkMessage{}, nil
+		}
+		dsms = nm.Messages
+	}
+
+	msg := &NetworkMessage{
+		PublisherId: rawToString(nm.PublisherId),
+	}
+	for _, dsm := range dsms {
+		writerId, err := strconv.ParseUint(rawToString(dsm.DataSetWriterId), 10, 16)
+		if err != nil && len(dsm.DataSetWriterId) > 0 {
+			return nil, fmt.Errorf("invalid DataSetWriterId %s", dsm.DataSetWriterId)
+		}
+		decoded := &DataSetMessage{
+			DataSetWriterId: uint16(writerId),
+			SequenceNumber:  dsm.SequenceNumber,
+			Timestamp:       dsm.Timestamp,
+			Status:          ua.StatusCode(dsm.Status),
+			MessageType:     dsm.MessageType,
+		}
+		if decoded.MessageType == "" {
+			decoded.MessageType = "ua-keyframe"
+		}
+		for name, raw := range dsm.Payload {
+			dv, err := decodeJSONField(raw, decoded)
+			if err != nil {
+				return nil, fmt.Errorf("field %v: %v", name, err)
+			}
+			decoded.Names = append(decoded.Names, name)
+			decoded.Values = append(decoded.Values, dv)
+		}
+		msg.DataSetMessages = append(msg.DataSetMessages, decoded)
+	}
+	return msg, nil
+}
+
+// decodeJSONField decodes a field that is either encoded as DataValue, as
+// reversible Variant or as plain JSON value.
+func decodeJSONField(raw json.RawMessage, dsm *DataSetMessage) (*ua.DataValue, error) {
+	dv := &ua.DataValue{
+		EncodingMask:    ua.DataValueValue | ua.DataValueSourceTimestamp,
+		Status:          dsm.Status,
+		SourceTimestamp: dsm.Timestamp,
+	}
+
+	if bytes.HasPrefix(bytes.TrimSpace(raw), []byte("{")) {
+		var jdv jsonDataValue
+		if err := json.Unmarshal(raw, &jdv); err != nil {
+			return nil, err
+		}
+		if jdv.Value != nil {
+			if jdv.Status != nil {
+				dv.Status = ua.StatusCode(*jdv.Status)
+			}
+			if !jdv.SourceTimestamp.IsZero() {
+				dv.SourceTimestamp = jdv.SourceTimestamp
+			}
+			raw = jdv.Value
+		}
+	}
+
+	var value interface{}
+	var jv jsonVariant
+	if bytes.HasPrefix(bytes.TrimSpace(raw), []byte("{")) && json.Unmarshal(raw, &jv) == nil && jv.Type != nil {
+		v, err := decodeJSONVariant(ua.TypeID(*jv.Type), jv.Body)
+		if err != nil {
+			return nil, err
+		}
+		value = v
+	} else {
+		d := json.NewDecoder(bytes.NewReader(raw))
+		d.UseNumber()
+		if err := d.Decode(&value); err != nil {
+			return nil, err
+		}
+		value = plainJSONValue(value)
+	}
+
+	if value == nil {
+		dv.EncodingMask &^= ua.DataValueValue
+		return dv, nil
+	}
+	v, err := ua.NewVariant(value)
+	if err != nil {
+		return nil, err
+	}
+	dv.Value = v
+	return dv, nil
+}
+
+// decodeJSONVariant converts the body of a reversible Variant into the Go type
+// that matches its built-in type id.
+func decodeJSONVariant(typeID ua.TypeID, body json.RawMessage) (interface{}, error) {
+	var err error
+	switch typeID {
+	case ua.TypeIDBoolean:
+		var v bool
+		err = json.Unmarshal(body, &v)
+		return v, err
+	case ua.TypeIDSByte:
+		var v int8
+		err = json.Unmarshal(body, &v)
+		return v, err
+	case ua.TypeIDByte:
+		var v uint8
+		err = json.Unmarshal(body, &v)
+		return v, err
+	case ua.TypeIDInt16:
+		var v int16
+		err = json.Unmarshal(body, &v)
+		return v, err
+	case ua.TypeIDUint16:
+		var v uint16
+		err = json.Unmarshal(body, &v)
+		return v, err
+	case ua.TypeIDInt32:
+		var v int32
+		err = json.Unmarshal(body, &v)
+		return v, err
+	case ua.TypeIDUint32:
+		var v uint32
+		err = json.Unmarshal(body, &v)
+		return v, err
+	case ua.TypeIDInt64:
+		//Int64 and UInt64 are encoded as strings
+		var s string
+		if err = json.Unmarshal(body, &s); err != nil {
+			return nil, err
+		}
+		return strconv.ParseInt(s, 10, 64)
+	case ua.TypeIDUint64:
+		var s string
+		if err = json.Unmarshal(body, &s); err != nil {
+			return nil, err
+		}
+		return strconv.ParseUint(s, 10, 64)
+	case ua.TypeIDFloat:
+		var v float32
+		err = json.Unmarshal(body, &v)
+		return v, err
+	case ua.TypeIDDouble:
+		var v float64
+		err = json.Unmarshal(body, &v)
+		return v, err
+	case ua.TypeIDString:
+		var v string
+		err = json.Unmarshal(body, &v)
+		return v, err
+	case ua.TypeIDDateTime:
+		var v time.Time
+		err = json.Unmarshal(body, &v)
+		return v, err
+	}
+	// All other types are published as their JSON text
+	return string(body), nil
+}
+
+// plainJSONValue maps non-reversible JSON values to the closest built-in type.
+func plainJSONValue(value interface{}) interface{} {
+	switch v := value.(type) {
+	case json.Number:
+		if i, err := v.Int64(); err == nil {
+			return i
+		}
+		f, _ := v.Float64()
+		return f
+	case bool, string, nil:
+		return v
+	}
+	b, _ := json.Marshal(value)
+	return string(b)
+}
+
+func rawToString(raw json.RawMessage) string {
+	var s string
+	if err := json.Unmarshal(raw, &s); err == nil {
+		return s
+	}
+	return string(raw)
+}
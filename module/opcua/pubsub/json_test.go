@@ -0,0 +1,182 @@
+package pubsub
+
+import (
+	"sort"
+	"testing"
+	"time"
+
+	"github.com/gopcua/opcua/ua"
+)
+
+// sortFields orders the fields of JSON DataSetMessages by name, the decoder
+// returns them in the random order of the payload map.
+func sortFields(dsm *DataSetMessage) {
+	sort.Sort(byName{dsm})
+}
+
+type byName struct{ *DataSetMessage }
+
+func (s byName) Len() int           { return len(s.Names) }
+func (s byName) Less(i, j int) bool { return s.Names[i] < s.Names[j] }
+func (s byName) Swap(i, j int) {
+	s.Names[i], s.Names[j] = s.Names[j], s.Names[i]
+	s.Values[i], s.Values[j] = s.Values[j], s.Values[i]
+}
+
+func TestDecodeJSON(t *testing.T) {
+	tests := []struct {
+		name      string
+		input     string
+		publisher string
+		messages  []wantDataSetMessage
+	}{
+		{
+			name: "non-reversible NetworkMessage",
+			input: `{
+				"MessageId": "32235546-05d9-4fd7-97df-ea3ff3408574",
+				"MessageType": "ua-data",
+				"PublisherId": "MQTT-Localhost",
+				"Messages": [{
+					"DataSetWriterId": 62541,
+					"SequenceNumber": 12,
+					"Timestamp": "2023-04-19T14:21:42Z",
+					"Payload": {
+						"BoolToggle": true,
+						"Int32": 42,
+						"Double": 21.5,
+						"String": "running",
+						"Array": [1, 2]
+					}
+				}]
+			}`,
+			publisher: "MQTT-Localhost",
+			messages: []wantDataSetMessage{{
+				writerId:    62541,
+				sequence:    12,
+				messageType: "ua-keyframe",
+				timestamp:   testTimestamp,
+				names:       []string{"Array", "BoolToggle", "Double", "Int32", "String"},
+				values:      []interface{}{"[1,2]", true, 21.5, int64(42), "running"},
+			}},
+		},
+		{
+			name: "reversible variants",
+			input: `{
+				"MessageId": "1",
+				"MessageType": "ua-data",
+				"PublisherId": 7,
+				"Messages": [{
+					"DataSetWriterId": "3",
+					"MessageType": "ua-deltaframe",
+					"Payload": {
+						"Boolean": {"Type": 1, "Body": true},
+						"Byte": {"Type": 3, "Body": 200},
+						"Int16": {"Type": 4, "Body": -7},
+						"Int64": {"Type": 8, "Body": "-9007199254740993"},
+						"UInt64": {"Type": 9, "Body": "18446744073709551615"},
+						"Float": {"Type": 10, "Body": 1.5},
+						"DateTime": {"Type": 13, "Body": "2023-04-19T14:21:42Z"},
+						"Guid": {"Type": 14, "Body": "72962B91-FA75-4AE6-8D28-B404DC7DAF63"}
+					}
+				}]
+			}`,
+			publisher: "7",
+			messages: []wantDataSetMessage{{
+				writerId:    3,
+				messageType: "ua-deltaframe",
+				names:       []string{"Boolean", "Byte", "DateTime", "Float", "Guid", "Int16", "Int64", "UInt64"},
+				values: []interface{}{
+					true, uint8(200), testTimestamp, float32(1.5), `"72962B91-FA75-4AE6-8D28-B404DC7DAF63"`,
+					int16(-7), int64(-9007199254740993), uint64(18446744073709551615),
+				},
+			}},
+		},
+		{
+			name: "data values",
+			input: `{
+				"MessageType": "ua-data",
+				"Messages": [{
+					"DataSetWriterId": 1,
+					"Status": 2150957056,
+					"Timestamp": "2023-04-19T14:21:42Z",
+					"Payload": {
+						"Temperature": {"Value": {"Type": 11, "Body": 21.5}, "Status": 2150957056, "SourceTimestamp": "2023-04-19T14:21:42Z"},
+						"Pressure": {"Value": 1.2, "Status": 2150957056}
+					}
+				}]
+			}`,
+			messages: []wantDataSetMessage{{
+				writerId:    1,
+				messageType: "ua-keyframe",
+				timestamp:   testTimestamp,
+				status:      ua.StatusCode(0x80350000),
+				names:       []string{"Pressure", "Temperature"},
+				values:      []interface{}{1.2, 21.5},
+			}},
+		},
+		{
+			name:     "DataSetMessage without NetworkMessage header",
+			input:    `{"DataSetWriterId": 5, "SequenceNumber": 1, "Payload": {"Speed": 3}}`,
+			messages: []wantDataSetMessage{{writerId: 5, sequence: 1, messageType: "ua-keyframe", names: []string{"Speed"}, values: []interface{}{int64(3)}}},
+		},
+		{
+			name:  "null value",
+			input: `{"DataSetWriterId": 5, "Payload": {"Speed": null}}`,
+			messages: []wantDataSetMessage{{
+				writerId: 5, messageType: "ua-keyframe", names: []string{"Speed"}, values: []interface{}{nil},
+			}},
+		},
+		{
+			name:  "metadata",
+			input: `{"MessageId": "2", "MessageType": "ua-metadata", "PublisherId": "1", "MetaData": {}}`,
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			msg, err := decodeJSON([]byte(test.input))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if msg.PublisherId != test.publisher {
+				t.Errorf("got publisher %q, want %q", msg.PublisherId, test.publisher)
+			}
+			for _, dsm := range msg.DataSetMessages {
+				sortFields(dsm)
+			}
+			checkDataSetMessages(t, msg.DataSetMessages, test.messages)
+		})
+	}
+}
+
+func TestDecodeJSONFieldTimestamp(t *testing.T) {
+	msg, err := decodeJSON([]byte(`{"Payload": {"Speed": {"Value": 3, "SourceTimestamp": "2023-04-19T14:21:42Z"}}}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	dv := msg.DataSetMessages[0].Values[0]
+	if !dv.SourceTimestamp.Equal(testTimestamp) {
+		t.Errorf("got source timestamp %v, want %v", dv.SourceTimestamp, testTimestamp)
+	}
+	if dv.Status != ua.StatusOK {
+		t.Errorf("got status %v, want OK", dv.Status)
+	}
+	if !msg.DataSetMessages[0].Timestamp.Equal(time.Time{}) {
+		t.Errorf("got timestamp %v, want none", msg.DataSetMessages[0].Timestamp)
+	}
+}
+
+func TestDecodeJSONErrors(t *testing.T) {
+	tests := map[string]string{
+		"malformed":         `{"MessageType": "ua-data", "Messages": [`,
+		"not an object":     `[1, 2]`,
+		"DataSetWriterId":   `{"DataSetWriterId": "press", "Payload": {}}`,
+		"variant body":      `{"Payload": {"Speed": {"Type": 6, "Body": "fast"}}}`,
+		"Int64 body":        `{"Payload": {"Count": {"Type": 8, "Body": 12}}}`,
+		"truncated payload": `{"Payload": {"Speed": {"Value": 3`,
+	}
+	for name, input := range tests {
+		if msg, err := decodeJSON([]byte(input)); err == nil {
+			t.Errorf("%v: expected an error, got %+v", name, msg)
+		}
+	}
+}
@@ -0,0 +1,190 @@
+package pubsub
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"math"
+	"net/url"
+	"time"
+
+	"github.com/elastic/beats/v7/libbeat/common"
+	"github.com/elastic/beats/v7/libbeat/common/cfgwarn"
+	"github.com/elastic/beats/v7/libbeat/logp"
+	"github.com/elastic/beats/v7/metricbeat/mb"
+	"github.com/elastic/machinebeat/helper/ssl"
+)
+
+// init registers the MetricSet with the central registry as soon as the program
+// starts. The New function will be called later to instantiate an instance of
+// the MetricSet for each host defined in the module's configuration. After the
+// MetricSet has been created then Fetch will begin to be called periodically.
+func init() {
+	mb.Registry.MustAddMetricSet("opcua", "pubsub", New)
+}
+
+// MetricSet holds any configuration or state information. It must implement
+// the mb.MetricSet interface. And this is best achieved by embedding
+// mb.BaseMetricSet because it implements all of the required mb.MetricSet
+// interface methods except for Fetch.
+type MetricSet struct {
+	mb.BaseMetricSet
+	URL       string           `config:"url"`
+	Interface string           `config:"interface"`
+	Encoding  string           `config:"encoding"`
+	Topics    []string         `config:"topics"`
+	QoS       int              `config:"QoS"`
+	Username  string           `config:"username"`
+	Password  string           `config:"password"`
+	AppName   string           `config:"appName"`
+	ClientID  string           `config:"clientID"`
+	SSL       ssl.Config       `config:"ssl"`
+	Readers   []*DataSetReader `config:"dataSetReaders"`
+	Client    Client
+}
+
+var DefaultConfig = MetricSet{
+	URL:      "opc.udp://224.0.0.22:4840",
+	Encoding: "",
+	Topics:   []string{"opcua/#"},
+	QoS:      0,
+	AppName:  "machinebeat",
+	Readers:  []*DataSetReader{},
+}
+
+// New creates a new instance of the MetricSet. New is responsible for unpacking
+// any MetricSet specific configuration options if there are any.
+func New(base mb.BaseMetricSet) (mb.MetricSet, error) {
+	cfgwarn.Experimental("The OPCUA pubsub metricset is experimental.")
+
+	config := DefaultConfig
+	if err := base.Module().UnpackConfig(&config); err != nil {
+		return nil, err
+	}
+
+	u, err := url.Parse(config.URL)
+	if err != nil {
+		return nil, err
+	}
+	if config.Encoding == "" {
+		//UADP is the default for UDP and JSON the default for brokers
+		if u.Scheme == "opc.udp" || u.Scheme == "udp" {
+			config.Encoding = "uadp"
+		} else {
+			config.Encoding = "json"
+		}
+	}
+	if config.Encoding != "uadp" && config.Encoding != "json" {
+		return nil, errors.New("encoding must be uadp or json")
+	}
+	if config.ClientID == "" {
+		config.ClientID = defaultClientID(config.AppName)
+	}
+	if err := config.SSL.Load(); err != nil {
+		return nil, err
+	}
+
+	metricset := &MetricSet{
+		BaseMetricSet: base,
+		URL:           config.URL,
+		Interface:     config.Interface,
+		Encoding:      config.Encoding,
+		Topics:        config.Topics,
+		QoS:           config.QoS,
+		Username:      config.Username,
+		Password:      config.Password,
+		AppName:       config.AppName,
+		ClientID:      config.ClientID,
+		SSL:           config.SSL,
+		Readers:       config.Readers,
+	}
+	metricset.Client.config = metricset
+
+	if err := metricset.Client.connect(); err != nil {
+		return nil, err
+	}
+	return metricset, nil
+}
+
+// defaultClientID returns a client ID of the appName with a random suffix,
+// so that other instances and the mqtt module on the same broker don't take
+// over the session.
+func defaultClientID(appName string) string {
+	suffix := make([]byte, 4)
+	if _, err := rand.Read(suffix); err != nil {
+		return appName + "-pubsub"
+	}
+	return appName + "-pubsub-" + hex.EncodeToString(suffix)
+}
+
+func publishResponses(data []*ResponseObject, report mb.ReporterV2, config *MetricSet) {
+	logp.Info("[OPCUA] Publishing %v new events", len(data))
+	for _, response := range data {
+		var mbEvent mb.Event
+		event := make(common.MapStr)
+		root := make(common.MapStr)
+
+		root.Put("event.provider", "opcua")
+		root.Put("event.url", config.URL)
+		root.Put("event.creation", time.Now())
+		root.Put("event.dataset", response.node.Path)
+
+		root.Put("sensor.id", response.node.ID)
+		root.Put("sensor.name", response.node.Name)
+		root.Put("sensor.label", response.node.Label)
+
+		root.Put("value.source_timestamp", response.value.SourceTimestamp.String())
+		if response.value.Value != nil {
+			if response.node.DataType != "" {
+				root.Put("value.datatype", response.node.DataType)
+				if response.node.DataType == "float64" {
+					if !math.IsNaN(response.value.Value.Value().(float64)) {
+						root.Put("value.value_"+response.node.DataType, response.value.Value.Value())
+					}
+				} else {
+					root.Put("value.value_"+response.node.DataType, response.value.Value.Value())
+				}
+			} else {
+				root.Put("value.value", response.value.Value.Value())
+			}
+		}
+		if response.value.Status == 0 {
+			event.Put("state", "OK")
+		} else {
+			event.Put("state", "ERROR")
+			event.Put("status", response.value.Status.Error())
+		}
+
+		event.Put("publisher_id", response.header.PublisherId)
+		event.Put("writer_group_id", response.header.WriterGroupId)
+		event.Put("dataset_writer_id", response.message.DataSetWriterId)
+		event.Put("sequence_number", response.message.SequenceNumber)
+		event.Put("message_type", response.message.MessageType)
+
+		mbEvent.RootFields = root
+		mbEvent.MetricSetFields = event
+		report.Event(mbEvent)
+	}
+}
+
+// Fetch methods implements the data gathering and data conversion to the right
+// format. It publishes the event which is then forwarded to the output. In case
+// of an error set the Error field of mb.Event or simply call report.Error().
+func (m *MetricSet) Fetch(report mb.ReporterV2) error {
+	var data []*ResponseObject
+	for {
+		select {
+		case response := <-m.Client.subscription:
+			data = append(data, response)
+		default:
+			publishResponses(data, report, m)
+			return nil
+		}
+	}
+}
+
+// Close stops listening for NetworkMessages.
+func (m *MetricSet) Close() error {
+	m.Client.closeConnection()
+	return nil
+}
@@ -0,0 +1,358 @@
+package pubsub
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"time"
+
+	"github.com/gopcua/opcua/ua"
+)
+
+// Flags of the UADP NetworkMessage header as defined in OPC UA Part 14, 7.2.2.2
+const (
+	uadpVersionMask          = 0x0f
+	uadpPublisherIdEnabled   = 0x10
+	uadpGroupHeaderEnabled   = 0x20
+	uadpPayloadHeaderEnabled = 0x40
+	uadpExtendedFlags1       = 0x80
+
+	ext1PublisherIdTypeMask = 0x07
+	ext1DataSetClassId      = 0x08
+	ext1SecurityEnabled     = 0x10
+	ext1TimestampEnabled    = 0x20
+	ext1PicoSecondsEnabled  = 0x40
+	ext1ExtendedFlags2      = 0x80
+
+	ext2Chunk                 = 0x01
+	ext2PromotedFieldsEnabled = 0x02
+	ext2MessageTypeMask       = 0x1c
+
+	groupWriterGroupIdEnabled  = 0x01
+	groupVersionEnabled        = 0x02
+	groupNetworkMessageNumber  = 0x04
+	groupSequenceNumberEnabled = 0x08
+)
+
+// Flags of the UADP DataSetMessage header as defined in OPC UA Part 14, 7.2.2.3
+const (
+	dsValid                   = 0x01
+	dsFieldEncodingMask       = 0x06
+	dsSequenceNumberEnabled   = 0x08
+	dsStatusEnabled           = 0x10
+	dsMajorVersionEnabled     = 0x20
+	dsMinorVersionEnabled     = 0x40
+	dsFlags2Enabled           = 0x80
+	ds2MessageTypeMask        = 0x0f
+	ds2TimestampEnabled       = 0x10
+	ds2PicoSecondsEnabled     = 0x20
+	fieldEncodingVariant      = 0x00
+	fieldEncodingRawData      = 0x02
+	fieldEncodingDataValue    = 0x04
+	messageTypeKeyFrame       = 0x00
+	messageTypeDeltaFrame     = 0x01
+	messageTypeEvent          = 0x02
+	messageTypeKeepAlive      = 0x03
+	networkMessageTypeDataSet = 0x00
+)
+
+// NetworkMessage is the transport independent representation of a received
+// OPC UA PubSub NetworkMessage.
+type NetworkMessage struct {
+	PublisherId     string
+	WriterGroupId   uint16
+	SequenceNumber  uint16
+	Timestamp       time.Time
+	DataSetMessages []*DataSetMessage
+}
+
+// DataSetMessage holds the decoded fields of a single DataSetMessage.
+// Fields are identified by their index within the DataSet. The JSON encoding
+// identifies fields by name, in that case Names is filled instead.
+type DataSetMessage struct {
+	DataSetWriterId uint16
+	SequenceNumber  uint16
+	Timestamp       time.Time
+	Status          ua.StatusCode
+	MessageType     string
+	Indexes         []int
+	Names           []string
+	Values          []*ua.DataValue
+}
+
+// decodeUADP decodes a UADP NetworkMessage. Raw encoded fields can only be
+// decoded if a matching DataSetReader with field metadata is configured.
+func decodeUADP(b []byte, readers []*DataSetReader) (*NetworkMessage, error) {
+	buf := ua.NewBuffer(b)
+	msg := &NetworkMessage{}
+
+	flags := buf.ReadByte()
+	if version := flags & uadpVersionMask; version != 1 {
+		return nil, fmt.Errorf("unsupported UADP version %v", version)
+	}
+
+	var ext1, ext2 byte
+	if flags&uadpExtendedFlags1 != 0 {
+		ext1 = buf.ReadByte()
+	}
+	if ext1&ext1ExtendedFlags2 != 0 {
+		ext2 = buf.ReadByte()
+	}
+	if ext2&ext2Chunk != 0 {
+		return nil, errors.New("chunked NetworkMessages are not supported")
+	}
+	if (ext2&ext2MessageTypeMask)>>2 != networkMessageTypeDataSet {
+		// Discovery requests and responses do not carry data
+		return msg, nil
+	}
+
+	if flags&uadpPublisherIdEnabled != 0 {
+		switch ext1 & ext1PublisherIdTypeMask {
+		case 0:
+			msg.PublisherId = strconv.FormatUint(uint64(buf.ReadByte()), 10)
+		case 1:
+			msg.PublisherId = strconv.FormatUint(uint64(buf.ReadUint16()), 10)
+		case 2:
+			msg.PublisherId = strconv.FormatUint(uint64(buf.ReadUint32()), 10)
+		case 3:
+			msg.PublisherId = strconv.FormatUint(buf.ReadUint64(), 10)
+		case 4:
+			msg.PublisherId = buf.ReadString()
+		default:
+			return nil, fmt.Errorf("unsupported PublisherId type %v", ext1&ext1PublisherIdTypeMask)
+		}
+	}
+	if ext1&ext1DataSetClassId != 0 {
+		buf.ReadN(16)
+	}
+
+	if flags&uadpGroupHeaderEnabled != 0 {
+		groupFlags := buf.ReadByte()
+		if groupFlags&groupWriterGroupIdEnabled != 0 {
+			msg.WriterGroupId = buf.ReadUint16()
+		}
+		if groupFlags&groupVersionEnabled != 0 {
+			buf.ReadUint32()
+		}
+		if groupFlags&groupNetworkMessageNumber != 0 {
+			buf.ReadUint16()
+		}
+		if groupFlags&groupSequenceNumberEnabled != 0 {
+			msg.SequenceNumber = buf.ReadUint16()
+		}
+	}
+
+	var writerIds []uint16
+	if flags&uadpPayloadHeaderEnabled != 0 {
+		count := int(buf.ReadByte())
+		for i := 0; i < count; i++ {
+			writerIds = append(writerIds, buf.ReadUint16())
+		}
+	}
+
+	if ext1&ext1TimestampEnabled != 0 {
+		msg.Timestamp = buf.ReadTime()
+	}
+	if ext1&ext1PicoSecondsEnabled != 0 {
+		buf.ReadUint16()
+	}
+	if ext2&ext2PromotedFieldsEnabled != 0 {
+		size := buf.ReadUint16()
+		buf.ReadN(int(size))
+	}
+	if ext1&ext1SecurityEnabled != 0 {
+		return nil, errors.New("secured NetworkMessages are not supported")
+	}
+	if buf.Error() != nil {
+		return nil, buf.Error()
+	}
+
+	//Without payload header the message contains exactly one DataSetMessage
+	if len(writerIds) == 0 {
+		writerIds = []uint16{0}
+	}
+	sizes := make([]int, len(writerIds))
+	if len(writerIds) > 1 {
+		for i := range sizes {
+			sizes[i] = int(buf.ReadUint16())
+		}
+	} else {
+		sizes[0] = buf.Len()
+	}
+	if buf.Error() != nil {
+		return nil, buf.Error()
+	}
+
+	for i, writerId := range writerIds {
+		data := buf.ReadN(sizes[i])
+		if buf.Error() != nil {
+			return nil, buf.Error()
+		}
+		reader := findReader(readers, msg.PublisherId, msg.WriterGroupId, writerId)
+		dsm, err := decodeDataSetMessage(data, reader)
+		if err != nil {
+			return nil, fmt.Errorf("DataSetMessage of writer %v: %v", writerId, err)
+		}
+		if dsm == nil {
+			continue
+		}
+		dsm.DataSetWriterId = writerId
+		msg.DataSetMessages = append(msg.DataSetMessages, dsm)
+	}
+	return msg, nil
+}
+
+func decodeDataSetMessage(b []byte, reader *DataSetReader) (*DataSetMessage, error) {
+	buf := ua.NewBuffer(b)
+	dsm := &DataSetMessage{}
+
+	flags1 := buf.ReadByte()
+	if buf.Error() != nil {
+		return nil, buf.Error()
+	}
+	if flags1&dsValid == 0 {
+		return nil, nil
+	}
+	var flags2 byte
+	if flags1&dsFlags2Enabled != 0 {
+		flags2 = buf.ReadByte()
+	}
+	if flags1&dsSequenceNumberEnabled != 0 {
+		dsm.SequenceNumber = buf.ReadUint16()
+	}
+	if flags2&ds2TimestampEnabled != 0 {
+		dsm.Timestamp = buf.ReadTime()
+	}
+	if flags2&ds2PicoSecondsEnabled != 0 {
+		buf.ReadUint16()
+	}
+	if flags1&dsStatusEnabled != 0 {
+		//The header only carries the severity and sub code (upper 16 bit)
+		dsm.Status = ua.StatusCode(uint32(buf.ReadUint16()) << 16)
+	}
+	if flags1&dsMajorVersionEnabled != 0 {
+		buf.ReadUint32()
+	}
+	if flags1&dsMinorVersionEnabled != 0 {
+		buf.ReadUint32()
+	}
+
+	encoding := flags1 & dsFieldEncodingMask
+	messageType := flags2 & ds2MessageTypeMask
+	switch messageType {
+	case messageTypeKeyFrame:
+		dsm.MessageType = "keyframe"
+	case messageTypeDeltaFrame:
+		dsm.MessageType = "deltaframe"
+	case messageTypeEvent:
+		dsm.MessageType = "event"
+	case messageTypeKeepAlive:
+		dsm.MessageType = "keepalive"
+		return dsm, buf.Error()
+	default:
+		return nil, fmt.Errorf("unsupported DataSetMessage type %v", messageType)
+	}
+
+	if encoding == fieldEncodingRawData {
+		if reader == nil || len(reader.Fields) == 0 {
+			return nil, errors.New("raw encoded fields require a DataSetReader with field metadata")
+		}
+		if messageType != messageTypeKeyFrame {
+			return nil, errors.New("raw encoding is only supported for key frames")
+		}
+		for i, field := range reader.Fields {
+			value := decodeRaw(buf, field.DataType)
+			if buf.Error() != nil {
+				return nil, buf.Error()
+			}
+			if value == nil {
+				return nil, fmt.Errorf("unsupported data type %q for raw encoded field %v", field.DataType, field.Name)
+			}
+			dv, err := newDataValue(value, dsm)
+			if err != nil {
+				return nil, err
+			}
+			dsm.Indexes = append(dsm.Indexes, i)
+			dsm.Values = append(dsm.Values, dv)
+		}
+		return dsm, nil
+	}
+
+	count := int(buf.ReadUint16())
+	for i := 0; i < count; i++ {
+		index := i
+		if messageType == messageTypeDeltaFrame {
+			index = int(buf.ReadUint16())
+		}
+		var dv *ua.DataValue
+		switch encoding {
+		case fieldEncodingVariant:
+			v := new(ua.Variant)
+			buf.ReadStruct(v)
+			dv = &ua.DataValue{
+				EncodingMask:    ua.DataValueValue | ua.DataValueSourceTimestamp,
+				Value:           v,
+				Status:          dsm.Status,
+				SourceTimestamp: dsm.Timestamp,
+			}
+		case fieldEncodingDataValue:
+			dv = new(ua.DataValue)
+			buf.ReadStruct(dv)
+		default:
+			return nil, fmt.Errorf("unsupported field encoding %v", encoding)
+		}
+		if buf.Error() != nil {
+			return nil, buf.Error()
+		}
+		dsm.Indexes = append(dsm.Indexes, index)
+		dsm.Values = append(dsm.Values, dv)
+	}
+	return dsm, buf.Error()
+}
+
+func newDataValue(value interface{}, dsm *DataSetMessage) (*ua.DataValue, error) {
+	v, err := ua.NewVariant(value)
+	if err != nil {
+		return nil, err
+	}
+	return &ua.DataValue{
+		EncodingMask:    ua.DataValueValue | ua.DataValueSourceTimestamp,
+		Value:           v,
+		Status:          dsm.Status,
+		SourceTimestamp: dsm.Timestamp,
+	}, nil
+}
+
+// decodeRaw reads a single raw encoded value. The data types use the same
+// names the nodevalue metricset uses for value.datatype.
+func decodeRaw(buf *ua.Buffer, dataType string) interface{} {
+	switch dataType {
+	case "bool":
+		return buf.ReadBool()
+	case "int8":
+		return buf.ReadInt8()
+	case "byte":
+		return buf.ReadByte()
+	case "int16":
+		return buf.ReadInt16()
+	case "uint16":
+		return buf.ReadUint16()
+	case "int32":
+		return buf.ReadInt32()
+	case "uint32":
+		return buf.ReadUint32()
+	case "int64":
+		return buf.ReadInt64()
+	case "uint64":
+		return buf.ReadUint64()
+	case "float32":
+		return buf.ReadFloat32()
+	case "float64":
+		return buf.ReadFloat64()
+	case "string":
+		return buf.ReadString()
+	case "time.Time":
+		return buf.ReadTime()
+	}
+	return nil
+}
@@ -0,0 +1,245 @@
+package pubsub
+
+import (
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/gopcua/opcua/ua"
+)
+
+var testTimestamp = time.Date(2023, 4, 19, 14, 21, 42, 0, time.UTC)
+
+// wantDataSetMessage is the expected content of a decoded DataSetMessage.
+type wantDataSetMessage struct {
+	writerId    uint16
+	sequence    uint16
+	messageType string
+	timestamp   time.Time
+	status      ua.StatusCode
+	indexes     []int
+	names       []string
+	values      []interface{}
+}
+
+func checkDataSetMessages(t *testing.T, got []*DataSetMessage, want []wantDataSetMessage) {
+	t.Helper()
+	if len(got) != len(want) {
+		t.Fatalf("got %v DataSetMessages, want %v", len(got), len(want))
+	}
+	for i, dsm := range got {
+		w := want[i]
+		if dsm.DataSetWriterId != w.writerId || dsm.SequenceNumber != w.sequence || dsm.MessageType != w.messageType {
+			t.Errorf("DataSetMessage %v: got writer %v, sequence %v, type %v, want %v, %v, %v",
+				i, dsm.DataSetWriterId, dsm.SequenceNumber, dsm.MessageType, w.writerId, w.sequence, w.messageType)
+		}
+		if !dsm.Timestamp.Equal(w.timestamp) || dsm.Status != w.status {
+			t.Errorf("DataSetMessage %v: got timestamp %v, status %v, want %v, %v", i, dsm.Timestamp, dsm.Status, w.timestamp, w.status)
+		}
+		if !reflect.DeepEqual(dsm.Indexes, w.indexes) || !reflect.DeepEqual(dsm.Names, w.names) {
+			t.Errorf("DataSetMessage %v: got indexes %v, names %v, want %v, %v", i, dsm.Indexes, dsm.Names, w.indexes, w.names)
+		}
+		var values []interface{}
+		for _, dv := range dsm.Values {
+			if dv.Value == nil {
+				values = append(values, nil)
+				continue
+			}
+			values = append(values, dv.Value.Value())
+			if dv.Status != w.status {
+				t.Errorf("DataSetMessage %v: got value status %v, want %v", i, dv.Status, w.status)
+			}
+		}
+		if !reflect.DeepEqual(values, w.values) {
+			t.Errorf("DataSetMessage %v: got values %#v, want %#v", i, values, w.values)
+		}
+	}
+}
+
+// Test vectors of UADP NetworkMessages with the layout of OPC UA Part 14, 7.2.2
+var (
+	uadpGroupAndPayloadHeader = []byte{
+		0xf1,       // Version 1, PublisherId, GroupHeader, PayloadHeader, ExtendedFlags1
+		0x01,       // ExtendedFlags1: PublisherId type UInt16
+		0x01, 0x00, // PublisherId 1
+		0x09,       // GroupFlags: WriterGroupId, SequenceNumber
+		0x64, 0x00, // WriterGroupId 100
+		0x07, 0x00, // SequenceNumber 7
+		0x02,                   // PayloadHeader: 2 DataSetMessages
+		0x4d, 0xf4, 0x4e, 0xf4, // DataSetWriterIds 62541, 62542
+		0x0e, 0x00, 0x13, 0x00, // Sizes 14, 19
+		// DataSetMessage 1
+		0x09,       // Valid, Variant encoding, SequenceNumber
+		0x03, 0x00, // SequenceNumber 3
+		0x01, 0x00, // FieldCount 1
+		0x0b, 0x00, 0x00, 0x00, 0x00, 0x00, 0x80, 0x35, 0x40, // Double 21.5
+		// DataSetMessage 2
+		0x89,       // Valid, Variant encoding, SequenceNumber, Flags2
+		0x10,       // Flags2: key frame, Timestamp
+		0x04, 0x00, // SequenceNumber 4
+		0x00, 0x1f, 0x2b, 0x43, 0xca, 0x72, 0xd9, 0x01, // Timestamp
+		0x01, 0x00, // FieldCount 1
+		0x06, 0x2a, 0x00, 0x00, 0x00, // Int32 42
+	}
+	uadpRawData = []byte{
+		0x91,                   // Version 1, PublisherId, ExtendedFlags1
+		0x24,                   // ExtendedFlags1: PublisherId type String, Timestamp
+		0x04, 0x00, 0x00, 0x00, // PublisherId length 4
+		'c', 'e', 'l', 'l',
+		0x00, 0x1f, 0x2b, 0x43, 0xca, 0x72, 0xd9, 0x01, // Timestamp
+		// DataSetMessage
+		0x03,                   // Valid, RawData encoding
+		0x00, 0x00, 0xc0, 0x3f, // Float 1.5
+		0xf9, 0xff, // Int16 -7
+	}
+	uadpDataValue = []byte{
+		0x01,       // Version 1
+		0x15,       // Valid, DataValue encoding, Status
+		0x35, 0x80, // Status BadAttributeIdInvalid
+		0x01, 0x00, // FieldCount 1
+		0x03,       // DataValue with Value and Status
+		0x01, 0x01, // Boolean true
+		0x00, 0x00, 0x35, 0x80, // Status BadAttributeIdInvalid
+	}
+	uadpDeltaFrame = []byte{
+		0x01,       // Version 1
+		0x81,       // Valid, Variant encoding, Flags2
+		0x01,       // Flags2: delta frame
+		0x01, 0x00, // FieldCount 1
+		0x02, 0x00, // FieldIndex 2
+		0x0b, 0x00, 0x00, 0x00, 0x00, 0x00, 0x80, 0x35, 0x40, // Double 21.5
+	}
+)
+
+func TestDecodeUADP(t *testing.T) {
+	rawReaders := []*DataSetReader{{
+		PublisherId: "cell",
+		Fields: []Field{
+			{Name: "speed", DataType: "float32"},
+			{Name: "offset", DataType: "int16"},
+		},
+	}}
+	bad := ua.StatusCode(0x80350000)
+
+	tests := []struct {
+		name      string
+		input     []byte
+		readers   []*DataSetReader
+		publisher string
+		group     uint16
+		sequence  uint16
+		timestamp time.Time
+		messages  []wantDataSetMessage
+	}{
+		{
+			name:      "group and payload header",
+			input:     uadpGroupAndPayloadHeader,
+			publisher: "1",
+			group:     100,
+			sequence:  7,
+			messages: []wantDataSetMessage{
+				{writerId: 62541, sequence: 3, messageType: "keyframe", indexes: []int{0}, values: []interface{}{21.5}},
+				{writerId: 62542, sequence: 4, messageType: "keyframe", timestamp: testTimestamp, indexes: []int{0}, values: []interface{}{int32(42)}},
+			},
+		},
+		{
+			name:      "raw data",
+			input:     uadpRawData,
+			readers:   rawReaders,
+			publisher: "cell",
+			timestamp: testTimestamp,
+			messages: []wantDataSetMessage{
+				{messageType: "keyframe", indexes: []int{0, 1}, values: []interface{}{float32(1.5), int16(-7)}},
+			},
+		},
+		{
+			name:  "data value",
+			input: uadpDataValue,
+			messages: []wantDataSetMessage{
+				{messageType: "keyframe", status: bad, indexes: []int{0}, values: []interface{}{true}},
+			},
+		},
+		{
+			name:  "delta frame",
+			input: uadpDeltaFrame,
+			messages: []wantDataSetMessage{
+				{messageType: "deltaframe", indexes: []int{2}, values: []interface{}{21.5}},
+			},
+		},
+		{
+			name:     "keep alive",
+			input:    []byte{0x01, 0x81, 0x03},
+			messages: []wantDataSetMessage{{messageType: "keepalive"}},
+		},
+		{
+			name:  "invalid DataSetMessage",
+			input: []byte{0x01, 0x00},
+		},
+		{
+			name:  "discovery",
+			input: []byte{0x81, 0x80, 0x04},
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			msg, err := decodeUADP(test.input, test.readers)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if msg.PublisherId != test.publisher || msg.WriterGroupId != test.group || msg.SequenceNumber != test.sequence {
+				t.Errorf("got publisher %q, group %v, sequence %v, want %q, %v, %v",
+					msg.PublisherId, msg.WriterGroupId, msg.SequenceNumber, test.publisher, test.group, test.sequence)
+			}
+			if !msg.Timestamp.Equal(test.timestamp) {
+				t.Errorf("got timestamp %v, want %v", msg.Timestamp, test.timestamp)
+			}
+			checkDataSetMessages(t, msg.DataSetMessages, test.messages)
+		})
+	}
+}
+
+func TestDecodeUADPErrors(t *testing.T) {
+	tests := map[string][]byte{
+		"empty":                 {},
+		"version 2":             {0x02},
+		"chunk":                 {0x81, 0x80, 0x01},
+		"security":              {0x81, 0x10},
+		"PublisherId type":      {0x91, 0x05},
+		"raw without reader":    {0x01, 0x03, 0x00, 0x00, 0xc0, 0x3f},
+		"field encoding":        {0x01, 0x07, 0x01, 0x00},
+		"DataSetMessage type":   {0x01, 0x81, 0x04},
+		"raw delta frame":       {0x01, 0x83, 0x01, 0x00, 0x00, 0xc0, 0x3f},
+		"size beyond the input": {0x41, 0x02, 0x01, 0x00, 0x02, 0x00, 0x10, 0x00, 0x10, 0x00, 0x01},
+	}
+	readers := []*DataSetReader{{Fields: []Field{{Name: "speed", DataType: "float32"}}}}
+	for name, input := range tests {
+		readers := readers
+		if name == "raw without reader" {
+			readers = nil
+		}
+		if msg, err := decodeUADP(input, readers); err == nil {
+			t.Errorf("%v: expected an error, got %+v", name, msg)
+		}
+	}
+}
+
+func TestDecodeUADPTruncated(t *testing.T) {
+	readers := []*DataSetReader{{
+		Fields: []Field{
+			{Name: "speed", DataType: "float32"},
+			{Name: "offset", DataType: "int16"},
+		},
+	}}
+	for name, input := range map[string][]byte{
+		"group and payload header": uadpGroupAndPayloadHeader,
+		"raw data":                 uadpRawData,
+		"data value":               uadpDataValue,
+		"delta frame":              uadpDeltaFrame,
+	} {
+		for n := 0; n < len(input); n++ {
+			if msg, err := decodeUADP(input[:n], readers); err == nil {
+				t.Errorf("%v truncated to %v bytes: expected an error, got %+v", name, n, msg)
+			}
+		}
+	}
+}
@@ -2,6 +2,8 @@ package plc4xvalue
 
 import (
 	"github.com/elastic/beats/v7/libbeat/logp"
+	"github.com/elastic/machinebeat/helper/change"
+	"github.com/elastic/machinebeat/helper/transform"
 
 	"github.com/apache/plc4x/plc4go/pkg/api"
 	"github.com/apache/plc4x/plc4go/pkg/api/drivers"
@@ -10,6 +12,10 @@ import (
 
 	"errors"
 	"fmt"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
 )
 
 type Client struct {
@@ -19,17 +25,36 @@ type Client struct {
 	config    *MetricSet
 	connected bool
 	counter   int
+	changes   *change.Detector
+	tags      []tagState
+
+	subscription chan *ResponseObject
 }
 
 type ResponseObject struct {
-	node  Node
-	value values.PlcValue
+	node        Node
+	index       int
+	value       values.PlcValue
+	transformed interface{}
+	// status is the name of the response code of the tag
+	status string
+	// err is set if the tag wasn't read, requestFailed if the read request
+	// failed instead of the tag
+	err           error
+	requestFailed bool
 }
 
+// maxFailedSingleReads is the number of tags of a failed read request that
+// are read one by one before the connection is considered broken.
+const maxFailedSingleReads = 3
+
 type Node struct {
-	ID    string `config:"tag"`
-	Label string `config:"label"`
-	Name  string
+	ID                string            `config:"tag"`
+	Label             string            `config:"label"`
+	Transform         *transform.Config `config:"transform"`
+	ReportByException *change.Config    `config:"reportByException"`
+	Subscription      *Subscription     `config:"subscription"`
+	Name              string
 }
 
 func (client *Client) connect() (bool, error) {
@@ -71,46 +96,223 @@ func (client *Client) connect() (bool, error) {
 	return true, err
 }
 
-func (client *Client) read() ([]*ResponseObject, error) {
-	var retVal []*ResponseObject
+// driverLimits are the limits of the read requests of a driver.
+type driverLimits struct {
+	// maxTags is the number of tags per read request, 0 is unlimited
+	maxTags int
+	// concurrent reports whether read requests may be executed in parallel
+	concurrent bool
+}
+
+// limitsOfDrivers are the limits of the drivers. The S7 driver doesn't split
+// requests that exceed the PDU size of 240 bytes and queues requests up to
+// the number of parallel jobs of the PLC. The C-Bus driver only handles 20
+// tags per request. The Modbus driver sends one request per tag and mixes up
+// the responses of more than 255 pending requests, or of parallel read
+// requests which number their requests separately. Other drivers read all
+// tags with one request.
+var limitsOfDrivers = map[string]driverLimits{
+	"s7":         {maxTags: 18, concurrent: true},
+	"ads":        {maxTags: 500, concurrent: true},
+	"c-bus":      {maxTags: 20},
+	"modbus-tcp": {maxTags: 100},
+}
+
+// driverName returns the driver code of a PLC4X endpoint like s7 of
+// s7://host or ads of ads:tcp://host.
+func driverName(endpoint string) string {
+	name := endpoint
+	if i := strings.Index(name, "://"); i >= 0 {
+		name = name[:i]
+	}
+	if i := strings.Index(name, ":"); i >= 0 {
+		name = name[:i]
+	}
+	return strings.ToLower(name)
+}
+
+// chunks splits the indexes of the nodes into the read requests.
+func (client *Client) chunks(indexes []int) [][]int {
+	if len(indexes) == 0 {
+		return nil
+	}
+	size := client.config.MaxTagsPerRequest
+	if size <= 0 {
+		size = limitsOfDrivers[driverName(client.config.Endpoint)].maxTags
+	}
+	if size <= 0 || size >= len(indexes) {
+		return [][]int{indexes}
+	}
+	var chunks [][]int
+	for len(indexes) > size {
+		chunks = append(chunks, indexes[:size])
+		indexes = indexes[size:]
+	}
+	return append(chunks, indexes)
+}
 
+// read reads all enabled nodes with one read request per chunk. The chunks
+// are read concurrently if the driver supports parallel requests. Every node
+// has a response, nodes that weren't read have an error.
+func (client *Client) read() []*ResponseObject {
 	logp.Info("[PLC4x] Start read node values")
 
-	// Prepare a read-request
-	for _, node := range client.config.Nodes {
-		var response ResponseObject
+	now := time.Now()
+	chunks := client.chunks(client.enabledNodes(now))
+	results := make([][]*ResponseObject, len(chunks))
+
+	concurrent := 1
+	if limitsOfDrivers[driverName(client.config.Endpoint)].concurrent && client.config.MaxConcurrentRequests > 1 {
+		concurrent = client.config.MaxConcurrentRequests
+	}
+	limit := make(chan struct{}, concurrent)
+	var wg sync.WaitGroup
+	for i, chunk := range chunks {
+		wg.Add(1)
+		limit <- struct{}{}
+		go func(i int, chunk []int) {
+			defer wg.Done()
+			defer func() { <-limit }()
+			results[i] = client.readChunk(chunk)
+		}(i, chunk)
+	}
+	wg.Wait()
 
-		readRequest, err := client.connection.ReadRequestBuilder().
-			AddTagAddress("tag", node.ID).
-			Build()
+	var retVal []*ResponseObject
+	anyRead, requestFailed := false, false
+	for _, result := range results {
+		for _, response := range result {
+			anyRead = anyRead || response.err == nil
+			requestFailed = requestFailed || response.requestFailed
+		}
+		retVal = append(retVal, result...)
+	}
+
+	// If no tag could be read the connection is lost, which isn't a failure
+	// of the tags. The next Fetch reconnects.
+	lost := !anyRead && requestFailed
+	for _, response := range retVal {
+		client.recordResult(response, now, lost)
+	}
+	if lost {
+		logp.Info("[PLC4X] No tag could be read, the connection is closed")
+		client.closeConnection()
+	}
+	return retVal
+}
+
+// readChunk reads nodes with a single read request. The tags are named by
+// their position in the request, so the same address can be read twice.
+func (client *Client) readChunk(indexes []int) []*ResponseObject {
+	var retVal []*ResponseObject
+
+	// Prepare a read-request
+	readRequest, err := client.buildRequest(indexes)
+	if err != nil {
+		// A single invalid tag fails the request, it is reported on its own
+		// and the other tags are read without it
+		logp.Info("[PLC4x] Error preparing read-request: %v", err)
+		var valid []int
+		for _, index := range indexes {
+			if _, err := client.buildRequest([]int{index}); err != nil {
+				retVal = append(retVal, client.failed(index, model.PlcResponseCode_INVALID_ADDRESS, err))
+				continue
+			}
+			valid = append(valid, index)
+		}
+		if len(valid) == 0 {
+			return retVal
+		}
+		indexes = valid
+		readRequest, err = client.buildRequest(indexes)
 		if err != nil {
-			logp.Info("[PLC4x] Error preparing read-request")
-			return retVal, err
+			return append(retVal, client.requestFailed(indexes, err)...)
 		}
+	}
 
-		// Execute a read-request
-		rrc := readRequest.Execute()
+	// Execute a read-request
+	rrc := readRequest.Execute()
 
-		// Wait for the response to finish
-		rrr := <-rrc
-		if rrr.GetErr() != nil {
-			logp.Info("[PLC4x] Error executing read-request: %s", rrr.GetErr().Error())
-			return retVal, rrr.GetErr()
+	// Wait for the response to finish
+	rrr := <-rrc
+	if err := rrr.GetErr(); err != nil {
+		logp.Info("[PLC4x] Error executing read-request: %s", err.Error())
+		if !client.connection.IsConnected() {
+			return append(retVal, client.requestFailed(indexes, err)...)
+		}
+		if len(indexes) == 1 {
+			return append(retVal, client.requestFailed(indexes, err)...)
+		}
+		// Drivers like Modbus fail the whole request if a single tag
+		// fails, the tags are then read one by one. If none of the first
+		// tags can be read the connection is probably broken.
+		anyRead := false
+		for i, index := range indexes {
+			if !anyRead && i == maxFailedSingleReads {
+				return append(retVal, client.requestFailed(indexes[i:], err)...)
+			}
+			for _, response := range client.readChunk([]int{index}) {
+				anyRead = anyRead || response.err == nil
+				retVal = append(retVal, response)
+			}
 		}
+		return retVal
+	}
 
+	for i, index := range indexes {
 		// Do something with the response
-		if rrr.GetResponse().GetResponseCode("tag") != model.PlcResponseCode_OK {
-			fmt.Printf("error an non-ok return code: %s", rrr.GetResponse().GetResponseCode("tag").GetName())
-			return retVal, rrr.GetErr()
+		code := rrr.GetResponse().GetResponseCode(tagName(i))
+		if code != model.PlcResponseCode_OK {
+			err := fmt.Errorf("error reading tag %v: response code %v", client.config.Nodes[index].ID, code.GetName())
+			retVal = append(retVal, client.failed(index, code, err))
+			continue
 		}
 
-		response.node = node
-		response.value = rrr.GetResponse().GetValue("tag")
-		fmt.Printf("Got result %f", response.value.GetFloat32())
-		retVal = append(retVal, &response)
+		response := client.response(index, code)
+		response.value = rrr.GetResponse().GetValue(tagName(i))
+		retVal = append(retVal, response)
 	}
 
-	return retVal, nil
+	return retVal
+}
+
+// buildRequest builds the read request of nodes.
+func (client *Client) buildRequest(indexes []int) (model.PlcReadRequest, error) {
+	builder := client.connection.ReadRequestBuilder()
+	for i, index := range indexes {
+		builder.AddTagAddress(tagName(i), client.config.Nodes[index].ID)
+	}
+	return builder.Build()
+}
+
+func (client *Client) response(index int, code model.PlcResponseCode) *ResponseObject {
+	return &ResponseObject{
+		node:   client.config.Nodes[index],
+		index:  index,
+		status: code.GetName(),
+	}
+}
+
+// failed returns the response of a tag that wasn't read.
+func (client *Client) failed(index int, code model.PlcResponseCode, err error) *ResponseObject {
+	response := client.response(index, code)
+	response.err = err
+	return response
+}
+
+// requestFailed returns the responses of the tags of a failed read request.
+func (client *Client) requestFailed(indexes []int, err error) []*ResponseObject {
+	var retVal []*ResponseObject
+	for _, index := range indexes {
+		response := client.failed(index, model.PlcResponseCode_INTERNAL_ERROR, err)
+		response.requestFailed = true
+		retVal = append(retVal, response)
+	}
+	return retVal
+}
+
+func tagName(i int) string {
+	return "tag" + strconv.Itoa(i)
 }
 
 func (client *Client) closeConnection() {
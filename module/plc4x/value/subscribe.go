@@ -0,0 +1,201 @@
+package plc4xvalue
+
+import (
+	"github.com/elastic/beats/v7/libbeat/logp"
+
+	"github.com/apache/plc4x/plc4go/pkg/api/model"
+
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Subscription is how a tag is subscribed in subscribe mode.
+type Subscription struct {
+	// Mode is change for change-of-state, cyclic or event
+	Mode string `config:"mode"`
+	// Interval is the interval of cyclic subscriptions
+	Interval time.Duration `config:"interval"`
+}
+
+const (
+	subscribeChange = "change"
+	subscribeCyclic = "cyclic"
+	subscribeEvent  = "event"
+)
+
+func (s *Subscription) validate() error {
+	switch s.Mode {
+	case "", subscribeChange, subscribeEvent:
+	case subscribeCyclic:
+		if s.Interval < 0 {
+			return fmt.Errorf("invalid subscription interval %v", s.Interval)
+		}
+	default:
+		return fmt.Errorf("invalid subscription mode %v, use %v, %v or %v", s.Mode, subscribeChange, subscribeCyclic, subscribeEvent)
+	}
+	return nil
+}
+
+// subscriptionOf returns the subscription of a node. Settings the node
+// doesn't set are taken from the module.
+func (client *Client) subscriptionOf(node Node) Subscription {
+	subscription := client.config.Subscription
+	if node.Subscription != nil {
+		if node.Subscription.Mode != "" {
+			subscription.Mode = node.Subscription.Mode
+		}
+		if node.Subscription.Interval > 0 {
+			subscription.Interval = node.Subscription.Interval
+		}
+	}
+	return subscription
+}
+
+// startSubscription subscribes all nodes with a single subscription request.
+// The values of the events are buffered until the next Fetch publishes them.
+func (client *Client) startSubscription() error {
+	logp.Info("[PLC4X] Starting subscribe process")
+	if client.subscription == nil {
+		client.subscription = make(chan *ResponseObject, 50000)
+	}
+
+	indexes := make([]int, len(client.config.Nodes))
+	for i := range indexes {
+		indexes[i] = i
+	}
+	if len(indexes) == 0 {
+		return nil
+	}
+	if _, err := client.subscriptionRequestBuilder(); err != nil {
+		return err
+	}
+
+	request, err := client.buildSubscription(indexes)
+	if err != nil {
+		// Invalid tags are reported on their own like in read requests
+		logp.Info("[PLC4X] Error preparing subscription-request: %v", err)
+		var valid []int
+		for _, index := range indexes {
+			if _, err := client.buildSubscription([]int{index}); err != nil {
+				client.push(client.failed(index, model.PlcResponseCode_INVALID_ADDRESS, err))
+				continue
+			}
+			valid = append(valid, index)
+		}
+		if len(valid) == 0 {
+			return nil
+		}
+		indexes = valid
+		request, err = client.buildSubscription(indexes)
+		if err != nil {
+			return err
+		}
+	}
+
+	result := <-request.Execute()
+	if result.GetResponse() == nil {
+		return fmt.Errorf("error executing subscription-request: %v", result.GetErr())
+	}
+	if err := result.GetErr(); err != nil {
+		// Drivers that subscribe every tag on its own only fail the tags
+		logp.Info("[PLC4X] Error executing subscription-request: %v", err)
+	}
+
+	response := result.GetResponse()
+	subscribed := 0
+	for _, index := range indexes {
+		name := tagName(index)
+		code := response.GetResponseCode(name)
+		handle, err := response.GetSubscriptionHandle(name)
+		if code != model.PlcResponseCode_OK || err != nil {
+			if err == nil {
+				err = fmt.Errorf("error subscribing tag %v: response code %v", client.config.Nodes[index].ID, code.GetName())
+			}
+			client.push(client.failed(index, code, err))
+			continue
+		}
+		handle.Register(client.consume)
+		subscribed++
+	}
+
+	logp.Info("[PLC4X] Subscribed %v of %v tags", subscribed, len(client.config.Nodes))
+	return nil
+}
+
+// subscriptionRequestBuilder returns a subscription request builder of the
+// connection. Drivers without subscriptions panic.
+func (client *Client) subscriptionRequestBuilder() (builder model.PlcSubscriptionRequestBuilder, err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			err = fmt.Errorf("the %v driver doesn't support subscriptions: %v", driverName(client.config.Endpoint), r)
+		}
+	}()
+	return client.connection.SubscriptionRequestBuilder(), nil
+}
+
+// buildSubscription builds the subscription request of nodes. The tags are
+// named by the index of their node.
+func (client *Client) buildSubscription(indexes []int) (model.PlcSubscriptionRequest, error) {
+	builder, err := client.subscriptionRequestBuilder()
+	if err != nil {
+		return nil, err
+	}
+	for _, index := range indexes {
+		node := client.config.Nodes[index]
+		subscription := client.subscriptionOf(node)
+		switch subscription.Mode {
+		case subscribeCyclic:
+			builder.AddCyclicTagAddress(tagName(index), node.ID, subscription.Interval)
+		case subscribeEvent:
+			builder.AddEventTagAddress(tagName(index), node.ID)
+		default:
+			builder.AddChangeOfStateTagAddress(tagName(index), node.ID)
+		}
+	}
+	return builder.Build()
+}
+
+// consume buffers the values of a subscription event.
+func (client *Client) consume(event model.PlcSubscriptionEvent) {
+	for _, name := range event.GetTagNames() {
+		index, err := strconv.Atoi(strings.TrimPrefix(name, "tag"))
+		if err != nil || index < 0 || index >= len(client.config.Nodes) {
+			continue
+		}
+		code := event.GetResponseCode(name)
+		if code != model.PlcResponseCode_OK {
+			client.push(client.failed(index, code, fmt.Errorf("error reading tag %v: response code %v", client.config.Nodes[index].ID, code.GetName())))
+			continue
+		}
+		response := client.response(index, code)
+		response.value = event.GetValue(name)
+		client.push(response)
+	}
+}
+
+func (client *Client) push(response *ResponseObject) {
+	select {
+	case client.subscription <- response:
+	default:
+		logp.Warn("[PLC4X] Too many buffered values. Increase the period or the interval of cyclic subscriptions")
+	}
+}
+
+// subscribed returns the values buffered since the last Fetch.
+func (client *Client) subscribed() []*ResponseObject {
+	var retVal []*ResponseObject
+	for {
+		select {
+		case response := <-client.subscription:
+			retVal = append(retVal, response)
+		default:
+			if !client.connection.IsConnected() {
+				logp.Info("[PLC4X] The connection of the subscription is lost")
+				client.closeConnection()
+			}
+			return retVal
+		}
+	}
+}
@@ -0,0 +1,47 @@
+package plc4xvalue
+
+import (
+	"time"
+
+	"github.com/elastic/beats/v7/libbeat/logp"
+)
+
+// tagState counts the consecutive failures of a node. Nodes that failed too
+// often are disabled until their next retry.
+type tagState struct {
+	failures      int
+	disabledUntil time.Time
+}
+
+// enabledNodes returns the indexes of the nodes that are read. Disabled nodes
+// are read again once their retry interval passed.
+func (client *Client) enabledNodes(now time.Time) []int {
+	indexes := make([]int, 0, len(client.config.Nodes))
+	for i := range client.config.Nodes {
+		if now.Before(client.tags[i].disabledUntil) {
+			continue
+		}
+		indexes = append(indexes, i)
+	}
+	return indexes
+}
+
+// recordResult counts the failures of a node and disables it after
+// disableTagAfterFailures consecutive failures. Failed read requests of a lost
+// connection are not counted.
+func (client *Client) recordResult(response *ResponseObject, now time.Time, lost bool) {
+	state := &client.tags[response.index]
+	if response.err == nil {
+		*state = tagState{}
+		return
+	}
+	if response.requestFailed && lost {
+		return
+	}
+	state.failures++
+	limit := client.config.DisableTagAfterFailures
+	if limit > 0 && state.failures >= limit {
+		state.disabledUntil = now.Add(client.config.RetryDisabledTagsAfter)
+		logp.Warn("[PLC4X] Tag %v failed %v times, it is disabled until %v", response.node.ID, state.failures, state.disabledUntil.Format(time.RFC3339))
+	}
+}
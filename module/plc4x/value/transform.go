@@ -0,0 +1,86 @@
+package plc4xvalue
+
+import (
+	"github.com/elastic/beats/v7/libbeat/common"
+	"github.com/elastic/beats/v7/libbeat/logp"
+
+	"github.com/apache/plc4x/plc4go/pkg/api/values"
+)
+
+// applyTransforms converts the raw values of all responses with the transformations
+// configured for their nodes. The raw value is kept in the response.
+func applyTransforms(data []*ResponseObject) {
+	for _, response := range data {
+		if !response.node.Transform.Enabled() || response.value == nil {
+			continue
+		}
+		raw := nativeValue(response.value)
+		if raw == nil {
+			continue
+		}
+		transformed, err := response.node.Transform.Apply(raw)
+		if err != nil {
+			logp.Debug("Transform", "Tag %v: %v", response.node.ID, err)
+			continue
+		}
+		response.transformed = transformed
+	}
+}
+
+// nativeValue returns the Go value of a PLC value. Lists are returned as
+// slices and structs as objects of their native values. Values of unknown
+// types return nil.
+func nativeValue(value values.PlcValue) interface{} {
+	if value == nil {
+		return nil
+	}
+	switch value.GetPlcValueType() {
+	case values.BOOL:
+		return value.GetBool()
+	case values.BYTE, values.USINT:
+		return value.GetUint8()
+	case values.WORD, values.UINT:
+		return value.GetUint16()
+	case values.DWORD, values.UDINT:
+		return value.GetUint32()
+	case values.LWORD, values.ULINT:
+		return value.GetUint64()
+	case values.SINT:
+		return value.GetInt8()
+	case values.INT:
+		return value.GetInt16()
+	case values.DINT:
+		return value.GetInt32()
+	case values.LINT:
+		return value.GetInt64()
+	case values.REAL:
+		return value.GetFloat32()
+	case values.LREAL:
+		return value.GetFloat64()
+	case values.CHAR, values.WCHAR, values.STRING, values.WSTRING:
+		return value.GetString()
+	case values.TIME, values.LTIME:
+		return value.GetDuration()
+	case values.DATE, values.LDATE, values.LDATE_AND_TIME:
+		return value.GetDate()
+	case values.TIME_OF_DAY, values.LTIME_OF_DAY:
+		return value.GetTime()
+	case values.DATE_AND_TIME:
+		return value.GetDateTime()
+	case values.RAW_BYTE_ARRAY:
+		return value.GetRaw()
+	case values.List:
+		list := make([]interface{}, 0, value.GetLength())
+		for _, item := range value.GetList() {
+			list = append(list, nativeValue(item))
+		}
+		return list
+	case values.Struct:
+		fields := make(common.MapStr)
+		for key, item := range value.GetStruct() {
+			fields[key] = nativeValue(item)
+		}
+		return fields
+	}
+	return nil
+}
@@ -9,9 +9,11 @@ import (
 	"github.com/elastic/beats/v7/metricbeat/mb"
 
 	"errors"
-	_ "fmt"
+	"fmt"
 
 	"github.com/elastic/beats/v7/libbeat/common"
+	"github.com/elastic/machinebeat/helper/change"
+	"github.com/elastic/machinebeat/helper/typed"
 )
 
 // init registers the MetricSet with the central registry as soon as the program
@@ -30,9 +32,19 @@ type MetricSet struct {
 	mb.BaseMetricSet
 	Endpoint            string `config:"endpoint"`
 	Client              Client
-	MaxTriesToReconnect int    `config:"maxTriesToReconnect"`
-	RetryOnErrorCount   int    `config:"retryOnError"`
-	Nodes               []Node `config:"nodes"`
+	MaxTriesToReconnect int           `config:"maxTriesToReconnect"`
+	RetryOnErrorCount   int           `config:"retryOnError"`
+	Nodes               []Node        `config:"nodes"`
+	ReportByException   change.Config `config:"reportByException"`
+	// Limits of the read requests, 0 tags uses the limit of the driver
+	MaxTagsPerRequest     int `config:"maxTagsPerRequest"`
+	MaxConcurrentRequests int `config:"maxConcurrentRequests"`
+	// Tags that failed too often are disabled and retried later, 0 never disables them
+	DisableTagAfterFailures int           `config:"disableTagAfterFailures"`
+	RetryDisabledTagsAfter  time.Duration `config:"retryDisabledTagsAfter"`
+	// Subscribe subscribes the tags instead of polling them
+	Subscribe    bool         `config:"subscribe"`
+	Subscription Subscription `config:"subscription"`
 }
 
 var clientDefaults = Client{
@@ -40,11 +52,19 @@ var clientDefaults = Client{
 }
 
 var DefaultConfig = MetricSet{
-	Endpoint:            "modbus-tcp://178.128.239.15",
-	Client:              clientDefaults,
-	MaxTriesToReconnect: 5,
-	RetryOnErrorCount:   5,
-	Nodes:               []Node{},
+	Endpoint:                "modbus-tcp://178.128.239.15",
+	Client:                  clientDefaults,
+	MaxTriesToReconnect:     5,
+	RetryOnErrorCount:       5,
+	Nodes:                   []Node{},
+	MaxConcurrentRequests:   4,
+	DisableTagAfterFailures: 5,
+	RetryDisabledTagsAfter:  5 * time.Minute,
+	Subscribe:               false,
+	Subscription: Subscription{
+		Mode:     subscribeChange,
+		Interval: 1 * time.Second,
+	},
 }
 
 // New creates a new instance of the MetricSet. New is responsible for unpacking
@@ -56,24 +76,51 @@ func New(base mb.BaseMetricSet) (mb.MetricSet, error) {
 	if err := base.Module().UnpackConfig(&config); err != nil {
 		return nil, err
 	}
+	if err := config.Subscription.validate(); err != nil {
+		return nil, err
+	}
+	for _, node := range config.Nodes {
+		if node.Subscription == nil {
+			continue
+		}
+		if err := node.Subscription.validate(); err != nil {
+			return nil, fmt.Errorf("tag %v: %v", node.ID, err)
+		}
+	}
 
 	metricset := &MetricSet{
-		BaseMetricSet:       base,
-		Endpoint:            config.Endpoint,
-		Client:              config.Client,
-		RetryOnErrorCount:   config.RetryOnErrorCount,
-		MaxTriesToReconnect: config.MaxTriesToReconnect,
-		Nodes:               config.Nodes,
+		BaseMetricSet:           base,
+		Endpoint:                config.Endpoint,
+		Client:                  config.Client,
+		RetryOnErrorCount:       config.RetryOnErrorCount,
+		MaxTriesToReconnect:     config.MaxTriesToReconnect,
+		Nodes:                   config.Nodes,
+		ReportByException:       config.ReportByException,
+		MaxTagsPerRequest:       config.MaxTagsPerRequest,
+		MaxConcurrentRequests:   config.MaxConcurrentRequests,
+		DisableTagAfterFailures: config.DisableTagAfterFailures,
+		RetryDisabledTagsAfter:  config.RetryDisabledTagsAfter,
+		Subscribe:               config.Subscribe,
+		Subscription:            config.Subscription,
 	}
 
 	metricset.Client.counter = metricset.MaxTriesToReconnect
 	metricset.Client.config = metricset
+	metricset.Client.changes = change.NewDetector()
+	metricset.Client.tags = make([]tagState, len(metricset.Nodes))
 
 	_, err := establishConnection(metricset, 1)
 	if err != nil {
 		return nil, err
 	}
 
+	if metricset.Subscribe {
+		if err := metricset.Client.startSubscription(); err != nil {
+			metricset.Client.closeConnection()
+			return nil, err
+		}
+	}
+
 	return metricset, nil
 }
 
@@ -90,6 +137,29 @@ func establishConnection(config *MetricSet, retryCounter int) (bool, error) {
 	return false, errors.New("Connection was not possible")
 }
 
+// reportByException drops the values that did not change since they were last published.
+func (client *Client) reportByException(data []*ResponseObject) []*ResponseObject {
+	var retVal []*ResponseObject
+	now := time.Now()
+	for _, response := range data {
+		config := response.node.ReportByException
+		if config == nil {
+			config = &client.config.ReportByException
+		}
+		value := response.transformed
+		if value == nil && response.value != nil {
+			value = nativeValue(response.value)
+			if value == nil {
+				value = response.value.GetString()
+			}
+		}
+		if client.changes.Report(config, response.node.ID, value, response.status, now) {
+			retVal = append(retVal, response)
+		}
+	}
+	return retVal
+}
+
 func publishResponses(data []*ResponseObject, report mb.ReporterV2, config *MetricSet) {
 	logp.Info("[PLC4X] Publishing %v new events", len(data))
 	for _, response := range data {
@@ -104,8 +174,24 @@ func publishResponses(data []*ResponseObject, report mb.ReporterV2, config *Metr
 		root.Put("sensor.id", response.node.ID)
 
 		event := make(common.MapStr)
-		event.Put("type", response.value.GetPlcValueType().String())
-		event.Put("value", response.value.GetString())
+		event.Put("status", response.status)
+		if response.err != nil {
+			//Tags that weren't read are published as error documents
+			mbEvent.Error = response.err
+		} else {
+			event.Put("type", response.value.GetPlcValueType().String())
+			if unit := response.node.Transform.OutputUnit(); unit != "" {
+				root.Put("value.unit", unit)
+			}
+			raw := nativeValue(response.value)
+			if response.transformed != nil {
+				//The raw value is kept next to the transformed value
+				root.Put("value.raw", raw)
+				typed.Put(root, response.transformed)
+			} else {
+				typed.Put(root, raw)
+			}
+		}
 
 		mbEvent.RootFields = root
 		mbEvent.MetricSetFields = event
@@ -118,11 +204,14 @@ func publishResponses(data []*ResponseObject, report mb.ReporterV2, config *Metr
 // of an error set the Error field of mb.Event or simply call report.Error().
 func (m *MetricSet) Fetch(report mb.ReporterV2) error {
 	if m.Client.connected {
-		resp, err := m.Client.read()
-		if err != nil {
-			logp.Info("[PLC4X] Data Collection failed")
-			return err
+		var resp []*ResponseObject
+		if m.Subscribe {
+			resp = m.Client.subscribed()
+		} else {
+			resp = m.Client.read()
 		}
+		applyTransforms(resp)
+		resp = m.Client.reportByException(resp)
 		publishResponses(resp, report, m)
 
 	} else {
@@ -134,6 +223,15 @@ func (m *MetricSet) Fetch(report mb.ReporterV2) error {
 			logp.Info("[PLC4X] Reconnect was not successful")
 			return err
 		}
+		//Publish every value again after a reconnect
+		m.Client.changes.Reset()
+		if m.Subscribe {
+			if err := m.Client.startSubscription(); err != nil {
+				logp.Info("[PLC4X] Subscribe was not successful")
+				m.Client.closeConnection()
+				return err
+			}
+		}
 	}
 	return nil
 }
@@ -0,0 +1,190 @@
+package mqtt
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/elastic/beats/v7/libbeat/beat"
+	"github.com/elastic/beats/v7/libbeat/logp"
+	"github.com/elastic/beats/v7/libbeat/outputs"
+	"github.com/elastic/beats/v7/libbeat/outputs/codec"
+	"github.com/elastic/beats/v7/libbeat/outputs/outil"
+	"github.com/elastic/beats/v7/libbeat/publisher"
+
+	MQTT "github.com/eclipse/paho.mqtt.golang"
+)
+
+// client publishes the events of a batch as MQTT messages to a broker. The
+// events are acknowledged when the broker acknowledged their messages, with
+// QoS 0 when they are written to the connection.
+type client struct {
+	log      *logp.Logger
+	observer outputs.Observer
+	host     string
+	options  *MQTT.ClientOptions
+	topic    outil.Selector
+	index    string
+	codec    codec.Codec
+	qos      byte
+	retain   bool
+	timeout  time.Duration
+
+	mqtt      MQTT.Client
+	sparkplug *sparkplugEncoder
+}
+
+func newClient(
+	observer outputs.Observer,
+	host string,
+	options *MQTT.ClientOptions,
+	topic outil.Selector,
+	index string,
+	codec codec.Codec,
+	qos byte,
+	retain bool,
+	timeout time.Duration,
+) *client {
+	c := &client{
+		log:      logp.NewLogger(logSelector),
+		observer: observer,
+		host:     host,
+		options:  options,
+		topic:    topic,
+		index:    index,
+		codec:    codec,
+		qos:      qos,
+		retain:   retain,
+		timeout:  timeout,
+	}
+	if codec == nil {
+		c.sparkplug = &sparkplugEncoder{}
+		c.sparkplug.reset()
+	}
+	return c
+}
+
+func (c *client) Connect() error {
+	c.log.Debugf("connect to MQTT broker %v", c.host)
+	c.mqtt = MQTT.NewClient(c.options)
+	token := c.mqtt.Connect()
+	if !token.WaitTimeout(c.timeout) {
+		return fmt.Errorf("timeout connecting to MQTT broker %v", c.host)
+	}
+	if err := token.Error(); err != nil {
+		return fmt.Errorf("failed to connect to MQTT broker %v: %v", c.host, err)
+	}
+	if c.sparkplug != nil {
+		c.sparkplug.reset()
+	}
+	return nil
+}
+
+func (c *client) Close() error {
+	if c.mqtt != nil {
+		c.mqtt.Disconnect(250)
+		c.mqtt = nil
+	}
+	return nil
+}
+
+// Publish sends all messages of the batch before it waits for their
+// acknowledgements. Events whose messages weren't acknowledged within the
+// timeout are retried after a reconnect.
+func (c *client) Publish(_ context.Context, batch publisher.Batch) error {
+	events := batch.Events()
+	c.observer.NewBatch(len(events))
+
+	tokens := make([]MQTT.Token, len(events))
+	dropped := 0
+	for i := range events {
+		event := &events[i].Content
+		topic, payload, err := c.encode(event)
+		if err != nil {
+			c.log.Errorf("Dropping event: %v", err)
+			dropped++
+			continue
+		}
+		c.observer.WriteBytes(len(payload))
+		tokens[i] = c.mqtt.Publish(topic, c.qos, c.retain, payload)
+	}
+
+	var failed []publisher.Event
+	var lastErr error
+	deadline := time.Now().Add(c.timeout)
+	for i, token := range tokens {
+		if token == nil {
+			continue
+		}
+		if !waitToken(token, deadline) {
+			lastErr = fmt.Errorf("no acknowledgement of MQTT broker %v within %v", c.host, c.timeout)
+			failed = append(failed, events[i])
+			continue
+		}
+		if err := token.Error(); err != nil {
+			lastErr = err
+			failed = append(failed, events[i])
+		}
+	}
+
+	c.observer.Dropped(dropped)
+	c.observer.Acked(len(events) - dropped - len(failed))
+	if len(failed) > 0 {
+		c.observer.Failed(len(failed))
+		c.observer.WriteError(lastErr)
+		batch.RetryEvents(failed)
+		// The connection is closed and reconnected with backoff
+		return lastErr
+	}
+	batch.ACK()
+	return nil
+}
+
+func (c *client) String() string {
+	return "mqtt(" + c.host + ")"
+}
+
+// encode returns the topic and the payload of an event.
+func (c *client) encode(event *beat.Event) (string, []byte, error) {
+	topic, err := c.topic.Select(event)
+	if err != nil {
+		return "", nil, fmt.Errorf("failed to select topic: %v", err)
+	}
+	if topic == "" {
+		return "", nil, errors.New("topic of event is empty")
+	}
+	if strings.ContainsAny(topic, "+#") {
+		return "", nil, fmt.Errorf("topic %v must not contain wildcards", topic)
+	}
+
+	var payload []byte
+	if c.sparkplug != nil {
+		payload, err = c.sparkplug.encode(topic, event)
+	} else {
+		payload, err = c.codec.Encode(c.index, event)
+	}
+	if err != nil {
+		return "", nil, fmt.Errorf("failed to encode event for %v: %v", topic, err)
+	}
+	// The codec may reuse its buffer for the next event
+	return topic, append([]byte(nil), payload...), nil
+}
+
+// waitToken waits until the token completed or the deadline passed.
+func waitToken(token MQTT.Token, deadline time.Time) bool {
+	select {
+	case <-token.Done():
+		return true
+	default:
+	}
+	timer := time.NewTimer(time.Until(deadline))
+	defer timer.Stop()
+	select {
+	case <-token.Done():
+		return true
+	case <-timer.C:
+		return false
+	}
+}
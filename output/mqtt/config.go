@@ -0,0 +1,71 @@
+package mqtt
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/elastic/beats/v7/libbeat/common/transport/tlscommon"
+	"github.com/elastic/beats/v7/libbeat/outputs/codec"
+)
+
+// Encodings of the event payloads
+const (
+	encodingJSON      = "json"
+	encodingSparkplug = "sparkplug"
+)
+
+type mqttConfig struct {
+	ClientID    string            `config:"client_id"`
+	Username    string            `config:"username"`
+	Password    string            `config:"password"`
+	QoS         int               `config:"qos"`
+	Retain      bool              `config:"retain"`
+	Encoding    string            `config:"encoding"`
+	Codec       codec.Config      `config:"codec"`
+	LoadBalance bool              `config:"loadbalance"`
+	Timeout     time.Duration     `config:"timeout"`
+	KeepAlive   time.Duration     `config:"keep_alive"`
+	BulkMaxSize int               `config:"bulk_max_size"`
+	MaxRetries  int               `config:"max_retries"`
+	TLS         *tlscommon.Config `config:"ssl"`
+	Backoff     backoff           `config:"backoff"`
+}
+
+type backoff struct {
+	Init time.Duration
+	Max  time.Duration
+}
+
+var (
+	defaultConfig = mqttConfig{
+		QoS:         1,
+		Encoding:    encodingJSON,
+		LoadBalance: false,
+		Timeout:     30 * time.Second,
+		KeepAlive:   30 * time.Second,
+		BulkMaxSize: 128,
+		MaxRetries:  3,
+		Backoff: backoff{
+			Init: 1 * time.Second,
+			Max:  60 * time.Second,
+		},
+	}
+)
+
+func (c *mqttConfig) Validate() error {
+	if c.QoS < 0 || c.QoS > 2 {
+		return fmt.Errorf("qos must be 0, 1 or 2, got %v", c.QoS)
+	}
+	switch c.Encoding {
+	case encodingJSON, encodingSparkplug:
+	default:
+		return fmt.Errorf("unknown encoding %q, use %v or %v", c.Encoding, encodingJSON, encodingSparkplug)
+	}
+	if c.Timeout <= 0 {
+		return fmt.Errorf("timeout must be larger than 0")
+	}
+	if c.BulkMaxSize <= 0 {
+		return fmt.Errorf("bulk_max_size must be larger than 0")
+	}
+	return nil
+}
@@ -0,0 +1,128 @@
+// Package mqtt is a libbeat output that publishes events to MQTT brokers.
+package mqtt
+
+import (
+	"fmt"
+	"net/url"
+	"strings"
+
+	"github.com/elastic/beats/v7/libbeat/beat"
+	"github.com/elastic/beats/v7/libbeat/common"
+	"github.com/elastic/beats/v7/libbeat/common/transport/tlscommon"
+	"github.com/elastic/beats/v7/libbeat/outputs"
+	"github.com/elastic/beats/v7/libbeat/outputs/codec"
+	"github.com/elastic/beats/v7/libbeat/outputs/outil"
+
+	MQTT "github.com/eclipse/paho.mqtt.golang"
+)
+
+const logSelector = "mqtt"
+
+func init() {
+	outputs.RegisterType("mqtt", makeMQTT)
+}
+
+func makeMQTT(
+	_ outputs.IndexManager,
+	beat beat.Info,
+	observer outputs.Observer,
+	cfg *common.Config,
+) (outputs.Group, error) {
+	config := defaultConfig
+	if err := cfg.Unpack(&config); err != nil {
+		return outputs.Fail(err)
+	}
+	if config.ClientID == "" {
+		config.ClientID = beat.Beat + "-output"
+	}
+
+	topic, err := buildTopicSelector(cfg)
+	if err != nil {
+		return outputs.Fail(err)
+	}
+
+	hosts, err := outputs.ReadHostList(cfg)
+	if err != nil {
+		return outputs.Fail(err)
+	}
+
+	tls, err := tlscommon.LoadTLSConfig(config.TLS)
+	if err != nil {
+		return outputs.Fail(err)
+	}
+
+	clients := make([]outputs.NetworkClient, len(hosts))
+	for i, host := range hosts {
+		brokerURL, err := parseBrokerURL(host)
+		if err != nil {
+			return outputs.Fail(err)
+		}
+
+		var enc codec.Codec
+		if config.Encoding == encodingJSON {
+			enc, err = codec.CreateEncoder(beat, config.Codec)
+			if err != nil {
+				return outputs.Fail(err)
+			}
+		}
+
+		options := MQTT.NewClientOptions()
+		options.AddBroker(brokerURL.String())
+		options.SetClientID(config.ClientID)
+		options.SetUsername(config.Username)
+		options.SetPassword(config.Password)
+		options.SetKeepAlive(config.KeepAlive)
+		options.SetConnectTimeout(config.Timeout)
+		// The pipeline reconnects with backoff and retries the failed events
+		options.SetAutoReconnect(false)
+		if tls != nil {
+			options.SetTLSConfig(tls.BuildModuleClientConfig(brokerURL.Hostname()))
+		}
+
+		client := newClient(observer, brokerURL.Redacted(), options, topic, beat.IndexPrefix, enc, byte(config.QoS), config.Retain, config.Timeout)
+		clients[i] = outputs.WithBackoff(client, config.Backoff.Init, config.Backoff.Max)
+	}
+
+	return outputs.SuccessNet(config.LoadBalance, config.BulkMaxSize, config.MaxRetries, clients)
+}
+
+func buildTopicSelector(cfg *common.Config) (outil.Selector, error) {
+	return outil.BuildSelectorFromConfig(cfg, outil.Settings{
+		Key:              "topic",
+		MultiKey:         "topics",
+		EnableSingleOnly: true,
+		FailEmpty:        true,
+		Case:             outil.SelectorKeepCase,
+	})
+}
+
+// parseBrokerURL parses a host of the output. Hosts without scheme use tcp,
+// the schemes ssl, ws and wss of the MQTT client are supported as well.
+func parseBrokerURL(host string) (*url.URL, error) {
+	if !strings.Contains(host, "://") {
+		host = "tcp://" + host
+	}
+	u, err := url.Parse(host)
+	if err != nil {
+		return nil, fmt.Errorf("invalid MQTT host %v: %v", host, err)
+	}
+	switch strings.ToLower(u.Scheme) {
+	case "tcp", "mqtt":
+		u.Scheme = "tcp"
+		if u.Port() == "" {
+			u.Host += ":1883"
+		}
+	case "ssl", "tls", "tcps", "mqtts":
+		u.Scheme = "ssl"
+		if u.Port() == "" {
+			u.Host += ":8883"
+		}
+	case "ws", "wss":
+	default:
+		return nil, fmt.Errorf("unsupported scheme %q of MQTT host %v", u.Scheme, host)
+	}
+	if u.Hostname() == "" {
+		return nil, fmt.Errorf("MQTT host %v has no hostname", host)
+	}
+	return u, nil
+}
@@ -0,0 +1,36 @@
+package mqtt
+
+import "testing"
+
+func TestParseBrokerURL(t *testing.T) {
+	tests := []struct {
+		host string
+		want string
+	}{
+		{"localhost", "tcp://localhost:1883"},
+		{"broker:1884", "tcp://broker:1884"},
+		{"mqtt://broker", "tcp://broker:1883"},
+		{"tcp://broker:1883", "tcp://broker:1883"},
+		{"ssl://broker", "ssl://broker:8883"},
+		{"mqtts://broker:9883", "ssl://broker:9883"},
+		{"tls://broker", "ssl://broker:8883"},
+		{"ws://broker:8080/mqtt", "ws://broker:8080/mqtt"},
+		{"wss://broker/mqtt", "wss://broker/mqtt"},
+	}
+	for _, test := range tests {
+		u, err := parseBrokerURL(test.host)
+		if err != nil {
+			t.Errorf("%v: %v", test.host, err)
+			continue
+		}
+		if u.String() != test.want {
+			t.Errorf("%v: got %v, want %v", test.host, u, test.want)
+		}
+	}
+
+	for _, host := range []string{"http://broker", "tcp://:1883", "tcp://bro ker"} {
+		if u, err := parseBrokerURL(host); err == nil {
+			t.Errorf("%v: expected an error, got %v", host, u)
+		}
+	}
+}
@@ -0,0 +1,161 @@
+package mqtt
+
+import (
+	"encoding/json"
+	"fmt"
+	"math"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/elastic/beats/v7/libbeat/beat"
+	"github.com/elastic/beats/v7/libbeat/common"
+
+	"google.golang.org/protobuf/encoding/protowire"
+)
+
+// Sparkplug B data types as defined in sparkplug_b.proto
+const (
+	spInt64    = 4
+	spUInt64   = 8
+	spFloat    = 9
+	spDouble   = 10
+	spBoolean  = 11
+	spString   = 12
+	spDateTime = 13
+	spBytes    = 17
+)
+
+// sparkplugEncoder encodes events as Sparkplug B payloads. Every field of an
+// event becomes a metric, nested fields are named with / like a/b/c. Birth
+// and death certificates are not published, so the topics should be the DATA
+// topics of the edge nodes and devices that are already born. The encoding is
+// not strictly compliant, the sequence number advances with every encoded
+// event, also for events whose batch is retried.
+type sparkplugEncoder struct {
+	seq map[string]uint64
+}
+
+// reset restarts the sequence numbers for a new connection.
+func (e *sparkplugEncoder) reset() {
+	e.seq = make(map[string]uint64)
+}
+
+// edgeNode returns the group and edge node of a Sparkplug B topic, which
+// share a sequence number. Other topics have their own.
+func edgeNode(topic string) string {
+	levels := strings.Split(topic, "/")
+	if len(levels) >= 4 && levels[0] == "spBv1.0" {
+		return levels[1] + "/" + levels[3]
+	}
+	return topic
+}
+
+func (e *sparkplugEncoder) encode(topic string, event *beat.Event) ([]byte, error) {
+	fields := event.Fields.Flatten()
+	names := make([]string, 0, len(fields))
+	for name := range fields {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	timestamp := uint64(event.Timestamp.UnixMilli())
+	var payload []byte
+	payload = protowire.AppendTag(payload, 1, protowire.VarintType)
+	payload = protowire.AppendVarint(payload, timestamp)
+	for _, name := range names {
+		metric, err := encodeMetric(strings.ReplaceAll(name, ".", "/"), timestamp, fields[name])
+		if err != nil {
+			return nil, err
+		}
+		payload = protowire.AppendTag(payload, 2, protowire.BytesType)
+		payload = protowire.AppendBytes(payload, metric)
+	}
+	payload = protowire.AppendTag(payload, 3, protowire.VarintType)
+	node := edgeNode(topic)
+	payload = protowire.AppendVarint(payload, e.seq[node])
+	// The sequence number of Sparkplug B wraps after 255
+	e.seq[node] = (e.seq[node] + 1) % 256
+	return payload, nil
+}
+
+// encodeMetric encodes a field as metric with the data type of its Go type.
+// Values without a Sparkplug B type are encoded as JSON strings.
+func encodeMetric(name string, timestamp uint64, value interface{}) ([]byte, error) {
+	var metric []byte
+	metric = protowire.AppendTag(metric, 1, protowire.BytesType)
+	metric = protowire.AppendString(metric, name)
+	metric = protowire.AppendTag(metric, 3, protowire.VarintType)
+	metric = protowire.AppendVarint(metric, timestamp)
+
+	appendType := func(datatype uint64) {
+		metric = protowire.AppendTag(metric, 4, protowire.VarintType)
+		metric = protowire.AppendVarint(metric, datatype)
+	}
+	appendLong := func(datatype uint64, v uint64) {
+		appendType(datatype)
+		metric = protowire.AppendTag(metric, 11, protowire.VarintType)
+		metric = protowire.AppendVarint(metric, v)
+	}
+	appendString := func(v string) {
+		appendType(spString)
+		metric = protowire.AppendTag(metric, 15, protowire.BytesType)
+		metric = protowire.AppendString(metric, v)
+	}
+
+	switch v := value.(type) {
+	case nil:
+		appendType(spString)
+		metric = protowire.AppendTag(metric, 7, protowire.VarintType)
+		metric = protowire.AppendVarint(metric, 1)
+	case bool:
+		appendType(spBoolean)
+		metric = protowire.AppendTag(metric, 14, protowire.VarintType)
+		metric = protowire.AppendVarint(metric, protowire.EncodeBool(v))
+	case int:
+		appendLong(spInt64, uint64(v))
+	case int8:
+		appendLong(spInt64, uint64(v))
+	case int16:
+		appendLong(spInt64, uint64(v))
+	case int32:
+		appendLong(spInt64, uint64(v))
+	case int64:
+		appendLong(spInt64, uint64(v))
+	case uint:
+		appendLong(spUInt64, uint64(v))
+	case uint8:
+		appendLong(spUInt64, uint64(v))
+	case uint16:
+		appendLong(spUInt64, uint64(v))
+	case uint32:
+		appendLong(spUInt64, uint64(v))
+	case uint64:
+		appendLong(spUInt64, v)
+	case float32:
+		appendType(spFloat)
+		metric = protowire.AppendTag(metric, 12, protowire.Fixed32Type)
+		metric = protowire.AppendFixed32(metric, math.Float32bits(v))
+	case float64:
+		appendType(spDouble)
+		metric = protowire.AppendTag(metric, 13, protowire.Fixed64Type)
+		metric = protowire.AppendFixed64(metric, math.Float64bits(v))
+	case string:
+		appendString(v)
+	case time.Time:
+		appendLong(spDateTime, uint64(v.UnixMilli()))
+	case common.Time:
+		appendLong(spDateTime, uint64(time.Time(v).UnixMilli()))
+	case []byte:
+		appendType(spBytes)
+		metric = protowire.AppendTag(metric, 16, protowire.BytesType)
+		metric = protowire.AppendBytes(metric, v)
+	default:
+		b, err := json.Marshal(v)
+		if err != nil {
+			return nil, fmt.Errorf("failed to encode metric %v: %v", name, err)
+		}
+		appendString(string(b))
+	}
+	return metric, nil
+}
@@ -0,0 +1,137 @@
+package mqtt
+
+import (
+	"bytes"
+	"io/ioutil"
+	"math"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/elastic/beats/v7/libbeat/beat"
+	"github.com/elastic/beats/v7/libbeat/common"
+
+	"google.golang.org/protobuf/encoding/protowire"
+)
+
+// metricFields decodes the fields of an encoded metric by field number.
+func metricFields(t *testing.T, b []byte) map[protowire.Number]interface{} {
+	fields := make(map[protowire.Number]interface{})
+	for len(b) > 0 {
+		num, typ, n := protowire.ConsumeTag(b)
+		if n < 0 {
+			t.Fatalf("invalid tag: %v", protowire.ParseError(n))
+		}
+		b = b[n:]
+		var value interface{}
+		switch typ {
+		case protowire.VarintType:
+			value, n = protowire.ConsumeVarint(b)
+		case protowire.Fixed32Type:
+			value, n = protowire.ConsumeFixed32(b)
+		case protowire.Fixed64Type:
+			value, n = protowire.ConsumeFixed64(b)
+		case protowire.BytesType:
+			value, n = protowire.ConsumeBytes(b)
+		default:
+			t.Fatalf("unexpected wire type %v", typ)
+		}
+		if n < 0 {
+			t.Fatalf("invalid field %v: %v", num, protowire.ParseError(n))
+		}
+		fields[num] = value
+		b = b[n:]
+	}
+	return fields
+}
+
+func TestEncodeMetric(t *testing.T) {
+	ts := time.Date(2023, 4, 19, 14, 21, 42, 0, time.UTC)
+	tests := []struct {
+		name     string
+		value    interface{}
+		datatype uint64
+		field    protowire.Number
+		want     interface{}
+	}{
+		{"bool", true, spBoolean, 14, uint64(1)},
+		{"int", -2, spInt64, 11, uint64(math.MaxUint64 - 1)},
+		{"int32", int32(42), spInt64, 11, uint64(42)},
+		{"uint16", uint16(7), spUInt64, 11, uint64(7)},
+		{"uint64", uint64(math.MaxUint64), spUInt64, 11, uint64(math.MaxUint64)},
+		{"float32", float32(1.5), spFloat, 12, math.Float32bits(1.5)},
+		{"float64", 21.3, spDouble, 13, math.Float64bits(21.3)},
+		{"string", "running", spString, 15, []byte("running")},
+		{"time", ts, spDateTime, 11, uint64(ts.UnixMilli())},
+		{"common.Time", common.Time(ts), spDateTime, 11, uint64(ts.UnixMilli())},
+		{"bytes", []byte{1, 2}, spBytes, 16, []byte{1, 2}},
+		{"object", map[string]interface{}{"a": 1}, spString, 15, []byte(`{"a":1}`)},
+		{"nil", nil, spString, 7, uint64(1)},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			b, err := encodeMetric("a/b", 1000, test.value)
+			if err != nil {
+				t.Fatal(err)
+			}
+			fields := metricFields(t, b)
+			if name := string(fields[1].([]byte)); name != "a/b" {
+				t.Errorf("name = %v, want a/b", name)
+			}
+			if timestamp := fields[3]; timestamp != uint64(1000) {
+				t.Errorf("timestamp = %v, want 1000", timestamp)
+			}
+			if datatype := fields[4]; datatype != test.datatype {
+				t.Errorf("datatype = %v, want %v", datatype, test.datatype)
+			}
+			if value := fields[test.field]; !reflect.DeepEqual(value, test.want) {
+				t.Errorf("field %v = %#v, want %#v", test.field, value, test.want)
+			}
+		})
+	}
+}
+
+func TestEncodeMetricUnsupported(t *testing.T) {
+	if _, err := encodeMetric("a", 0, make(chan int)); err == nil {
+		t.Error("expected an error for a value that can't be encoded")
+	}
+}
+
+// goldenEvent is the event of testdata/sparkplug_ddata.pb, which the tests of
+// the Sparkplug B decoder of the mqtt module decode.
+func goldenEvent() *beat.Event {
+	return &beat.Event{
+		Timestamp: time.Date(2023, 4, 19, 14, 21, 42, 0, time.UTC),
+		Fields: common.MapStr{
+			"sensor": common.MapStr{
+				"name":   "temperature",
+				"active": true,
+			},
+			"value": common.MapStr{
+				"value_float64": 21.5,
+				"value_float32": float32(1.5),
+				"value_int64":   int64(-7),
+				"value_uint64":  uint64(42),
+				"raw":           []byte{1, 2},
+				"unit":          nil,
+			},
+			"tags": []string{"line1"},
+		},
+	}
+}
+
+func TestSparkplugEncoderGolden(t *testing.T) {
+	golden, err := ioutil.ReadFile("testdata/sparkplug_ddata.pb")
+	if err != nil {
+		t.Fatal(err)
+	}
+	encoder := &sparkplugEncoder{}
+	encoder.reset()
+	payload, err := encoder.encode("spBv1.0/plant/DDATA/edge1/press1", goldenEvent())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(payload, golden) {
+		t.Errorf("got payload %x, want %x", payload, golden)
+	}
+}